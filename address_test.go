@@ -0,0 +1,132 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func parseTestCIDRs(t *testing.T, groups ...[]string) [][]*net.IPNet {
+	var result [][]*net.IPNet
+	for _, group := range groups {
+		var blocks []*net.IPNet
+		for _, cidr := range group {
+			_, block, err := net.ParseCIDR(cidr)
+			require.NoError(t, err)
+			blocks = append(blocks, block)
+		}
+		result = append(result, blocks)
+	}
+	return result
+}
+
+func TestSelectIP(t *testing.T) {
+
+	ips := []net.IP{
+		net.ParseIP("127.0.0.1"),
+		net.ParseIP("fd12:3456::10"),
+		net.ParseIP("fe80::1"),
+		net.ParseIP("192.168.1.5"),
+		net.ParseIP("10.1.2.3"),
+	}
+
+	ip, ok := selectIP(ips, parseTestCIDRs(t, defaultLocalIPPreferences...))
+	require.True(t, ok)
+	require.Equal(t, "192.168.1.5", ip.String())
+
+	// unique local address is used when there is no private IPv4
+	ip, ok = selectIP(ips[:3], parseTestCIDRs(t, defaultLocalIPPreferences...))
+	require.True(t, ok)
+	require.Equal(t, "fd12:3456::10", ip.String())
+
+	ip, ok = selectIP(ips, parseTestCIDRs(t, []string{"10.0.0.0/8"}, []string{"192.168.0.0/16"}))
+	require.True(t, ok)
+	require.Equal(t, "10.1.2.3", ip.String())
+
+	_, ok = selectIP(ips, parseTestCIDRs(t, []string{"172.16.0.0/12"}))
+	require.False(t, ok)
+
+	_, err := PreferredLocalIP([]string{"not-a-cidr"})
+	require.Error(t, err)
+}
+
+func TestHostAndPortNumber(t *testing.T) {
+
+	for addr, expected := range map[string]struct {
+		host string
+		port int
+	}{
+		"10.0.0.1:7000":      {"10.0.0.1", 7000},
+		"[fd00::1]:7000":     {"fd00::1", 7000},
+		"raft-0.local:7000":  {"raft-0.local", 7000},
+		":7000":              {"", 7000},
+	} {
+		host, port, err := getHostAndPortNumber(addr)
+		require.NoError(t, err, addr)
+		require.Equal(t, expected.host, host, addr)
+		require.Equal(t, expected.port, port, addr)
+	}
+
+	for _, addr := range []string{"fd00::1:7000", "10.0.0.1", "10.0.0.1:port"} {
+		_, _, err := getHostAndPortNumber(addr)
+		require.Error(t, err, addr)
+	}
+
+	pool := &implRaftClientPool{portDiff: 1000}
+	endpoint, err := pool.GetAPIEndpoint("[fd00::1]:7000")
+	require.NoError(t, err)
+	require.Equal(t, "[fd00::1]:8000", endpoint)
+}
+
+func TestAdvertiseHostName(t *testing.T) {
+
+	server := &implRaftServer{AdvertiseAddress: "localhost:7000"}
+	addr, err := server.advertiseAddress()
+	require.NoError(t, err)
+	require.Equal(t, HostAddr{Address: "localhost:7000"}, addr)
+
+	server.AdvertiseAddress = "[fd00::1]:7000"
+	addr, err = server.advertiseAddress()
+	require.NoError(t, err)
+	require.Equal(t, "[fd00::1]:7000", addr.String())
+
+	server.AdvertiseAddress = "localhost"
+	_, err = server.advertiseAddress()
+	require.Error(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+
+	advertise := HostAddr{Address: net.JoinHostPort("localhost", port)}
+	var stream raft.StreamLayer
+	transport, err := newTCPTransport(listener, advertise, nil, nil, func(s raft.StreamLayer) *raft.NetworkTransport {
+		stream = s
+		return raft.NewNetworkTransport(s, 1, time.Second, nil)
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	require.Equal(t, raft.ServerAddress(advertise.Address), transport.LocalAddr())
+
+	// host name is resolved when the peer is dialed
+	conn, err := stream.Dial(transport.LocalAddr(), time.Second)
+	require.NoError(t, err)
+	conn.Close()
+}
@@ -0,0 +1,426 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/hashicorp/raft"
+	"google.golang.org/grpc"
+	"io"
+	"reflect"
+	"time"
+)
+
+var RaftMembershipClass = reflect.TypeOf((*RaftMembership)(nil)).Elem()
+
+/**
+Cluster membership operations implemented by raft-server bean.
+If the local node is not the leader, request would be forwarded to the leader through RaftClientPool.
+ */
+type RaftMembership interface {
+
+	/**
+	Adds node to the cluster as a voter, replaces the stale entry if node has a different address.
+	 */
+	Join(nodeId, address string) error
+
+	/**
+	Removes the local node from the cluster.
+	 */
+	Leave() error
+
+	/**
+	Removes node from the cluster.
+	 */
+	RemovePeer(nodeId string) error
+
+}
+
+type RaftEventType int
+
+const (
+	/**
+	Local node became the leader.
+	 */
+	LeaderElected RaftEventType = iota
+
+	/**
+	Local node lost the leadership.
+	 */
+	LeaderLost
+
+	/**
+	Cluster leader changed, NodeId and Address are empty if there is no leader.
+	 */
+	LeaderChanged
+
+	/**
+	Leader started replication to the peer.
+	 */
+	PeerAdded
+
+	/**
+	Leader stopped replication to the peer.
+	 */
+	PeerRemoved
+
+	/**
+	Leader failed to heartbeat the peer, LastContact has the time of the last successful contact.
+	 */
+	PeerHeartbeatFailed
+
+	/**
+	Leader resumed to heartbeat the peer after failures.
+	 */
+	PeerHeartbeatResumed
+
+	/**
+	Local node changed the raft state.
+	 */
+	StateChanged
+)
+
+func (t RaftEventType) String() string {
+	switch t {
+	case LeaderElected:
+		return "LeaderElected"
+	case LeaderLost:
+		return "LeaderLost"
+	case LeaderChanged:
+		return "LeaderChanged"
+	case PeerAdded:
+		return "PeerAdded"
+	case PeerRemoved:
+		return "PeerRemoved"
+	case PeerHeartbeatFailed:
+		return "PeerHeartbeatFailed"
+	case PeerHeartbeatResumed:
+		return "PeerHeartbeatResumed"
+	case StateChanged:
+		return "StateChanged"
+	default:
+		return "Unknown"
+	}
+}
+
+type RaftEvent struct {
+	Type         RaftEventType
+	State        raft.RaftState       // current state of the local node
+	NodeId       raft.ServerID        // optional, leader or peer
+	Address      raft.ServerAddress   // optional, leader or peer
+	LastContact  time.Time            // optional
+}
+
+var RaftEventListenerClass = reflect.TypeOf((*RaftEventListener)(nil)).Elem()
+
+/**
+Beans implementing this interface are registered by raft-server automatically.
+Events are delivered sequentially from the single goroutine, listener should not block.
+ */
+type RaftEventListener interface {
+
+	OnRaftEvent(event RaftEvent)
+
+}
+
+var RaftEventsClass = reflect.TypeOf((*RaftEvents)(nil)).Elem()
+
+/**
+Subscription to the leadership and cluster change events implemented by raft-server bean.
+ */
+type RaftEvents interface {
+
+	/**
+	Registers listener and returns the handle to remove it.
+	 */
+	AddEventListener(listener RaftEventListener) int64
+
+	/**
+	Creates buffered channel of events and returns the handle to remove it.
+	Events are dropped if channel is full, channel is closed on removal.
+	 */
+	EventChannel(size int) (<-chan RaftEvent, int64)
+
+	/**
+	Removes listener or channel by handle.
+	 */
+	RemoveEventListener(handle int64)
+
+}
+
+var RaftApplierClass = reflect.TypeOf((*RaftApplier)(nil)).Elem()
+
+/**
+Leader-forwarding command apply implemented by raft-server bean.
+ */
+type RaftApplier interface {
+
+	/**
+	Applies command locally on the leader, otherwise forwards it to the leader through RaftClientPool.
+	Retries on leader change until context deadline or 'raft-server.timeout' if context has no deadline.
+
+	Returns FSM response, that could be nil, []byte or proto.Message for forwarded commands,
+	error and raftapi.FSMResponse responses are converted to the error and *raftpb.Status accordingly.
+	 */
+	Apply(ctx context.Context, cmd []byte) (interface{}, error)
+
+}
+
+var RaftReaderClass = reflect.TypeOf((*RaftReader)(nil)).Elem()
+
+/**
+Linearizable reads implemented by raft-server bean.
+ */
+type RaftReader interface {
+
+	/**
+	Runs fn after the local FSM has applied all entries committed before the call.
+	On the leader it verifies leadership and waits for barrier, or uses lease if 'raft-server.read-mode' is 'lease'.
+	On the follower it requests read index from the leader if 'raft-server.follower-read' is enabled,
+	otherwise returns raft.ErrNotLeader.
+	 */
+	ConsistentRead(ctx context.Context, fn func() error) error
+
+	/**
+	Returns the index that must be applied before read, runs on the leader only.
+	 */
+	ReadIndex(ctx context.Context) (uint64, error)
+
+}
+
+var RaftSnapshotterClass = reflect.TypeOf((*RaftSnapshotter)(nil)).Elem()
+
+/**
+On-demand snapshots implemented by raft-server bean.
+ */
+type RaftSnapshotter interface {
+
+	/**
+	Takes the snapshot of the local FSM and waits until it is persisted or context is done.
+	Scheduled snapshots are configured by 'raft-server.snapshot-schedule' and 'raft-server.snapshot-log-size' properties.
+	 */
+	TakeSnapshot(ctx context.Context) (*raft.SnapshotMeta, error)
+
+}
+
+var SnapshotRewriterClass = reflect.TypeOf((*SnapshotRewriter)(nil)).Elem()
+
+/**
+Snapshot store that can replace content of the existing snapshot keeping its ID and metadata.
+Used by the key rotation, because snapshots created for re-encryption would be reaped by retention.
+ */
+type SnapshotRewriter interface {
+
+	/**
+	Runs fn with the current content and the writer of the new content, replaces content if fn succeeds.
+	 */
+	Rewrite(id string, fn func(meta *raft.SnapshotMeta, source io.Reader, sink io.Writer) error) error
+
+}
+
+var SnapshotStoreWrapperClass = reflect.TypeOf((*SnapshotStoreWrapper)(nil)).Elem()
+
+/**
+Snapshot store that wraps another store, like compression, encryption, verifying and retention stores.
+Use FindSnapshotStore to reach interfaces of the wrapped stores, for example EncryptedSnapshotStore under compression.
+ */
+type SnapshotStoreWrapper interface {
+
+	/**
+	Returns the wrapped store.
+	 */
+	Unwrap() raft.SnapshotStore
+
+}
+
+var SnapshotAttributesClass = reflect.TypeOf((*SnapshotAttributes)(nil)).Elem()
+
+/**
+Snapshot store that keeps small named values next to the snapshot metadata.
+Used by the wrapping stores to record values known only after the sink is closed, like the uncompressed size.
+ */
+type SnapshotAttributes interface {
+
+	/**
+	Stores the value of the attribute of the existing snapshot, the value is kept by Rewrite.
+	 */
+	SetAttribute(id, name string, value []byte) error
+
+	/**
+	Returns the value of the attribute, nil if the attribute is not set.
+	 */
+	Attribute(id, name string) ([]byte, error)
+
+}
+
+var EncryptedSnapshotStoreClass = reflect.TypeOf((*EncryptedSnapshotStore)(nil)).Elem()
+
+/**
+Snapshot store that encrypts snapshots with the active key of the keyring and decrypts with any key of the keyring.
+ */
+type EncryptedSnapshotStore interface {
+	raft.SnapshotStore
+
+	/**
+	Returns ID of the key used to encrypt new snapshots.
+	 */
+	ActiveKeyID() string
+
+	/**
+	Adds key to the keyring and makes it active for new snapshots, previous keys stay in the keyring for decryption.
+	 */
+	SetActiveKey(id, token string) error
+
+	/**
+	Re-encrypts retained snapshots under the active key in background, channel receives the result.
+	Requires delegate store implementing SnapshotRewriter.
+	 */
+	Rotate(ctx context.Context) <-chan error
+
+}
+
+var KeyProviderClass = reflect.TypeOf((*KeyProvider)(nil)).Elem()
+
+/**
+Source of the snapshot encryption token.
+Beans implementing this interface are referred by bean name in 'raft-snapshot.key-bean' and 'raft-snapshot.keyring' properties,
+if there is no bean with such name, the token is taken from the property or prompted.
+ */
+type KeyProvider interface {
+
+	/**
+	Returns encryption token, called once on creation of the snapshot store.
+	 */
+	GetKey() (string, error)
+
+}
+
+var SnapshotQuarantineClass = reflect.TypeOf((*SnapshotQuarantine)(nil)).Elem()
+
+/**
+Snapshot store that can move corrupt snapshot aside, so it is not listed anymore, but kept for investigation.
+ */
+type SnapshotQuarantine interface {
+
+	/**
+	Moves snapshot in to the quarantine.
+	 */
+	Quarantine(id string) error
+
+}
+
+var VerifyingSnapshotStoreClass = reflect.TypeOf((*VerifyingSnapshotStore)(nil)).Elem()
+
+/**
+Snapshot store that keeps SHA-256 digest of each snapshot and checks it on Open.
+ */
+type VerifyingSnapshotStore interface {
+	raft.SnapshotStore
+
+	/**
+	Checks digest of the snapshot, corrupt snapshot is quarantined and the error is returned.
+	 */
+	Verify(id string) error
+
+	/**
+	Verifies all snapshots, reports results through zap and returns the number of valid snapshots.
+	 */
+	Scan() (int, error)
+
+}
+
+var SnapshotRemoverClass = reflect.TypeOf((*SnapshotRemover)(nil)).Elem()
+
+/**
+Snapshot store that can delete a single snapshot, used by the retention policies.
+ */
+type SnapshotRemover interface {
+
+	/**
+	Deletes snapshot metadata and data.
+	 */
+	Remove(id string) error
+
+}
+
+var RetentionSnapshotStoreClass = reflect.TypeOf((*RetentionSnapshotStore)(nil)).Elem()
+
+/**
+Snapshot store that prunes snapshots by retention policies after each successful snapshot.
+ */
+type RetentionSnapshotStore interface {
+	raft.SnapshotStore
+
+	/**
+	Protects snapshot from pruning.
+	 */
+	Pin(id string)
+
+	/**
+	Removes protection set by Pin or 'raft-snapshot.pinned' property.
+	 */
+	Unpin(id string)
+
+	/**
+	Applies retention policies now, returns IDs of deleted snapshots.
+	 */
+	Prune() ([]string, error)
+
+}
+
+var CertificateReloaderClass = reflect.TypeOf((*CertificateReloader)(nil)).Elem()
+
+/**
+Source of TLS certificates that follows changes of certificate files, used by raft transport and client pool if present.
+ */
+type CertificateReloader interface {
+
+	/**
+	Returns the current certificate for tls.Config.GetCertificate.
+	 */
+	GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	/**
+	Returns the current certificate for tls.Config.GetClientCertificate.
+	 */
+	GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error)
+
+	/**
+	Returns the current CA pool or nil if CA file is not configured.
+	 */
+	RootCAs() *x509.CertPool
+
+	/**
+	Reloads files if they were changed, returns true if the certificate or CA pool were replaced.
+	 */
+	Reload() (bool, error)
+
+}
+
+var ContextClientPoolClass = reflect.TypeOf((*ContextClientPool)(nil)).Elem()
+
+/**
+Client pool that dials within the caller context, implemented by raft-client-pool bean.
+ */
+type ContextClientPool interface {
+
+	/**
+	Returns the pooled connection or dials the API endpoint of the raft address until the context is done.
+	 */
+	GetAPIConnContext(ctx context.Context, raftAddress raft.ServerAddress) (*grpc.ClientConn, error)
+
+}
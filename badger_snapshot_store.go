@@ -0,0 +1,645 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"hash"
+	"hash/crc64"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+/**
+BADGER SNAPSHOT STORE
+
+Keys under the prefix:
+	prefix 'm' id                                 metadata JSON, written last, so the snapshot is visible only after commit
+	prefix 'd' id 0x00 generation(4) chunk(4)     data chunk
+	prefix 'q' id                                 metadata of quarantined snapshot, data is kept
+
+Generation is incremented by Rewrite, so the new content is switched atomically by the metadata update.
+*/
+
+const (
+	badgerSnapshotMetaKey = 'm'
+	badgerSnapshotDataKey = 'd'
+	badgerSnapshotQuarantineKey = 'q'
+)
+
+var BadgerSnapshotChunkSize = 256 * 1024
+
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+type implBadgerSnapshotStore struct {
+	db     *badger.DB
+	prefix []byte
+	retain int
+
+	// serializes commit and retention
+	commitMu sync.Mutex
+}
+
+type badgerSnapshotMeta struct {
+	raft.SnapshotMeta
+	CRC        []byte
+	Generation uint32
+	Attributes map[string][]byte `json:",omitempty"`
+}
+
+/**
+Stores snapshots in the badger DB under the prefix, keeps 'retain' latest snapshots.
+Chunks of unfinished snapshots left after crash are removed on creation.
+ */
+func NewBadgerSnapshotStore(db *badger.DB, prefix []byte, retain int) (raft.SnapshotStore, error) {
+	if retain < 1 {
+		return nil, errors.New("must retain at least one snapshot")
+	}
+	t := &implBadgerSnapshotStore{
+		db:     db,
+		prefix: prefix,
+		retain: retain,
+	}
+	if err := t.removeOrphans(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *implBadgerSnapshotStore) metaKey(id string) []byte {
+	return t.key(badgerSnapshotMetaKey, id)
+}
+
+func (t *implBadgerSnapshotStore) quarantineKey(id string) []byte {
+	return t.key(badgerSnapshotQuarantineKey, id)
+}
+
+func (t *implBadgerSnapshotStore) key(kind byte, id string) []byte {
+	key := make([]byte, 0, len(t.prefix)+1+len(id))
+	key = append(key, t.prefix...)
+	key = append(key, kind)
+	return append(key, id...)
+}
+
+func (t *implBadgerSnapshotStore) dataPrefix(id string) []byte {
+	key := make([]byte, 0, len(t.prefix)+2+len(id))
+	key = append(key, t.prefix...)
+	key = append(key, badgerSnapshotDataKey)
+	key = append(key, id...)
+	return append(key, 0)
+}
+
+func (t *implBadgerSnapshotStore) generationPrefix(id string, generation uint32) []byte {
+	key := t.dataPrefix(id)
+	n := len(key)
+	key = append(key, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(key[n:], generation)
+	return key
+}
+
+func (t *implBadgerSnapshotStore) chunkKey(id string, generation, chunk uint32) []byte {
+	key := t.generationPrefix(id, generation)
+	n := len(key)
+	key = append(key, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(key[n:], chunk)
+	return key
+}
+
+func (t *implBadgerSnapshotStore) Create(version raft.SnapshotVersion, index, term uint64, configuration raft.Configuration,
+	configurationIndex uint64, trans raft.Transport) (raft.SnapshotSink, error) {
+
+	if version > raft.SnapshotVersionMax {
+		return nil, errors.Errorf("unsupported snapshot version %d", version)
+	}
+
+	id := fmt.Sprintf("%d-%d-%d", term, index, time.Now().UnixNano()/int64(time.Millisecond))
+
+	// deprecated peers are not stored, raft uses configuration since protocol version 3
+	meta := &badgerSnapshotMeta{
+		SnapshotMeta: raft.SnapshotMeta{
+			Version:            version,
+			ID:                 id,
+			Index:              index,
+			Term:               term,
+			Configuration:      configuration,
+			ConfigurationIndex: configurationIndex,
+		},
+	}
+
+	return t.newSink(meta), nil
+}
+
+func (t *implBadgerSnapshotStore) newSink(meta *badgerSnapshotMeta) *implBadgerSnapshotSink {
+	return &implBadgerSnapshotSink{
+		store: t,
+		meta:  meta,
+		batch: t.db.NewWriteBatch(),
+		hash:  crc64.New(crc64.MakeTable(crc64.ECMA)),
+		buf:   make([]byte, 0, BadgerSnapshotChunkSize),
+	}
+}
+
+func (t *implBadgerSnapshotStore) List() ([]*raft.SnapshotMeta, error) {
+	list, err := t.list()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*raft.SnapshotMeta, len(list))
+	for i, meta := range list {
+		result[i] = &meta.SnapshotMeta
+	}
+	return result, nil
+}
+
+/**
+Returns committed snapshots, newest first.
+ */
+func (t *implBadgerSnapshotStore) list() ([]*badgerSnapshotMeta, error) {
+	var list []*badgerSnapshotMeta
+	prefix := t.metaKey("")
+	err := t.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix, PrefetchValues: true, PrefetchSize: 16})
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			meta := new(badgerSnapshotMeta)
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, meta)
+			}); err != nil {
+				return errors.Errorf("snapshot '%s' metadata error, %v", it.Item().Key()[len(prefix):], err)
+			}
+			list = append(list, meta)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Term != b.Term {
+			return a.Term > b.Term
+		}
+		if a.Index != b.Index {
+			return a.Index > b.Index
+		}
+		return a.ID > b.ID
+	})
+	return list, nil
+}
+
+func (t *implBadgerSnapshotStore) readMeta(txn *badger.Txn, id string) (*badgerSnapshotMeta, error) {
+	item, err := txn.Get(t.metaKey(id))
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return nil, errors.Wrapf(ErrSnapshotNotFound, "snapshot '%s'", id)
+		}
+		return nil, err
+	}
+	meta := new(badgerSnapshotMeta)
+	err = item.Value(func(val []byte) error {
+		return json.Unmarshal(val, meta)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+/**
+Reader holds read-only transaction until Close, so the content stays consistent during rewrite or retention.
+ */
+func (t *implBadgerSnapshotStore) Open(id string) (*raft.SnapshotMeta, io.ReadCloser, error) {
+	txn := t.db.NewTransaction(false)
+	meta, err := t.readMeta(txn, id)
+	if err != nil {
+		txn.Discard()
+		return nil, nil, err
+	}
+	return &meta.SnapshotMeta, &implBadgerSnapshotReader{
+		store: t,
+		txn:   txn,
+		meta:  meta,
+		hash:  crc64.New(crc64.MakeTable(crc64.ECMA)),
+	}, nil
+}
+
+func (t *implBadgerSnapshotStore) Rewrite(id string, fn func(meta *raft.SnapshotMeta, source io.Reader, sink io.Writer) error) error {
+
+	meta, source, err := t.Open(id)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	current := source.(*implBadgerSnapshotReader).meta
+	rewritten := &badgerSnapshotMeta{
+		SnapshotMeta: *meta,
+		Generation:   current.Generation + 1,
+	}
+	rewritten.Size = 0
+
+	sink := t.newSink(rewritten)
+	if err := fn(meta, source, sink); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.finish(current.Generation, true)
+}
+
+/**
+Commits metadata of the snapshot and removes the previous generation of data, then applies retention.
+ */
+func (t *implBadgerSnapshotStore) commit(meta *badgerSnapshotMeta, previousGeneration uint32, replace bool) error {
+
+	t.commitMu.Lock()
+	defer t.commitMu.Unlock()
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	err = t.db.Update(func(txn *badger.Txn) error {
+		key := t.metaKey(meta.ID)
+		if replace {
+			// rewrite keeps attributes, including ones set during the rewrite
+			current, err := t.readMeta(txn, meta.ID)
+			if err != nil {
+				return err
+			}
+			if len(current.Attributes) > 0 {
+				replaced := *meta
+				replaced.Attributes = current.Attributes
+				if data, err = json.Marshal(&replaced); err != nil {
+					return err
+				}
+			}
+		}
+		return txn.Set(key, data)
+	})
+	if err != nil {
+		return err
+	}
+
+	if replace {
+		if err := t.deletePrefix(t.generationPrefix(meta.ID, previousGeneration)); err != nil {
+			return err
+		}
+	}
+
+	return t.reap()
+}
+
+func (t *implBadgerSnapshotStore) SetAttribute(id, name string, value []byte) error {
+	t.commitMu.Lock()
+	defer t.commitMu.Unlock()
+	return t.db.Update(func(txn *badger.Txn) error {
+		meta, err := t.readMeta(txn, id)
+		if err != nil {
+			return err
+		}
+		if meta.Attributes == nil {
+			meta.Attributes = make(map[string][]byte)
+		}
+		meta.Attributes[name] = value
+		data, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		return txn.Set(t.metaKey(id), data)
+	})
+}
+
+func (t *implBadgerSnapshotStore) Attribute(id, name string) ([]byte, error) {
+	var value []byte
+	err := t.db.View(func(txn *badger.Txn) error {
+		meta, err := t.readMeta(txn, id)
+		if err != nil {
+			return err
+		}
+		value = meta.Attributes[name]
+		return nil
+	})
+	return value, err
+}
+
+func (t *implBadgerSnapshotStore) reap() error {
+	list, err := t.list()
+	if err != nil {
+		return err
+	}
+	for i := t.retain; i < len(list); i++ {
+		if err := t.remove(list[i].ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *implBadgerSnapshotStore) Remove(id string) error {
+	t.commitMu.Lock()
+	defer t.commitMu.Unlock()
+	return t.remove(id)
+}
+
+func (t *implBadgerSnapshotStore) remove(id string) error {
+	// metadata first, so the snapshot disappears atomically
+	err := t.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(t.metaKey(id))
+	})
+	if err != nil {
+		return err
+	}
+	return t.deletePrefix(t.dataPrefix(id))
+}
+
+/**
+Moves metadata under the quarantine key, so the snapshot is not listed and its data is not removed as orphan.
+ */
+func (t *implBadgerSnapshotStore) Quarantine(id string) error {
+	t.commitMu.Lock()
+	defer t.commitMu.Unlock()
+	return t.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(t.metaKey(id))
+		if err != nil {
+			if err == badger.ErrKeyNotFound {
+				return errors.Wrapf(ErrSnapshotNotFound, "snapshot '%s'", id)
+			}
+			return err
+		}
+		data, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if err := txn.Set(t.quarantineKey(id), data); err != nil {
+			return err
+		}
+		return txn.Delete(t.metaKey(id))
+	})
+}
+
+func (t *implBadgerSnapshotStore) removeOrphans() error {
+	committed := make(map[string]bool)
+	list, err := t.list()
+	if err != nil {
+		return err
+	}
+	for _, meta := range list {
+		committed[meta.ID] = true
+	}
+	quarantinePrefix := t.quarantineKey("")
+	err = t.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: quarantinePrefix})
+		defer it.Close()
+		for it.Seek(quarantinePrefix); it.ValidForPrefix(quarantinePrefix); it.Next() {
+			committed[string(it.Item().Key()[len(quarantinePrefix):])] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	dataPrefix := t.dataPrefix("")
+	dataPrefix = dataPrefix[:len(dataPrefix)-1]
+	orphans := make(map[string]bool)
+	err = t.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: dataPrefix})
+		defer it.Close()
+		for it.Seek(dataPrefix); it.ValidForPrefix(dataPrefix); it.Next() {
+			key := it.Item().Key()[len(dataPrefix):]
+			if i := bytes.IndexByte(key, 0); i >= 0 && !committed[string(key[:i])] {
+				orphans[string(key[:i])] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for id := range orphans {
+		if err := t.deletePrefix(t.dataPrefix(id)); err != nil {
+			return err
+		}
+	}
+
+	// stale generations of interrupted rewrites
+	for _, meta := range list {
+		if err := t.deleteStaleGenerations(meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *implBadgerSnapshotStore) deleteStaleGenerations(meta *badgerSnapshotMeta) error {
+	prefix := t.dataPrefix(meta.ID)
+	current := t.generationPrefix(meta.ID, meta.Generation)
+	return t.deleteKeys(prefix, func(key []byte) bool {
+		return !bytes.HasPrefix(key, current)
+	})
+}
+
+func (t *implBadgerSnapshotStore) deletePrefix(prefix []byte) error {
+	return t.deleteKeys(prefix, func(key []byte) bool {
+		return true
+	})
+}
+
+func (t *implBadgerSnapshotStore) deleteKeys(prefix []byte, filter func(key []byte) bool) error {
+	var keys [][]byte
+	err := t.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			if key := it.Item().Key(); filter(key) {
+				keys = append(keys, it.Item().KeyCopy(nil))
+			}
+		}
+		return nil
+	})
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	batch := t.db.NewWriteBatch()
+	defer batch.Cancel()
+	for _, key := range keys {
+		if err := batch.Delete(key); err != nil {
+			return err
+		}
+	}
+	return batch.Flush()
+}
+
+/**
+BADGER SNAPSHOT SINK
+ */
+
+type implBadgerSnapshotSink struct {
+	store   *implBadgerSnapshotStore
+	meta    *badgerSnapshotMeta
+	batch   *badger.WriteBatch
+	hash    hash.Hash64
+	buf     []byte
+	chunk   uint32
+	closed  bool
+}
+
+func (t *implBadgerSnapshotSink) Write(p []byte) (int, error) {
+	if t.closed {
+		return 0, errors.New("write to closed snapshot sink")
+	}
+	written := 0
+	for len(p) > 0 {
+		n := copy(t.buf[len(t.buf):cap(t.buf)], p)
+		t.buf = t.buf[:len(t.buf)+n]
+		p = p[n:]
+		written += n
+		if len(t.buf) == cap(t.buf) {
+			if err := t.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (t *implBadgerSnapshotSink) flush() error {
+	if len(t.buf) == 0 {
+		return nil
+	}
+	t.hash.Write(t.buf)
+	t.meta.Size += int64(len(t.buf))
+	// write batch keeps the reference, so the buffer is not reused
+	if err := t.batch.Set(t.store.chunkKey(t.meta.ID, t.meta.Generation, t.chunk), t.buf); err != nil {
+		return err
+	}
+	t.chunk++
+	t.buf = make([]byte, 0, cap(t.buf))
+	return nil
+}
+
+func (t *implBadgerSnapshotSink) ID() string {
+	return t.meta.ID
+}
+
+func (t *implBadgerSnapshotSink) Close() error {
+	if t.closed {
+		return nil
+	}
+	return t.finish(0, false)
+}
+
+func (t *implBadgerSnapshotSink) finish(previousGeneration uint32, replace bool) error {
+	t.closed = true
+	if err := t.flush(); err != nil {
+		t.discard()
+		return err
+	}
+	if err := t.batch.Flush(); err != nil {
+		t.discard()
+		return err
+	}
+	t.meta.CRC = t.hash.Sum(nil)
+	if err := t.store.commit(t.meta, previousGeneration, replace); err != nil {
+		t.discard()
+		return err
+	}
+	return nil
+}
+
+func (t *implBadgerSnapshotSink) Cancel() error {
+	t.closed = true
+	t.discard()
+	return nil
+}
+
+/**
+Removes chunks of this generation that could be already flushed by the write batch.
+ */
+func (t *implBadgerSnapshotSink) discard() {
+	t.batch.Cancel()
+	t.store.deletePrefix(t.store.generationPrefix(t.meta.ID, t.meta.Generation))
+}
+
+/**
+BADGER SNAPSHOT READER
+ */
+
+type implBadgerSnapshotReader struct {
+	store  *implBadgerSnapshotStore
+	txn    *badger.Txn
+	meta   *badgerSnapshotMeta
+	hash   hash.Hash64
+	chunk  uint32
+	data   []byte
+	pos    int
+	read   int64
+	err    error
+}
+
+func (t *implBadgerSnapshotReader) Read(p []byte) (int, error) {
+	for t.pos == len(t.data) {
+		if t.err != nil {
+			return 0, t.err
+		}
+		t.err = t.next()
+	}
+	n := copy(p, t.data[t.pos:])
+	t.pos += n
+	return n, nil
+}
+
+func (t *implBadgerSnapshotReader) next() error {
+
+	if t.read == t.meta.Size {
+		if !bytes.Equal(t.hash.Sum(nil), t.meta.CRC) {
+			return errors.Wrapf(ErrSnapshotDigestMismatch, "snapshot '%s' CRC64", t.meta.ID)
+		}
+		return io.EOF
+	}
+
+	item, err := t.txn.Get(t.store.chunkKey(t.meta.ID, t.meta.Generation, t.chunk))
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return errors.Errorf("snapshot '%s' chunk %d not found, read %d bytes of %d", t.meta.ID, t.chunk, t.read, t.meta.Size)
+		}
+		return err
+	}
+	t.data, err = item.ValueCopy(t.data[:0])
+	if err != nil {
+		return err
+	}
+
+	t.chunk++
+	t.pos = 0
+	t.read += int64(len(t.data))
+	t.hash.Write(t.data)
+	return nil
+}
+
+func (t *implBadgerSnapshotReader) Close() error {
+	t.txn.Discard()
+	return nil
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"bytes"
+	"context"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+)
+
+func TestBadgerSnapshotStore(t *testing.T) {
+
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLoggingLevel(badger.WARNING))
+	require.NoError(t, err)
+	defer db.Close()
+
+	snapshots, err := NewBadgerSnapshotStore(db, []byte("snapshot"), 2)
+	require.NoError(t, err)
+
+	content := make([]byte, BadgerSnapshotChunkSize * 2 + 100)
+	for i := range content {
+		content[i] = byte(i)
+	}
+
+	// not visible before Close
+	sink, err := snapshots.Create(raft.SnapshotVersionMax, 100, 1, raft.Configuration{}, 0, nil)
+	require.NoError(t, err)
+	_, err = sink.Write(content)
+	require.NoError(t, err)
+
+	list, err := snapshots.List()
+	require.NoError(t, err)
+	require.Equal(t, 0, len(list))
+
+	require.NoError(t, sink.Cancel())
+
+	for i := uint64(1); i <= 3; i++ {
+		sink, err := snapshots.Create(raft.SnapshotVersionMax, 100 * i, 1, raft.Configuration{}, 0, nil)
+		require.NoError(t, err)
+		_, err = sink.Write(content)
+		require.NoError(t, err)
+		require.NoError(t, sink.Close())
+	}
+
+	// retention
+	list, err = snapshots.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(list))
+	require.Equal(t, uint64(300), list[0].Index)
+	require.Equal(t, uint64(200), list[1].Index)
+
+	meta, reader, err := snapshots.Open(list[0].ID)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), meta.Size)
+	actual, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(content, actual))
+	require.NoError(t, reader.Close())
+
+	// key rotation rewrites snapshots in place
+	snapshots, err = NewBadgerSnapshotStore(db, []byte("encrypted"), 2)
+	require.NoError(t, err)
+
+	old, err := NewEncryptedSnapshotStore(snapshots, "123", WithKDF("sha256", ""), WithKeyID("k1"))
+	require.NoError(t, err)
+
+	sink, err = old.Create(raft.SnapshotVersionMax, 400, 1, raft.Configuration{}, 0, nil)
+	require.NoError(t, err)
+	_, err = sink.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+	require.NoError(t, snapshots.(SnapshotAttributes).SetAttribute(sink.ID(), "name", []byte("value")))
+
+	s, err := NewEncryptedSnapshotStore(snapshots, "456", WithKDF("sha256", ""), WithKeyID("k2"), WithKey("k1", "123"))
+	require.NoError(t, err)
+	require.NoError(t, <-s.(EncryptedSnapshotStore).Rotate(context.Background()))
+
+	list, err = snapshots.List()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(list))
+
+	_, _, err = old.Open(list[0].ID)
+	require.Error(t, err)
+
+	// attributes are kept by the rewrite
+	value, err := snapshots.(SnapshotAttributes).Attribute(list[0].ID, "name")
+	require.NoError(t, err)
+	require.Equal(t, "value", string(value))
+
+	_, reader, err = s.Open(list[0].ID)
+	require.NoError(t, err)
+	actual, err = io.ReadAll(reader)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(content, actual))
+	require.NoError(t, reader.Close())
+
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+package raftmod
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"os"
+	"sync"
+	"time"
+)
+
+type implCertificateReloader struct {
+
+	Log          *zap.Logger      `inject`
+
+	CertFile        string         `value:"raft-server.tls-cert-file,default="`
+	KeyFile         string         `value:"raft-server.tls-key-file,default="`
+	CAFile          string         `value:"raft-server.tls-ca-file,default="`
+	ReloadInterval  time.Duration  `value:"raft-server.tls-reload-interval,default=30s"`
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	roots     *x509.CertPool
+	versions  map[string]certificateFileVersion
+
+	stopCh    chan struct{}
+	stopOnce  sync.Once
+}
+
+type certificateFileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+/**
+Loads certificate, key and optional CA bundle from files on start and reloads them when files change,
+new TLS handshakes use the new certificates, established connections are not affected.
+ */
+func CertificateFileReloader() CertificateReloader {
+	return &implCertificateReloader{}
+}
+
+func (t *implCertificateReloader) PostConstruct() error {
+
+	if t.CertFile == "" || t.KeyFile == "" {
+		return errors.New("properties 'raft-server.tls-cert-file' and 'raft-server.tls-key-file' are required by certificate reloader")
+	}
+
+	t.stopCh = make(chan struct{})
+	if _, err := t.Reload(); err != nil {
+		return err
+	}
+
+	if t.ReloadInterval > 0 {
+		go t.watch()
+	}
+	return nil
+}
+
+func (t *implCertificateReloader) BeanName() string {
+	return "raft-certificate-reloader"
+}
+
+func (t *implCertificateReloader) Destroy() error {
+	t.stopOnce.Do(func() {
+		if t.stopCh != nil {
+			close(t.stopCh)
+		}
+	})
+	return nil
+}
+
+func (t *implCertificateReloader) watch() {
+
+	ticker := time.NewTicker(t.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stopCh:
+			return
+		case <-ticker.C:
+			// previous certificates stay in use on error, files could be in the middle of the update
+			if _, err := t.Reload(); err != nil && t.Log != nil {
+				t.Log.Error("RaftCertificateReload", zap.Error(err))
+			}
+		}
+	}
+
+}
+
+func (t *implCertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.cert, nil
+}
+
+func (t *implCertificateReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.cert, nil
+}
+
+func (t *implCertificateReloader) RootCAs() *x509.CertPool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.roots
+}
+
+func (t *implCertificateReloader) Reload() (bool, error) {
+
+	files := []string{t.CertFile, t.KeyFile}
+	if t.CAFile != "" {
+		files = append(files, t.CAFile)
+	}
+
+	versions := make(map[string]certificateFileVersion)
+	changed := false
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, errors.Errorf("certificate file '%s' error, %v", file, err)
+		}
+		version := certificateFileVersion{modTime: info.ModTime(), size: info.Size()}
+		versions[file] = version
+		if t.versions[file] != version {
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return false, errors.Errorf("certificate '%s' with key '%s' load error, %v", t.CertFile, t.KeyFile, err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false, errors.Errorf("certificate '%s' parse error, %v", t.CertFile, err)
+	}
+
+	var roots *x509.CertPool
+	if t.CAFile != "" {
+		roots, err = loadRootCAs(t.CAFile, &tls.Config{})
+		if err != nil {
+			return false, err
+		}
+	}
+
+	t.mu.Lock()
+	t.cert = &cert
+	t.roots = roots
+	t.versions = versions
+	t.mu.Unlock()
+
+	if t.Log != nil {
+		t.Log.Info("RaftCertificateLoaded", zap.String("subject", cert.Leaf.Subject.String()), zap.Time("notAfter", cert.Leaf.NotAfter), zap.Bool("ca", roots != nil))
+	}
+	return true, nil
+}
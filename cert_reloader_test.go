@@ -0,0 +1,124 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+package raftmod
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestCertificate(t *testing.T, cert tls.Certificate, certFile, keyFile string) {
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600))
+}
+
+func writeTestCABundle(t *testing.T, caFile string, list ...*testCA) {
+	var data []byte
+	for _, ca := range list {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})...)
+	}
+	require.NoError(t, os.WriteFile(caFile, data, 0600))
+}
+
+/**
+Moves modification time forward, so the change is detected on file systems with coarse timestamps.
+ */
+func touchTestFiles(t *testing.T, shift time.Duration, files ...string) {
+	for _, file := range files {
+		require.NoError(t, os.Chtimes(file, time.Now().Add(shift), time.Now().Add(shift)))
+	}
+}
+
+func TestCertificateReloader(t *testing.T) {
+
+	dir, err := os.MkdirTemp(os.TempDir(), "raftmodtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "node.crt")
+	keyFile := filepath.Join(dir, "node.key")
+	caFile := filepath.Join(dir, "ca.crt")
+
+	oldCA := newTestCA(t)
+	newCA := newTestCA(t)
+
+	writeTestCertificate(t, oldCA.issue(t, "node1", false), certFile, keyFile)
+	writeTestCABundle(t, caFile, oldCA)
+
+	reloader := &implCertificateReloader{Log: zap.NewNop(), CertFile: certFile, KeyFile: keyFile, CAFile: caFile}
+	require.NoError(t, reloader.PostConstruct())
+	defer reloader.Destroy()
+
+	server := newTestStreamLayer(t, tls.Certificate{}, oldCA, TLSModeMutual, nil)
+	defer server.Close()
+	server.tlsOpt.reloader = reloader
+	peers := map[raft.ServerAddress]raft.ServerID{raft.ServerAddress(server.Addr().String()): "node1"}
+
+	clientErr, serverErr := dialTestStreamLayer(newTestStreamLayer(t, oldCA.issue(t, "node2", false), oldCA, TLSModeMutual, peers), server)
+	require.NoError(t, clientErr)
+	require.NoError(t, serverErr)
+
+	changed, err := reloader.Reload()
+	require.NoError(t, err)
+	require.False(t, changed)
+
+	// rotation to the new CA, old clients are trusted during the transition
+	writeTestCertificate(t, newCA.issue(t, "node1", false), certFile, keyFile)
+	writeTestCABundle(t, caFile, oldCA, newCA)
+	touchTestFiles(t, time.Minute, certFile, keyFile, caFile)
+
+	changed, err = reloader.Reload()
+	require.NoError(t, err)
+	require.True(t, changed)
+
+	clientErr, _ = dialTestStreamLayer(newTestStreamLayer(t, oldCA.issue(t, "node2", false), oldCA, TLSModeMutual, peers), server)
+	require.Error(t, clientErr)
+
+	clientErr, serverErr = dialTestStreamLayer(newTestStreamLayer(t, oldCA.issue(t, "node2", false), newCA, TLSModeMutual, peers), server)
+	require.NoError(t, clientErr)
+	require.NoError(t, serverErr)
+
+	pool := &implRaftClientPool{CertificateReloader: reloader}
+	require.NoError(t, pool.verifyServerCertificate(newCA.issue(t, "node3", false).Certificate, nil))
+	require.Error(t, pool.verifyServerCertificate(newTestCA(t).issue(t, "node3", false).Certificate, nil))
+
+	// without CA file the server certificate is verified against the system roots
+	noCA := &implCertificateReloader{CertFile: certFile, KeyFile: keyFile}
+	require.NoError(t, noCA.PostConstruct())
+	defer noCA.Destroy()
+	require.Nil(t, noCA.RootCAs())
+	pool = &implRaftClientPool{CertificateReloader: noCA}
+	require.Error(t, pool.verifyServerCertificate(newCA.issue(t, "node3", false).Certificate, nil))
+
+	// broken files keep the previous certificate
+	require.NoError(t, os.WriteFile(certFile, []byte("broken"), 0600))
+	touchTestFiles(t, 2*time.Minute, certFile)
+	_, err = reloader.Reload()
+	require.Error(t, err)
+	cert, err := reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	require.NotNil(t, cert)
+
+}
@@ -0,0 +1,301 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"io"
+	"math"
+)
+
+/**
+CHUNK ENCRYPTER
+
+Authenticated encryption of the stream split in to fixed-size chunks.
+Each chunk record is 'flag(1) | length(4) | ciphertext', nonce is 'prefix(7) | counter(4) | flag(1)'
+and the header is additional data of every chunk, so truncation, reordering and header changes are detected.
+*/
+
+const (
+	chunkFlagNext  = 0
+	chunkFlagFinal = 1
+
+	chunkRecordHeaderSize = 5
+
+	// authentication tag size of both supported ciphers
+	chunkTagSize = 16
+)
+
+var (
+	ErrSnapshotTruncated = errors.New("encrypted snapshot is truncated")
+	ErrSnapshotCorrupted = errors.New("encrypted snapshot is corrupted")
+)
+
+func newAEAD(c SnapshotCipher, key []byte) (cipher.AEAD, error) {
+	switch c {
+	case CipherAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case CipherChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	default:
+		return nil, errors.Errorf("unsupported snapshot cipher %d", c)
+	}
+}
+
+/**
+Every chunk except the final one holds exactly chunkSize bytes of plaintext,
+so the plaintext size is derived from the size of chunk records without decryption.
+ */
+func chunkedPlaintextSize(payloadSize int64, chunkSize uint32) (int64, error) {
+	recordOverhead := int64(chunkRecordHeaderSize + chunkTagSize)
+	recordSize := int64(chunkSize) + recordOverhead
+	if payloadSize < recordOverhead {
+		return 0, ErrSnapshotTruncated
+	}
+	if rem := payloadSize % recordSize; rem != 0 && rem < recordOverhead {
+		return 0, ErrSnapshotTruncated
+	}
+	records := (payloadSize + recordSize - 1) / recordSize
+	return payloadSize - records*recordOverhead, nil
+}
+
+func chunkNonce(nonce []byte, prefix []byte, counter uint32, flag byte) {
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	nonce[noncePrefixSize+4] = flag
+}
+
+type implChunkEncrypter struct {
+	sink     raft.SnapshotSink
+	aead     cipher.AEAD
+	header   *snapshotHeader
+	ad       []byte
+	nonce    []byte
+	counter  uint32
+	buf      []byte
+	out      []byte
+	closed   bool
+}
+
+/**
+Writes header to the sink and returns the sink that encrypts stream by chunks.
+ */
+func newChunkEncrypter(sessionKey []byte, header *snapshotHeader, sink raft.SnapshotSink) (raft.SnapshotSink, error) {
+	aead, err := newAEAD(header.cipher, sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	ad := header.marshal()
+	if err := writeFull(sink, ad); err != nil {
+		return nil, err
+	}
+	return &implChunkEncrypter{
+		sink:   sink,
+		aead:   aead,
+		header: header,
+		ad:     ad,
+		nonce:  make([]byte, aead.NonceSize()),
+		buf:    make([]byte, 0, header.chunkSize),
+		out:    make([]byte, chunkRecordHeaderSize, chunkRecordHeaderSize+int(header.chunkSize)+aead.Overhead()),
+	}, nil
+}
+
+func (t *implChunkEncrypter) Write(p []byte) (int, error) {
+	if t.closed {
+		return 0, errors.New("write to closed snapshot sink")
+	}
+	written := 0
+	for len(p) > 0 {
+		if len(t.buf) == cap(t.buf) {
+			// more data is coming, so the full chunk is not the last one
+			if err := t.flush(chunkFlagNext); err != nil {
+				return written, err
+			}
+		}
+		n := copy(t.buf[len(t.buf):cap(t.buf)], p)
+		t.buf = t.buf[:len(t.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (t *implChunkEncrypter) flush(flag byte) error {
+	if t.counter == math.MaxUint32 {
+		return errors.New("snapshot is too large for the chunk size")
+	}
+	chunkNonce(t.nonce, t.header.noncePrefix, t.counter, flag)
+	t.out = t.aead.Seal(t.out[:chunkRecordHeaderSize], t.nonce, t.buf, t.ad)
+	t.out[0] = flag
+	binary.BigEndian.PutUint32(t.out[1:chunkRecordHeaderSize], uint32(len(t.out)-chunkRecordHeaderSize))
+	if err := writeFull(t.sink, t.out); err != nil {
+		return err
+	}
+	t.counter++
+	clean(t.buf)
+	t.buf = t.buf[:0]
+	return nil
+}
+
+func (t *implChunkEncrypter) Close() error {
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	if err := t.flush(chunkFlagFinal); err != nil {
+		t.sink.Cancel()
+		return err
+	}
+	return t.sink.Close()
+}
+
+func (t *implChunkEncrypter) ID() string {
+	return t.sink.ID()
+}
+
+func (t *implChunkEncrypter) Cancel() error {
+	t.closed = true
+	clean(t.buf)
+	return t.sink.Cancel()
+}
+
+/**
+CHUNK DECRYPTER
+ */
+
+type implChunkDecrypter struct {
+	source   io.ReadCloser
+	aead     cipher.AEAD
+	header   *snapshotHeader
+	ad       []byte
+	nonce    []byte
+	counter  uint32
+	record   []byte
+	plain    []byte
+	pos      int
+	final    bool
+	err      error
+}
+
+/**
+Returns reader of the decrypted stream, header must be already read from the source.
+ */
+func newChunkDecrypter(sessionKey []byte, header *snapshotHeader, ad []byte, source io.ReadCloser) (io.ReadCloser, error) {
+	if header.chunkSize == 0 || header.chunkSize > maxSnapshotChunkSize {
+		return nil, errors.Wrapf(ErrSnapshotCorrupted, "invalid chunk size %d", header.chunkSize)
+	}
+	aead, err := newAEAD(header.cipher, sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	return &implChunkDecrypter{
+		source: source,
+		aead:   aead,
+		header: header,
+		ad:     ad,
+		nonce:  make([]byte, aead.NonceSize()),
+		record: make([]byte, 0, int(header.chunkSize)+aead.Overhead()),
+	}, nil
+}
+
+func (t *implChunkDecrypter) Read(p []byte) (int, error) {
+	for t.pos == len(t.plain) {
+		if t.err != nil {
+			return 0, t.err
+		}
+		if t.final {
+			t.err = t.checkTrailing()
+			continue
+		}
+		t.err = t.next()
+	}
+	n := copy(p, t.plain[t.pos:])
+	t.pos += n
+	return n, nil
+}
+
+func (t *implChunkDecrypter) next() error {
+
+	var hdr [chunkRecordHeaderSize]byte
+	if _, err := io.ReadFull(t.source, hdr[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrSnapshotTruncated
+		}
+		return err
+	}
+
+	flag := hdr[0]
+	size := binary.BigEndian.Uint32(hdr[1:])
+	if flag > chunkFlagFinal || int(size) > cap(t.record) || int(size) < t.aead.Overhead() {
+		return ErrSnapshotCorrupted
+	}
+
+	t.record = t.record[:size]
+	if _, err := io.ReadFull(t.source, t.record); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrSnapshotTruncated
+		}
+		return err
+	}
+
+	chunkNonce(t.nonce, t.header.noncePrefix, t.counter, flag)
+	plain, err := t.aead.Open(t.record[:0], t.nonce, t.record, t.ad)
+	if err != nil {
+		return ErrSnapshotCorrupted
+	}
+
+	t.counter++
+	t.plain = plain
+	t.pos = 0
+	t.final = flag == chunkFlagFinal
+	return nil
+}
+
+func (t *implChunkDecrypter) checkTrailing() error {
+	var b [1]byte
+	n, err := t.source.Read(b[:])
+	if n > 0 {
+		return ErrSnapshotCorrupted
+	}
+	if err == nil || err == io.EOF {
+		return io.EOF
+	}
+	return err
+}
+
+func (t *implChunkDecrypter) Close() error {
+	clean(t.record[:cap(t.record)])
+	return t.source.Close()
+}
+
+func writeFull(w io.Writer, p []byte) error {
+	n, err := w.Write(p)
+	if err != nil {
+		return err
+	}
+	if n != len(p) {
+		return errors.Errorf("i/o write error, written %d bytes whereas expected %d bytes", n, len(p))
+	}
+	return nil
+}
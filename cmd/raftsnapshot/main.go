@@ -0,0 +1,390 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+/**
+Snapshot tool works with the 'raft-snapshot' directory of the stopped node,
+or with the badger directory of the 'raft-storage' when the node has 'raft-snapshot.store=badger'.
+
+	raftsnapshot export -dir db/app/raft-snapshot -key-env SNAPSHOT_KEY -out snapshot.rmsa
+	raftsnapshot import -dir new/raft-snapshot -key-env SNAPSHOT_KEY -peers 'node1=10.0.0.1:7000' -in snapshot.rmsa
+	raftsnapshot inspect -dir db/app/raft-snapshot -key-env SNAPSHOT_KEY -json
+	raftsnapshot inspect -dir db/app/raft-snapshot -key-env SNAPSHOT_KEY -id 2-1200-1678450000000 -dump state.bin
+	raftsnapshot inspect -store badger -dir db/app/raft-storage -prefix snapshot
+*/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/codeallergy/raftmod"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+func main() {
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "export":
+		err = doExport(os.Args[2:])
+	case "import":
+		err = doImport(os.Args[2:])
+	case "inspect":
+		err = doInspect(os.Args[2:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s export|import|inspect [options]\n", os.Args[0])
+}
+
+type storeFlags struct {
+	store       string
+	dir         string
+	prefix      string
+	keyFile     string
+	keyEnv      string
+	keyId       string
+	kdf         string
+	kdfSalt     string
+	compression string
+	verify      bool
+	// set by commands that only read snapshots, the data directory is not changed
+	noQuarantine bool
+}
+
+func (t *storeFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&t.store, "store", "file", "snapshot store 'file' or 'badger', the same as 'raft-snapshot.store'")
+	fs.StringVar(&t.dir, "dir", "", "snapshot directory, the 'raft-snapshot' folder of the data directory, or the badger directory of 'raft-storage'")
+	fs.StringVar(&t.prefix, "prefix", "snapshot", "key prefix of the badger store, the same as 'raft-storage.snapshot-prefix'")
+	fs.StringVar(&t.keyFile, "key-file", "", "file with the snapshot encryption token")
+	fs.StringVar(&t.keyEnv, "key-env", "", "environment variable with the snapshot encryption token")
+	fs.StringVar(&t.keyId, "key-id", "", "ID of the snapshot encryption token")
+	fs.StringVar(&t.kdf, "kdf", "scrypt", "snapshot key derivation function, the same as 'raft-snapshot.kdf'")
+	fs.StringVar(&t.kdfSalt, "kdf-salt", raftmod.DefaultKDFSalt, "snapshot key derivation salt, the same as 'raft-snapshot.kdf-salt'")
+	fs.StringVar(&t.compression, "compression", "none", "compression of imported snapshot, the same as 'raft-snapshot.compression'")
+	fs.BoolVar(&t.verify, "verify", false, "store digest of imported snapshot, the same as 'raft-snapshot.verify'")
+}
+
+func (t *storeFlags) validate() error {
+	if t.dir == "" {
+		return errors.New("flag '-dir' is required")
+	}
+	if t.store != "file" && t.store != "badger" {
+		return errors.Errorf("invalid flag '-store' value '%s', expected 'file' or 'badger'", t.store)
+	}
+	return nil
+}
+
+/**
+Builds the same stack of stores as the snapshot factory, readers detect compression and digest by headers.
+The returned function closes the badger DB.
+ */
+func (t *storeFlags) open() (raft.SnapshotStore, func(), error) {
+
+	if err := t.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	closer := func() {}
+
+	var store raft.SnapshotStore
+	if t.store == "badger" {
+		db, err := badger.Open(badger.DefaultOptions(t.dir).WithLoggingLevel(badger.WARNING))
+		if err != nil {
+			return nil, nil, errors.Errorf("open badger '%s' error, %v", t.dir, err)
+		}
+		closer = func() {
+			db.Close()
+		}
+		store, err = raftmod.NewBadgerSnapshotStore(db, []byte(t.prefix), 1<<30)
+		if err != nil {
+			closer()
+			return nil, nil, err
+		}
+	} else {
+		var err error
+		store, err = raftmod.NewFileSnapshotStore(t.dir, 1<<30, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	store, err := t.wrap(store)
+	if err != nil {
+		closer()
+		return nil, nil, err
+	}
+	return store, closer, nil
+}
+
+func (t *storeFlags) wrap(store raft.SnapshotStore) (raft.SnapshotStore, error) {
+
+	if t.verify {
+		var options []raftmod.VerifyingOption
+		if t.noQuarantine {
+			options = append(options, raftmod.WithoutQuarantine())
+		}
+		store = raftmod.NewVerifyingSnapshotStore(store, zap.NewNop(), options...)
+	}
+
+	token, err := readKey(t.keyFile, t.keyEnv)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		store, err = raftmod.NewEncryptedSnapshotStore(store, token, raftmod.WithKDF(t.kdf, t.kdfSalt), raftmod.WithKeyID(t.keyId))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	compression, err := raftmod.ParseSnapshotCompression(t.compression)
+	if err != nil {
+		return nil, err
+	}
+	return raftmod.NewCompressedSnapshotStore(store, compression), nil
+}
+
+func readKey(keyFile, keyEnv string) (string, error) {
+	switch {
+	case keyFile != "":
+		return raftmod.FileKeyProvider("key-file", keyFile).GetKey()
+	case keyEnv != "":
+		return raftmod.EnvKeyProvider("key-env", keyEnv).GetKey()
+	default:
+		return "", nil
+	}
+}
+
+type archiveFlags struct {
+	keyFile string
+	keyEnv  string
+	kdf     string
+}
+
+func (t *archiveFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&t.keyFile, "archive-key-file", "", "file with the archive encryption token")
+	fs.StringVar(&t.keyEnv, "archive-key-env", "", "environment variable with the archive encryption token")
+	fs.StringVar(&t.kdf, "archive-kdf", "scrypt", "archive key derivation function")
+}
+
+func (t *archiveFlags) options() ([]raftmod.ArchiveOption, error) {
+	token, err := readKey(t.keyFile, t.keyEnv)
+	if err != nil || token == "" {
+		return nil, err
+	}
+	return []raftmod.ArchiveOption{raftmod.WithArchiveKey(token, t.kdf)}, nil
+}
+
+func doExport(args []string) error {
+
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var sf storeFlags
+	var af archiveFlags
+	sf.register(fs)
+	af.register(fs)
+	id := fs.String("id", "", "snapshot ID, the latest snapshot by default")
+	out := fs.String("out", "-", "archive file, '-' for stdout")
+	fs.Parse(args)
+
+	// digest is detected on read, corrupt snapshot fails the export and stays in the data directory
+	sf.verify = true
+	sf.noQuarantine = true
+	store, closer, err := sf.open()
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	options, err := af.options()
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		fd, err := os.OpenFile(*out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		w = fd
+	}
+
+	info, err := raftmod.ExportSnapshot(store, *id, w, options...)
+	if err != nil {
+		if *out != "-" {
+			os.Remove(*out)
+		}
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Exported snapshot '%s', index %d, term %d, size %d\n", info.Meta.ID, info.Meta.Index, info.Meta.Term, info.Meta.Size)
+	return nil
+}
+
+func doImport(args []string) error {
+
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	var sf storeFlags
+	var af archiveFlags
+	sf.register(fs)
+	af.register(fs)
+	in := fs.String("in", "-", "archive file, '-' for stdin")
+	peers := fs.String("peers", "", "configuration of the new cluster 'nodeId=address;...', configuration of the archive by default")
+	fs.Parse(args)
+
+	if err := sf.validate(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(sf.dir, 0755); err != nil {
+		return err
+	}
+
+	store, closer, err := sf.open()
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	options, err := af.options()
+	if err != nil {
+		return err
+	}
+
+	if *peers != "" {
+		configuration, err := parsePeers(*peers)
+		if err != nil {
+			return err
+		}
+		// zero index takes the index of the imported snapshot
+		options = append(options, raftmod.WithArchiveConfiguration(configuration, 0))
+	}
+
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		fd, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		r = fd
+	}
+
+	meta, err := raftmod.ImportSnapshot(store, r, options...)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Imported snapshot '%s', index %d, term %d, size %d, servers %d\n", meta.ID, meta.Index, meta.Term, meta.Size, len(meta.Configuration.Servers))
+	return nil
+}
+
+func doInspect(args []string) error {
+
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	var sf storeFlags
+	sf.register(fs)
+	id := fs.String("id", "", "snapshot ID, all snapshots by default")
+	dump := fs.String("dump", "", "file for decrypted FSM payload of the snapshot, requires '-id'")
+	asJson := fs.Bool("json", false, "print JSON instead of the table")
+	fs.Parse(args)
+
+	store, closer, err := sf.open()
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	var options []raftmod.InspectOption
+	if *id != "" {
+		options = append(options, raftmod.WithInspectID(*id))
+	}
+	if *dump != "" {
+		fd, err := os.OpenFile(*dump, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		options = append(options, raftmod.WithInspectDump(fd))
+	}
+
+	list, err := raftmod.InspectSnapshots(store, options...)
+	if err != nil {
+		return err
+	}
+
+	if *asJson {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(list)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tINDEX\tTERM\tSIZE\tPAYLOAD\tVOTERS\tNON-VOTERS\tDIGEST\tENCRYPTION\tKEY ID\tCOMPRESSION\tSTATUS")
+	for _, info := range list {
+		payload := "-"
+		if info.PayloadSize >= 0 {
+			payload = fmt.Sprintf("%d", info.PayloadSize)
+		}
+		status := info.Status
+		if info.Error != "" {
+			status = fmt.Sprintf("%s: %s", info.Status, info.Error)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", info.ID, info.Index, info.Term, info.Size, payload,
+			strings.Join(info.Voters, ","), strings.Join(info.NonVoters, ","), info.Digest, info.Encryption, info.KeyID, info.Compression, status)
+	}
+	return w.Flush()
+}
+
+func parsePeers(value string) (raft.Configuration, error) {
+	var configuration raft.Configuration
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.IndexByte(entry, '=')
+		if i <= 0 || i == len(entry)-1 {
+			return configuration, errors.Errorf("invalid peer '%s', expected 'nodeId=address'", entry)
+		}
+		configuration.Servers = append(configuration.Servers, raft.Server{
+			Suffrage: raft.Voter,
+			ID:       raft.ServerID(strings.TrimSpace(entry[:i])),
+			Address:  raft.ServerAddress(strings.TrimSpace(entry[i+1:])),
+		})
+	}
+	return configuration, nil
+}
@@ -0,0 +1,494 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/hashicorp/raft"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"io"
+	"sync"
+)
+
+/**
+SNAPSHOT COMPRESSION HEADER
+
+Wrap the encrypted store to compress before encryption, snapshots without header are stored uncompressed.
+	magic        [4]byte  "RMSZ"
+	version      uint8
+	codec        uint8
+	payload      ...
+
+Version 2 adds the trailer, so the size is known without decompression:
+	size         uint64   uncompressed size of the payload
+*/
+
+var compressionMagic = []byte("RMSZ")
+
+const (
+	compressionVersionNoSize = 1
+	compressionVersion       = 2
+
+	compressionHeaderSize  = 6
+	compressionTrailerSize = 8
+)
+
+// SnapshotAttributes name of the uncompressed size, uint64 big endian
+const uncompressedSizeAttribute = "uncompressed-size"
+
+var ErrSnapshotSizeMismatch = errors.New("snapshot uncompressed size does not match the trailer")
+
+type SnapshotCompression uint8
+
+const (
+	CompressionNone SnapshotCompression = iota
+	CompressionZstd
+	CompressionSnappy
+)
+
+func (t SnapshotCompression) String() string {
+	switch t {
+	case CompressionNone:
+		return "none"
+	case CompressionZstd:
+		return "zstd"
+	case CompressionSnappy:
+		return "snappy"
+	default:
+		return "unknown"
+	}
+}
+
+func ParseSnapshotCompression(s string) (SnapshotCompression, error) {
+	switch s {
+	case "none", "":
+		return CompressionNone, nil
+	case "zstd":
+		return CompressionZstd, nil
+	case "snappy":
+		return CompressionSnappy, nil
+	default:
+		return 0, errors.Errorf("unknown snapshot compression '%s'", s)
+	}
+}
+
+type implCompressedSnapshotStore struct {
+	delegate    raft.SnapshotStore
+	compression SnapshotCompression
+
+	// snapshot ID to uncompressed size
+	sizes sync.Map
+}
+
+/**
+Compresses new snapshots by the codec and decompresses snapshots written by any codec.
+Open reports size of the decompressed stream, because raft sends it in InstallSnapshot and checks the size.
+The size is recorded in the snapshot attributes on Close, if the delegate store implements SnapshotAttributes.
+Snapshots without the attribute are read once to take the size from the trailer, version 1 is decompressed for that.
+ */
+func NewCompressedSnapshotStore(store raft.SnapshotStore, compression SnapshotCompression) raft.SnapshotStore {
+	return &implCompressedSnapshotStore{
+		delegate:    store,
+		compression: compression,
+	}
+}
+
+func (t *implCompressedSnapshotStore) Create(version raft.SnapshotVersion, index, term uint64, configuration raft.Configuration,
+	configurationIndex uint64, trans raft.Transport) (raft.SnapshotSink, error) {
+
+	sink, err := t.delegate.Create(version, index, term, configuration, configurationIndex, trans)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.compression == CompressionNone {
+		return sink, nil
+	}
+
+	header := append(append([]byte{}, compressionMagic...), compressionVersion, byte(t.compression))
+	if err := writeFull(sink, header); err != nil {
+		sink.Cancel()
+		return nil, err
+	}
+
+	writer, err := newCompressionWriter(t.compression, sink)
+	if err != nil {
+		sink.Cancel()
+		return nil, err
+	}
+
+	return &implCompressedSink{
+		SnapshotSink: sink,
+		writer:       writer,
+		onClose: func(size int64) {
+			t.sizes.Store(sink.ID(), size)
+			// the snapshot is already stored, without the attribute the size is read from the trailer
+			t.setSizeAttribute(sink.ID(), size)
+		},
+	}, nil
+}
+
+func (t *implCompressedSnapshotStore) Unwrap() raft.SnapshotStore {
+	return t.delegate
+}
+
+func (t *implCompressedSnapshotStore) SetAttribute(id, name string, value []byte) error {
+	attributes, ok := t.delegate.(SnapshotAttributes)
+	if !ok {
+		return errors.New("snapshot store does not support attributes")
+	}
+	return attributes.SetAttribute(id, name, value)
+}
+
+func (t *implCompressedSnapshotStore) Attribute(id, name string) ([]byte, error) {
+	attributes, ok := t.delegate.(SnapshotAttributes)
+	if !ok {
+		return nil, errors.New("snapshot store does not support attributes")
+	}
+	return attributes.Attribute(id, name)
+}
+
+func (t *implCompressedSnapshotStore) setSizeAttribute(id string, size int64) error {
+	value := make([]byte, compressionTrailerSize)
+	binary.BigEndian.PutUint64(value, uint64(size))
+	return t.SetAttribute(id, uncompressedSizeAttribute, value)
+}
+
+func (t *implCompressedSnapshotStore) sizeAttribute(id string) (int64, bool) {
+	value, err := t.Attribute(id, uncompressedSizeAttribute)
+	if err != nil || len(value) != compressionTrailerSize {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(value)), true
+}
+
+/**
+Drops cached sizes of snapshots that are not listed anymore.
+ */
+func (t *implCompressedSnapshotStore) List() ([]*raft.SnapshotMeta, error) {
+	list, err := t.delegate.List()
+	if err != nil {
+		return nil, err
+	}
+	listed := make(map[string]bool, len(list))
+	for _, meta := range list {
+		listed[meta.ID] = true
+	}
+	t.sizes.Range(func(key, value interface{}) bool {
+		if !listed[key.(string)] {
+			t.sizes.Delete(key)
+		}
+		return true
+	})
+	return list, nil
+}
+
+func (t *implCompressedSnapshotStore) Open(id string) (*raft.SnapshotMeta, io.ReadCloser, error) {
+
+	meta, source, err := t.delegate.Open(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	version, compression, payload, err := readCompressionHeader(source)
+	if err != nil {
+		source.Close()
+		return nil, nil, err
+	}
+
+	if version == 0 {
+		// stored uncompressed
+		return meta, payload, nil
+	}
+
+	size, err := t.uncompressedSize(id)
+	if err != nil {
+		source.Close()
+		return nil, nil, err
+	}
+
+	reader, err := newCompressionReader(compression, version, payload)
+	if err != nil {
+		source.Close()
+		return nil, nil, err
+	}
+
+	decompressed := *meta
+	decompressed.Size = size
+	return &decompressed, reader, nil
+}
+
+/**
+Takes the size from the cache or the snapshot attribute.
+Otherwise reads the trailer and records the attribute, the payload is decompressed only for snapshots of version 1.
+ */
+func (t *implCompressedSnapshotStore) uncompressedSize(id string) (int64, error) {
+
+	if size, ok := t.sizes.Load(id); ok {
+		return size.(int64), nil
+	}
+
+	if size, ok := t.sizeAttribute(id); ok {
+		t.sizes.Store(id, size)
+		return size, nil
+	}
+
+	_, source, err := t.delegate.Open(id)
+	if err != nil {
+		return 0, err
+	}
+	defer source.Close()
+
+	version, compression, payload, err := readCompressionHeader(source)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	if version >= compressionVersion {
+		trailer := newTrailerReader(payload)
+		if _, err := io.Copy(io.Discard, trailer); err != nil {
+			return 0, err
+		}
+		size, err = trailer.size()
+	} else {
+		var reader io.ReadCloser
+		reader, err = newCompressionReader(compression, version, payload)
+		if err != nil {
+			return 0, err
+		}
+		size, err = io.Copy(io.Discard, reader)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	t.sizes.Store(id, size)
+	t.setSizeAttribute(id, size)
+	return size, nil
+}
+
+/**
+Returns version 0 for snapshots without header, payload reader starts right after the header.
+ */
+func readCompressionHeader(source io.ReadCloser) (int, SnapshotCompression, io.ReadCloser, error) {
+
+	prefix := make([]byte, compressionHeaderSize)
+	n, err := io.ReadFull(source, prefix)
+	if err == nil && bytes.Equal(prefix[:len(compressionMagic)], compressionMagic) {
+		version := int(prefix[len(compressionMagic)])
+		if version != compressionVersionNoSize && version != compressionVersion {
+			return 0, 0, nil, errors.Errorf("unsupported snapshot compression version %d", version)
+		}
+		return version, SnapshotCompression(prefix[len(compressionMagic)+1]), source, nil
+	}
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return 0, 0, nil, err
+	}
+
+	return 0, CompressionNone, &prefixedReadCloser{
+		Reader: io.MultiReader(bytes.NewReader(prefix[:n]), source),
+		Closer: source,
+	}, nil
+}
+
+/**
+Detects compression by magic, snapshots without header are returned as is.
+ */
+func openCompressedStream(source io.ReadCloser) (io.ReadCloser, error) {
+
+	version, compression, payload, err := readCompressionHeader(source)
+	if err != nil {
+		return nil, err
+	}
+	if version == 0 {
+		return payload, nil
+	}
+
+	return newCompressionReader(compression, version, payload)
+}
+
+func newCompressionWriter(compression SnapshotCompression, w io.Writer) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	case CompressionSnappy:
+		return snappy.NewBufferedWriter(w), nil
+	default:
+		return nil, errors.Errorf("unsupported snapshot compression %d", compression)
+	}
+}
+
+/**
+Decoder of version 2 does not see the trailer, the size is checked at the end of the stream.
+ */
+func newCompressionReader(compression SnapshotCompression, version int, source io.ReadCloser) (io.ReadCloser, error) {
+
+	var input io.Reader = source
+	var trailer *trailerReader
+	if version >= compressionVersion {
+		trailer = newTrailerReader(source)
+		input = trailer
+	}
+
+	switch compression {
+	case CompressionZstd:
+		decoder, err := zstd.NewReader(input)
+		if err != nil {
+			return nil, err
+		}
+		return &implDecompressReader{Reader: decoder, closeFn: decoder.Close, source: source, trailer: trailer}, nil
+	case CompressionSnappy:
+		return &implDecompressReader{Reader: snappy.NewReader(input), source: source, trailer: trailer}, nil
+	default:
+		return nil, errors.Errorf("unsupported snapshot compression %d", compression)
+	}
+}
+
+type implCompressedSink struct {
+	raft.SnapshotSink
+	writer  io.WriteCloser
+	size    int64
+	onClose func(size int64)
+	closed  bool
+}
+
+func (t *implCompressedSink) Write(p []byte) (int, error) {
+	n, err := t.writer.Write(p)
+	t.size += int64(n)
+	return n, err
+}
+
+func (t *implCompressedSink) Close() error {
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	if err := t.writer.Close(); err != nil {
+		t.SnapshotSink.Cancel()
+		return err
+	}
+	trailer := make([]byte, compressionTrailerSize)
+	binary.BigEndian.PutUint64(trailer, uint64(t.size))
+	if err := writeFull(t.SnapshotSink, trailer); err != nil {
+		t.SnapshotSink.Cancel()
+		return err
+	}
+	if err := t.SnapshotSink.Close(); err != nil {
+		return err
+	}
+	t.onClose(t.size)
+	return nil
+}
+
+func (t *implCompressedSink) Cancel() error {
+	if !t.closed {
+		t.closed = true
+		// releases encoder resources, the output is discarded anyway
+		t.writer.Close()
+	}
+	return t.SnapshotSink.Cancel()
+}
+
+type implDecompressReader struct {
+	io.Reader
+	closeFn func()
+	source  io.ReadCloser
+	// nil for version 1
+	trailer *trailerReader
+	n       int64
+}
+
+func (t *implDecompressReader) Read(p []byte) (int, error) {
+	n, err := t.Reader.Read(p)
+	t.n += int64(n)
+	if err == io.EOF && t.trailer != nil {
+		if _, err := io.Copy(io.Discard, t.trailer); err != nil {
+			return n, err
+		}
+		size, err := t.trailer.size()
+		if err != nil {
+			return n, err
+		}
+		if size != t.n {
+			return n, errors.Wrapf(ErrSnapshotSizeMismatch, "decompressed %d bytes, trailer %d bytes", t.n, size)
+		}
+	}
+	return n, err
+}
+
+func (t *implDecompressReader) Close() error {
+	if t.closeFn != nil {
+		t.closeFn()
+	}
+	return t.source.Close()
+}
+
+/**
+Holds back the last bytes of the stream, they are the trailer once the source is exhausted.
+ */
+type trailerReader struct {
+	source  *bufio.Reader
+	trailer []byte
+	err     error
+}
+
+const trailerReaderBufferSize = 64 * 1024
+
+func newTrailerReader(source io.Reader) *trailerReader {
+	return &trailerReader{source: bufio.NewReaderSize(source, trailerReaderBufferSize)}
+}
+
+func (t *trailerReader) Read(p []byte) (int, error) {
+	if t.err != nil {
+		return 0, t.err
+	}
+	if len(p) > trailerReaderBufferSize-compressionTrailerSize {
+		p = p[:trailerReaderBufferSize-compressionTrailerSize]
+	}
+	peek, err := t.source.Peek(len(p) + compressionTrailerSize)
+	if len(peek) > compressionTrailerSize {
+		n := copy(p, peek[:len(peek)-compressionTrailerSize])
+		t.source.Discard(n)
+		return n, nil
+	}
+	switch {
+	case err == io.EOF && len(peek) == compressionTrailerSize:
+		t.trailer = append([]byte{}, peek...)
+		t.err = io.EOF
+	case err == io.EOF:
+		t.err = ErrSnapshotTruncated
+	case err != nil:
+		t.err = err
+	}
+	return 0, t.err
+}
+
+/**
+Returns the size recorded in the trailer, valid after the reader returned io.EOF.
+ */
+func (t *trailerReader) size() (int64, error) {
+	if t.trailer == nil {
+		if t.err != nil && t.err != io.EOF {
+			return 0, t.err
+		}
+		return 0, ErrSnapshotTruncated
+	}
+	return int64(binary.BigEndian.Uint64(t.trailer)), nil
+}
@@ -0,0 +1,219 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestCompressedSnapshotStore(t *testing.T) {
+
+	dir, err := os.MkdirTemp(os.TempDir(), "raftmodtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	snapshots, err := raft.NewFileSnapshotStore(dir, 5, os.Stderr)
+	require.NoError(t, err)
+
+	encrypted, err := NewEncryptedSnapshotStore(snapshots, "123", WithKDF("sha256", ""))
+	require.NoError(t, err)
+
+	content := bytes.Repeat([]byte(`{"key":"value","counter":12345}`), 1000)
+
+	// written before compression was enabled
+	sink, err := encrypted.Create(raft.SnapshotVersionMax, 100, 1, raft.Configuration{}, 0, nil)
+	require.NoError(t, err)
+	_, err = sink.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+
+	for i, compression := range []SnapshotCompression{CompressionZstd, CompressionSnappy} {
+
+		store := NewCompressedSnapshotStore(encrypted, compression)
+
+		sink, err := store.Create(raft.SnapshotVersionMax, uint64(200 + i), 1, raft.Configuration{}, 0, nil)
+		require.NoError(t, err)
+		_, err = sink.Write(content)
+		require.NoError(t, err)
+		require.NoError(t, sink.Close())
+
+		list, err := store.List()
+		require.NoError(t, err)
+		require.Equal(t, 2 + i, len(list))
+
+		for _, entry := range list {
+
+			require.True(t, entry.Index == 100 || entry.Size < int64(len(content)) / 10, "compression %s, size %d", compression, entry.Size)
+
+			meta, reader, err := store.Open(entry.ID)
+			require.NoError(t, err)
+			require.Equal(t, int64(len(content)), meta.Size)
+
+			actual, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			require.True(t, bytes.Equal(content, actual), "compression %s", compression)
+			require.NoError(t, reader.Close())
+		}
+	}
+
+	// key management of the store wrapped by compression
+	store := NewCompressedSnapshotStore(encrypted, CompressionZstd)
+	found, ok := FindSnapshotStore(store, EncryptedSnapshotStoreClass)
+	require.True(t, ok)
+	require.Equal(t, encrypted, found)
+	require.NoError(t, found.(EncryptedSnapshotStore).SetActiveKey("k2", "456"))
+	require.Equal(t, "k2", found.(EncryptedSnapshotStore).ActiveKeyID())
+
+	_, ok = FindSnapshotStore(store, VerifyingSnapshotStoreClass)
+	require.False(t, ok)
+
+}
+
+func writeTestSnapshot(t *testing.T, store raft.SnapshotStore, index uint64, data []byte) string {
+	sink, err := store.Create(raft.SnapshotVersionMax, index, 1, raft.Configuration{}, 0, nil)
+	require.NoError(t, err)
+	_, err = sink.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+	return sink.ID()
+}
+
+func compressTestPayload(t *testing.T, version int, content []byte, size uint64) []byte {
+	var buf bytes.Buffer
+	buf.Write(compressionMagic)
+	buf.WriteByte(byte(version))
+	buf.WriteByte(byte(CompressionZstd))
+	writer, err := newCompressionWriter(CompressionZstd, &buf)
+	require.NoError(t, err)
+	_, err = writer.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	if version >= compressionVersion {
+		trailer := make([]byte, compressionTrailerSize)
+		binary.BigEndian.PutUint64(trailer, size)
+		buf.Write(trailer)
+	}
+	return buf.Bytes()
+}
+
+func TestCompressedSnapshotStoreSize(t *testing.T) {
+
+	inmem := raft.NewInmemSnapshotStore()
+	content := bytes.Repeat([]byte(`{"key":"value","counter":12345}`), 1000)
+
+	// size is cached on Close
+	store := NewCompressedSnapshotStore(inmem, CompressionZstd).(*implCompressedSnapshotStore)
+	id := writeTestSnapshot(t, store, 100, content)
+	size, ok := store.sizes.Load(id)
+	require.True(t, ok)
+	require.Equal(t, int64(len(content)), size)
+
+	for _, c := range []struct {
+		version int
+		size    uint64
+		err     error
+	}{
+		{compressionVersion, uint64(len(content)), nil},
+		{compressionVersionNoSize, 0, nil},
+		{compressionVersion, uint64(len(content)) + 1, ErrSnapshotSizeMismatch},
+	} {
+
+		inmem := raft.NewInmemSnapshotStore()
+		id := writeTestSnapshot(t, inmem, 100, compressTestPayload(t, c.version, content, c.size))
+
+		// the size is read from the trailer by a new store
+		store := NewCompressedSnapshotStore(inmem, CompressionZstd)
+		meta, reader, err := store.Open(id)
+		require.NoError(t, err)
+		if c.version >= compressionVersion {
+			require.Equal(t, int64(c.size), meta.Size)
+		} else {
+			require.Equal(t, int64(len(content)), meta.Size)
+		}
+
+		actual, err := io.ReadAll(reader)
+		require.NoError(t, reader.Close())
+		if c.err != nil {
+			require.True(t, errors.Is(err, c.err), "%v", err)
+			continue
+		}
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(content, actual))
+	}
+
+	// truncated trailer
+	payload := compressTestPayload(t, compressionVersion, content, uint64(len(content)))
+	id = writeTestSnapshot(t, inmem, 200, payload[:len(payload)-3])
+	_, reader, err := NewCompressedSnapshotStore(inmem, CompressionZstd).Open(id)
+	require.NoError(t, err)
+	_, err = io.ReadAll(reader)
+	require.Error(t, err)
+	require.NoError(t, reader.Close())
+
+}
+
+/**
+File store that counts opened snapshots.
+ */
+type countingOpenStore struct {
+	*implFileSnapshotStore
+	opens int
+}
+
+func (t *countingOpenStore) Open(id string) (*raft.SnapshotMeta, io.ReadCloser, error) {
+	t.opens++
+	return t.implFileSnapshotStore.Open(id)
+}
+
+func TestCompressedSnapshotStoreSizeAttribute(t *testing.T) {
+
+	dir, err := os.MkdirTemp(os.TempDir(), "raftmodtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	base, err := NewFileSnapshotStore(dir, 5, nil)
+	require.NoError(t, err)
+	content := bytes.Repeat([]byte(`{"key":"value","counter":12345}`), 1000)
+
+	// size is recorded on Close
+	id := writeTestSnapshot(t, NewCompressedSnapshotStore(base, CompressionZstd), 100, content)
+
+	counting := &countingOpenStore{implFileSnapshotStore: base.(*implFileSnapshotStore)}
+	meta, reader, err := NewCompressedSnapshotStore(counting, CompressionZstd).Open(id)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	require.Equal(t, int64(len(content)), meta.Size)
+	require.Equal(t, 1, counting.opens)
+
+	// snapshot without the attribute is read once, then the attribute is recorded
+	id = writeTestSnapshot(t, base, 200, compressTestPayload(t, compressionVersion, content, uint64(len(content))))
+
+	for _, opens := range []int{2, 1} {
+		counting.opens = 0
+		meta, reader, err = NewCompressedSnapshotStore(counting, CompressionZstd).Open(id)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+		require.Equal(t, int64(len(content)), meta.Size)
+		require.Equal(t, opens, counting.opens)
+	}
+
+}
@@ -15,58 +15,481 @@
 package raftmod
 
 import (
+	"bytes"
+	"context"
+	"crypto/aes"
 	"crypto/sha256"
 	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"go.uber.org/atomic"
 	"io"
+	"os"
+	"sync"
+)
+
+var DefaultSnapshotChunkSize = 64 * 1024
+
+var (
+	ErrUnknownSnapshotKey = errors.New("snapshot key is not in the keyring")
+	ErrRotationInProgress = errors.New("snapshot key rotation is in progress")
 )
 
 type implEncryptedSnapshotStore struct {
 	delegate  raft.SnapshotStore
-	token     string
+	cipher    SnapshotCipher
+	chunkSize int
+	kdf       SnapshotKDF
+	kdfSalt   string
+
+	keys        map[string]string // key ID to token
+	activeKeyId string
+	masterKeys  map[masterKeyRef][]byte
+	keysMu      sync.Mutex
+
+	rotating atomic.Bool
+}
+
+type masterKeyRef struct {
+	keyId string
+	kdf   SnapshotKDF
+}
+
+type EncryptionOption func(*implEncryptedSnapshotStore) error
+
+/**
+Selects AEAD cipher for new snapshots, 'aes-gcm' (default) or 'chacha20-poly1305'.
+ */
+func WithCipher(name string) EncryptionOption {
+	return func(t *implEncryptedSnapshotStore) (err error) {
+		t.cipher, err = ParseSnapshotCipher(name)
+		return
+	}
+}
+
+/**
+Sets plaintext size of the encrypted chunk for new snapshots.
+ */
+func WithChunkSize(size int) EncryptionOption {
+	return func(t *implEncryptedSnapshotStore) error {
+		t.chunkSize = size
+		return nil
+	}
 }
 
-func NewEncryptedSnapshotStore(store raft.SnapshotStore, token string) (raft.SnapshotStore, error) {
-	return &implEncryptedSnapshotStore{delegate: store, token: token}, nil
+/**
+Selects password-based KDF for the master key, 'scrypt' (default), 'argon2id' or 'sha256'
+and the salt that must be the same for the whole lifetime of snapshots.
+ */
+func WithKDF(name, salt string) EncryptionOption {
+	return func(t *implEncryptedSnapshotStore) (err error) {
+		t.kdf, err = ParseSnapshotKDF(name)
+		if salt != "" {
+			t.kdfSalt = salt
+		}
+		return
+	}
+}
+
+/**
+Sets ID of the token passed to the constructor, the ID is recorded in the header of new snapshots.
+ */
+func WithKeyID(id string) EncryptionOption {
+	return func(t *implEncryptedSnapshotStore) error {
+		t.activeKeyId = id
+		return nil
+	}
+}
+
+/**
+Adds retired key to the keyring, used only to decrypt snapshots.
+Snapshots without key ID in the header are decrypted by the key with empty ID, or by the active key if there is none.
+ */
+func WithKey(id, token string) EncryptionOption {
+	return func(t *implEncryptedSnapshotStore) error {
+		if _, ok := t.keys[id]; ok {
+			return errors.Errorf("duplicate snapshot key '%s'", id)
+		}
+		t.keys[id] = token
+		return nil
+	}
+}
+
+func NewEncryptedSnapshotStore(store raft.SnapshotStore, token string, options ...EncryptionOption) (raft.SnapshotStore, error) {
+	t := &implEncryptedSnapshotStore{
+		delegate:   store,
+		cipher:     CipherAESGCM,
+		chunkSize:  DefaultSnapshotChunkSize,
+		kdf:        KDFScrypt,
+		kdfSalt:    DefaultKDFSalt,
+		keys:       make(map[string]string),
+		masterKeys: make(map[masterKeyRef][]byte),
+	}
+	for _, opt := range options {
+		if err := opt(t); err != nil {
+			return nil, err
+		}
+	}
+	if t.chunkSize <= 0 || t.chunkSize > maxSnapshotChunkSize {
+		return nil, errors.Errorf("invalid snapshot chunk size %d, expected up to %d", t.chunkSize, maxSnapshotChunkSize)
+	}
+	if _, ok := t.keys[t.activeKeyId]; ok {
+		return nil, errors.Errorf("duplicate snapshot key '%s'", t.activeKeyId)
+	}
+	t.keys[t.activeKeyId] = token
+	// derive master key in advance to fail fast
+	if _, err := t.masterKey(t.activeKeyId, t.kdf); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *implEncryptedSnapshotStore) ActiveKeyID() string {
+	t.keysMu.Lock()
+	defer t.keysMu.Unlock()
+	return t.activeKeyId
+}
+
+func (t *implEncryptedSnapshotStore) SetActiveKey(id, token string) error {
+	t.keysMu.Lock()
+	defer t.keysMu.Unlock()
+	if existing, ok := t.keys[id]; ok && existing != token {
+		return errors.Errorf("snapshot key '%s' is already in the keyring with a different token", id)
+	}
+	key, err := deriveMasterKey(t.kdf, []byte(token), []byte(t.kdfSalt))
+	if err != nil {
+		return err
+	}
+	t.keys[id] = token
+	t.masterKeys[masterKeyRef{id, t.kdf}] = key
+	t.activeKeyId = id
+	return nil
 }
 
 func (t *implEncryptedSnapshotStore) Create(version raft.SnapshotVersion, index, term uint64, configuration raft.Configuration,
-	configurationIndex uint64, trans raft.Transport) (sink raft.SnapshotSink, err error) {
-	sink, err = t.delegate.Create(version, index, term, configuration, configurationIndex, trans)
+	configurationIndex uint64, trans raft.Transport) (raft.SnapshotSink, error) {
+	sink, err := t.delegate.Create(version, index, term, configuration, configurationIndex, trans)
 	if err != nil {
-		return
+		return nil, err
+	}
+	encrypted, err := t.newSink(sink, index, term)
+	if err != nil {
+		sink.Cancel()
+		return nil, err
 	}
-	sessionKey := t.newSessionKey(index, term)
-	sink, err = StreamEncrypter(sessionKey, sink)
-	clean(sessionKey)
-	return
+	return encrypted, nil
+}
+
+/**
+Returns the sink that encrypts stream by the active key.
+ */
+func (t *implEncryptedSnapshotStore) newSink(sink raft.SnapshotSink, index, term uint64) (raft.SnapshotSink, error) {
+	header, err := newSnapshotHeader(t.cipher, t.chunkSize, t.kdf, t.ActiveKeyID())
+	if err != nil {
+		return nil, err
+	}
+	sessionKey, err := t.sessionKey(header, index, term, sink.ID())
+	if err != nil {
+		return nil, err
+	}
+	defer clean(sessionKey)
+	return newChunkEncrypter(sessionKey, header, sink)
+}
+
+func (t *implEncryptedSnapshotStore) Unwrap() raft.SnapshotStore {
+	return t.delegate
 }
 
 func (t *implEncryptedSnapshotStore) List() ([]*raft.SnapshotMeta, error) {
 	return t.delegate.List()
 }
 
-func (t *implEncryptedSnapshotStore) Open(id string) (meta *raft.SnapshotMeta, source io.ReadCloser, err error) {
-	meta, source, err = t.delegate.Open(id)
+func (t *implEncryptedSnapshotStore) SetAttribute(id, name string, value []byte) error {
+	attributes, ok := t.delegate.(SnapshotAttributes)
+	if !ok {
+		return errors.New("snapshot store does not support attributes")
+	}
+	return attributes.SetAttribute(id, name, value)
+}
+
+func (t *implEncryptedSnapshotStore) Attribute(id, name string) ([]byte, error) {
+	attributes, ok := t.delegate.(SnapshotAttributes)
+	if !ok {
+		return nil, errors.New("snapshot store does not support attributes")
+	}
+	return attributes.Attribute(id, name)
+}
+
+/**
+Returns size of the decrypted stream in meta, because raft sends it in InstallSnapshot and checks the size.
+ */
+func (t *implEncryptedSnapshotStore) Open(id string) (*raft.SnapshotMeta, io.ReadCloser, error) {
+
+	meta, source, err := t.delegate.Open(id)
 	if err != nil {
-		return
+		return nil, nil, err
+	}
+
+	header, ad, payload, err := readEncryptionHeader(source)
+	if err != nil {
+		source.Close()
+		return nil, nil, err
+	}
+
+	size, err := plaintextSize(header, ad, meta.Size)
+	if err != nil {
+		source.Close()
+		return nil, nil, errors.Wrapf(err, "snapshot '%s'", id)
+	}
+
+	decrypted, err := t.decryptStream(header, ad, payload, meta, id)
+	if err != nil {
+		source.Close()
+		return nil, nil, err
+	}
+
+	plain := *meta
+	plain.Size = size
+	return &plain, decrypted, nil
+}
+
+/**
+Calculates size of the decrypted stream by the stored size, nil header means legacy CTR stream with IV prefix.
+ */
+func plaintextSize(header *snapshotHeader, ad []byte, size int64) (int64, error) {
+	if header == nil {
+		if size < aes.BlockSize {
+			return 0, ErrSnapshotTruncated
+		}
+		return size - aes.BlockSize, nil
 	}
-	sessionKey := t.newSessionKey(meta.Index, meta.Term)
-	source, err = StreamDecrypter(sessionKey, source)
-	clean(sessionKey)
-	return
+	return chunkedPlaintextSize(size-int64(len(ad)), header.chunkSize)
 }
 
-func (t *implEncryptedSnapshotStore) newSessionKey(index, term uint64) []byte {
+/**
+Detects encryption format by magic, snapshots without header are legacy CTR streams.
+ */
+func (t *implEncryptedSnapshotStore) openStream(meta *raft.SnapshotMeta, id string, source io.ReadCloser) (io.ReadCloser, error) {
+
+	header, ad, payload, err := readEncryptionHeader(source)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.decryptStream(header, ad, payload, meta, id)
+}
+
+/**
+Decrypts payload that follows the header, nil header means legacy CTR stream.
+ */
+func (t *implEncryptedSnapshotStore) decryptStream(header *snapshotHeader, ad []byte, payload io.ReadCloser, meta *raft.SnapshotMeta, id string) (io.ReadCloser, error) {
+
+	if header != nil {
+		sessionKey, err := t.sessionKey(header, meta.Index, meta.Term, id)
+		if err != nil {
+			return nil, err
+		}
+		defer clean(sessionKey)
+		return newChunkDecrypter(sessionKey, header, ad, payload)
+	}
+
+	sessionKey := t.legacySessionKey()
+	defer clean(sessionKey)
+	return StreamDecrypter(sessionKey, payload)
+}
+
+/**
+Returns nil header for legacy CTR streams, payload reader starts right after the header.
+ */
+func readEncryptionHeader(source io.ReadCloser) (*snapshotHeader, []byte, io.ReadCloser, error) {
+
+	prefix := make([]byte, len(snapshotMagic)+1)
+	n, err := io.ReadFull(source, prefix)
+	if err == nil && bytes.Equal(prefix[:len(snapshotMagic)], snapshotMagic) {
+		header, ad, err := readSnapshotHeader(prefix[len(snapshotMagic)], source)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return header, ad, source, nil
+	}
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, nil, nil, err
+	}
+
+	legacy := &prefixedReadCloser{
+		Reader: io.MultiReader(bytes.NewReader(prefix[:n]), source),
+		Closer: source,
+	}
+	return nil, nil, legacy, nil
+}
+
+func (t *implEncryptedSnapshotStore) sessionKey(header *snapshotHeader, index, term uint64, id string) ([]byte, error) {
+	if header.version < snapshotVersionHKDF {
+		return t.legacySessionKey(), nil
+	}
+	keyId, ok := header.keyId, header.version >= snapshotVersionKeyID
+	if !ok {
+		keyId = t.legacyKeyID()
+	}
+	masterKey, err := t.masterKey(keyId, header.kdf)
+	if err != nil {
+		return nil, err
+	}
+	return deriveSessionKey(masterKey, header.salt, index, term, id)
+}
+
+func (t *implEncryptedSnapshotStore) masterKey(keyId string, kdf SnapshotKDF) ([]byte, error) {
+	t.keysMu.Lock()
+	defer t.keysMu.Unlock()
+	ref := masterKeyRef{keyId, kdf}
+	if key, ok := t.masterKeys[ref]; ok {
+		return key, nil
+	}
+	token, ok := t.keys[keyId]
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownSnapshotKey, "key '%s'", keyId)
+	}
+	key, err := deriveMasterKey(kdf, []byte(token), []byte(t.kdfSalt))
+	if err != nil {
+		return nil, err
+	}
+	t.masterKeys[ref] = key
+	return key, nil
+}
+
+/**
+Key of snapshots written without key ID.
+ */
+func (t *implEncryptedSnapshotStore) legacyKeyID() string {
+	t.keysMu.Lock()
+	defer t.keysMu.Unlock()
+	if _, ok := t.keys[""]; ok {
+		return ""
+	}
+	return t.activeKeyId
+}
+
+/**
+Session key of CTR and version 1 snapshots, the same for all snapshots.
+ */
+func (t *implEncryptedSnapshotStore) legacySessionKey() []byte {
+	keyId := t.legacyKeyID()
+	t.keysMu.Lock()
+	token := t.keys[keyId]
+	t.keysMu.Unlock()
 	h := sha256.New()
-	h.Write([]byte(t.token))
+	h.Write([]byte(token))
 	return h.Sum(nil)
 }
 
+func (t *implEncryptedSnapshotStore) Rotate(ctx context.Context) <-chan error {
+	result := make(chan error, 1)
+	rewriter, ok := t.delegate.(SnapshotRewriter)
+	if !ok {
+		result <- errors.New("snapshot store does not support rewrite")
+		return result
+	}
+	if !t.rotating.CAS(false, true) {
+		result <- ErrRotationInProgress
+		return result
+	}
+	go func() {
+		defer t.rotating.Store(false)
+		result <- t.rotate(ctx, rewriter)
+	}()
+	return result
+}
+
+func (t *implEncryptedSnapshotStore) rotate(ctx context.Context, rewriter SnapshotRewriter) error {
+
+	list, err := t.delegate.List()
+	if err != nil {
+		return err
+	}
+
+	for _, meta := range list {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := t.reencrypt(rewriter, meta.ID); err != nil {
+			if os.IsNotExist(err) || errors.Is(err, ErrSnapshotNotFound) {
+				// reaped by retention in the meantime
+				continue
+			}
+			return errors.Errorf("snapshot '%s' re-encryption error, %v", meta.ID, err)
+		}
+	}
+
+	return nil
+}
+
+/**
+Re-encrypts the snapshot under the active key if it was encrypted by another key.
+ */
+func (t *implEncryptedSnapshotStore) reencrypt(rewriter SnapshotRewriter, id string) error {
+
+	activeKeyId := t.ActiveKeyID()
+
+	_, source, err := t.delegate.Open(id)
+	if err != nil {
+		return err
+	}
+	header, _, _, err := readEncryptionHeader(source)
+	source.Close()
+	if err != nil {
+		return err
+	}
+	if header != nil && header.version >= snapshotVersionKeyID && header.keyId == activeKeyId {
+		return nil
+	}
+
+	return rewriter.Rewrite(id, func(meta *raft.SnapshotMeta, source io.Reader, sink io.Writer) error {
+
+		plain, err := t.openStream(meta, id, io.NopCloser(source))
+		if err != nil {
+			return err
+		}
+
+		encrypted, err := t.newSink(&writerSink{Writer: sink, id: id}, meta.Index, meta.Term)
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(encrypted, plain); err != nil {
+			encrypted.Cancel()
+			return err
+		}
+		return encrypted.Close()
+	})
+}
+
+/**
+Snapshot sink over plain writer, used to re-encrypt content in place.
+ */
+type writerSink struct {
+	io.Writer
+	id string
+}
+
+func (t *writerSink) ID() string {
+	return t.id
+}
+
+func (t *writerSink) Cancel() error {
+	return nil
+}
+
+func (t *writerSink) Close() error {
+	return nil
+}
+
+type prefixedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
 func clean(arr []byte) {
 	n := len(arr)
 	for i := 0; i < n; i++ {
 		arr[i] = 0
 	}
 }
-
-
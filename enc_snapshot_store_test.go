@@ -16,6 +16,9 @@ package raftmod
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/hashicorp/raft"
 	"github.com/stretchr/testify/require"
@@ -48,8 +51,8 @@ func TestEncryptedSnapshotStore(t *testing.T) {
 	err = sink.Close()
 	require.NoError(t, err)
 
-	// MODIFIES BUF during encryption
-	require.False(t, bytes.Equal([]byte(welcome), buf))
+	// does not modify buf during encryption
+	require.True(t, bytes.Equal([]byte(welcome), buf))
 
 	list, err := testing.List()
 	require.NoError(t, err)
@@ -73,3 +76,230 @@ func TestEncryptedSnapshotStore(t *testing.T) {
 
 }
 
+
+func TestEncryptedSnapshotStoreLegacyCTR(t *testing.T) {
+
+	dir, err := os.MkdirTemp(os.TempDir(), "raftmodtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	snapshots, err := raft.NewFileSnapshotStore(dir, 5, os.Stderr)
+	require.NoError(t, err)
+
+	testing, err := NewEncryptedSnapshotStore(snapshots, "123")
+	require.NoError(t, err)
+
+	// write snapshot in the legacy format
+	sink, err := snapshots.Create(raft.SnapshotVersionMax, 100, 1, raft.Configuration{}, 0, nil)
+	require.NoError(t, err)
+
+	sessionKey := testing.(*implEncryptedSnapshotStore).legacySessionKey()
+	sink, err = StreamEncrypter(sessionKey, sink)
+	require.NoError(t, err)
+
+	welcome := "Hello World!"
+	_, err = sink.Write([]byte(welcome))
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+
+	list, err := testing.List()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(list))
+
+	meta, reader, err := testing.Open(list[0].ID)
+	require.NoError(t, err)
+
+	content, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, welcome, string(content))
+	require.Equal(t, int64(len(content)), meta.Size)
+	require.NoError(t, reader.Close())
+
+}
+
+func TestEncryptedSnapshotStoreSize(t *testing.T) {
+
+	dir, err := os.MkdirTemp(os.TempDir(), "raftmodtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	snapshots, err := NewFileSnapshotStore(dir, 10, nil)
+	require.NoError(t, err)
+
+	content := make([]byte, 1000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+
+	for _, cipher := range []string{"aes-gcm", "chacha20-poly1305"} {
+
+		store, err := NewEncryptedSnapshotStore(snapshots, "123", WithKDF("sha256", ""), WithCipher(cipher), WithChunkSize(100))
+		require.NoError(t, err)
+
+		for i, size := range []int{0, 1, 99, 100, 101, 300, 1000} {
+
+			sink, err := store.Create(raft.SnapshotVersionMax, uint64(i + 1), 1, raft.Configuration{}, 0, nil)
+			require.NoError(t, err)
+			_, err = sink.Write(content[:size])
+			require.NoError(t, err)
+			require.NoError(t, sink.Close())
+
+			// raft checks that InstallSnapshot streams exactly meta.Size bytes
+			meta, reader, err := store.Open(sink.ID())
+			require.NoError(t, err)
+			actual, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			require.NoError(t, reader.Close())
+			require.True(t, bytes.Equal(content[:size], actual), "cipher %s, size %d", cipher, size)
+			require.Equal(t, int64(len(actual)), meta.Size, "cipher %s, size %d", cipher, size)
+		}
+	}
+
+}
+
+func TestEncryptedSnapshotStoreRotation(t *testing.T) {
+
+	dir, err := os.MkdirTemp(os.TempDir(), "raftmodtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	snapshots, err := NewFileSnapshotStore(dir, 5, nil)
+	require.NoError(t, err)
+
+	old, err := NewEncryptedSnapshotStore(snapshots, "123", WithKDF("sha256", ""), WithKeyID("k1"))
+	require.NoError(t, err)
+
+	welcome := "Hello World!"
+	for i := uint64(1); i <= 3; i++ {
+		sink, err := old.Create(raft.SnapshotVersionMax, 100 * i, 1, raft.Configuration{}, 0, nil)
+		require.NoError(t, err)
+		_, err = sink.Write([]byte(welcome))
+		require.NoError(t, err)
+		require.NoError(t, sink.Close())
+	}
+
+	s, err := NewEncryptedSnapshotStore(snapshots, "456", WithKDF("sha256", ""), WithKeyID("k2"), WithKey("k1", "123"))
+	require.NoError(t, err)
+	store := s.(EncryptedSnapshotStore)
+	require.Equal(t, "k2", store.ActiveKeyID())
+
+	require.NoError(t, <-store.Rotate(context.Background()))
+
+	// old keyring can not read rotated snapshots
+	list, err := store.List()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(list))
+
+	for _, meta := range list {
+		_, _, err = old.Open(meta.ID)
+		require.True(t, errors.Is(err, ErrUnknownSnapshotKey), "%v", err)
+
+		_, reader, err := store.Open(meta.ID)
+		require.NoError(t, err)
+		content, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, welcome, string(content))
+		require.NoError(t, reader.Close())
+	}
+
+	// new keyring without the old key
+	rotated, err := NewEncryptedSnapshotStore(snapshots, "456", WithKDF("sha256", ""), WithKeyID("k2"))
+	require.NoError(t, err)
+	_, reader, err := rotated.Open(list[0].ID)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+
+}
+
+type bufferSink struct {
+	bytes.Buffer
+}
+
+func (t *bufferSink) ID() string {
+	return "buffer"
+}
+
+func (t *bufferSink) Cancel() error {
+	return nil
+}
+
+func (t *bufferSink) Close() error {
+	return nil
+}
+
+func TestChunkEncrypter(t *testing.T) {
+
+	s, err := NewEncryptedSnapshotStore(nil, "123", WithKDF("sha256", ""))
+	require.NoError(t, err)
+	store := s.(*implEncryptedSnapshotStore)
+	meta := &raft.SnapshotMeta{Index: 100, Term: 1}
+
+	content := make([]byte, 1000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+
+	for _, cipher := range []SnapshotCipher{CipherAESGCM, CipherChaCha20Poly1305} {
+
+		for _, size := range []int{0, 99, 100, 1000} {
+
+			header, err := newSnapshotHeader(cipher, 100, store.kdf, "")
+			require.NoError(t, err)
+
+			sessionKey, err := store.sessionKey(header, meta.Index, meta.Term, "buffer")
+			require.NoError(t, err)
+
+			sink := &bufferSink{}
+			encrypter, err := newChunkEncrypter(sessionKey, header, sink)
+			require.NoError(t, err)
+
+			_, err = encrypter.Write(content[:size])
+			require.NoError(t, err)
+			require.NoError(t, encrypter.Close())
+
+			encrypted := sink.Bytes()
+
+			reader, err := store.openStream(meta, "buffer", io.NopCloser(bytes.NewReader(encrypted)))
+			require.NoError(t, err)
+			actual, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			require.True(t, bytes.Equal(content[:size], actual), "cipher %s, size %d", cipher, size)
+
+			// flipped bit
+			tampered := append([]byte{}, encrypted...)
+			tampered[len(tampered)-1] ^= 1
+			reader, err = store.openStream(meta, "buffer", io.NopCloser(bytes.NewReader(tampered)))
+			require.NoError(t, err)
+			_, err = io.ReadAll(reader)
+			require.Equal(t, ErrSnapshotCorrupted, err)
+
+			// truncated after the first chunk
+			if size > 100 {
+				truncated := encrypted[:len(header.marshal()) + chunkRecordHeaderSize + 100 + 16]
+				reader, err = store.openStream(meta, "buffer", io.NopCloser(bytes.NewReader(truncated)))
+				require.NoError(t, err)
+				_, err = io.ReadAll(reader)
+				require.Equal(t, ErrSnapshotTruncated, err)
+			}
+
+		}
+	}
+
+}
+
+func TestSnapshotHeaderChunkSize(t *testing.T) {
+
+	_, err := newSnapshotHeader(CipherAESGCM, maxSnapshotChunkSize+1, KDFSHA256, "")
+	require.Error(t, err)
+
+	header, err := newSnapshotHeader(CipherAESGCM, 100, KDFSHA256, "k1")
+	require.NoError(t, err)
+
+	// corrupted chunk size is rejected before the buffer is allocated
+	data := header.marshal()
+	binary.BigEndian.PutUint32(data[len(snapshotMagic)+2:], 0xFFFFFFFF)
+
+	_, _, _, err = readEncryptionHeader(io.NopCloser(bytes.NewReader(data)))
+	require.True(t, errors.Is(err, ErrSnapshotCorrupted), "%v", err)
+
+}
@@ -0,0 +1,393 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"hash/crc64"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+/**
+Layout of raft.FileSnapshotStore, snapshot is the directory with metadata and state files.
+ */
+const (
+	fileSnapshotsDir  = "snapshots"
+	fileSnapshotMeta  = "meta.json"
+	fileSnapshotState = "state.bin"
+
+	// written by SetAttribute, raft.FileSnapshotStore ignores other files of the snapshot directory
+	fileSnapshotAttributes = "attributes.json"
+
+	fileSnapshotQuarantineDir = "quarantine"
+
+	// ends with '.tmp', so raft.FileSnapshotStore skips them in List
+	fileSnapshotRewriteSuffix = ".rewrite.tmp"
+	fileSnapshotOldSuffix     = ".old.tmp"
+)
+
+type implFileSnapshotStore struct {
+	*raft.FileSnapshotStore
+	path string
+
+	// serializes attribute updates with the swap of rewritten snapshot
+	attributesMu sync.Mutex
+}
+
+/**
+Wraps raft.FileSnapshotStore with SnapshotRewriter and SnapshotAttributes support.
+ */
+func NewFileSnapshotStore(base string, retain int, logger hclog.Logger) (raft.SnapshotStore, error) {
+	store, err := raft.NewFileSnapshotStoreWithLogger(base, retain, logger)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(base, fileSnapshotsDir)
+	if err := recoverRewrites(path); err != nil {
+		return nil, errors.Errorf("snapshot rewrite recovery in '%s' error, %v", path, err)
+	}
+	return &implFileSnapshotStore{
+		FileSnapshotStore: store,
+		path:              path,
+	}, nil
+}
+
+/**
+Reports CRC mismatch as ErrSnapshotDigestMismatch, so the corrupt snapshot could be quarantined.
+raft.FileSnapshotStore has no error value for the mismatch, so the CRC is verified again on failure.
+ */
+func (t *implFileSnapshotStore) Open(id string) (*raft.SnapshotMeta, io.ReadCloser, error) {
+	meta, source, err := t.FileSnapshotStore.Open(id)
+	if err != nil {
+		if verr := t.verifyCRC(id); errors.Is(verr, ErrSnapshotDigestMismatch) {
+			return nil, nil, verr
+		}
+		return nil, nil, err
+	}
+	return meta, source, nil
+}
+
+/**
+Compares CRC64 of the state file with the one in the metadata file.
+ */
+func (t *implFileSnapshotStore) verifyCRC(id string) error {
+
+	dir := filepath.Join(t.path, id)
+
+	data, err := os.ReadFile(filepath.Join(dir, fileSnapshotMeta))
+	if err != nil {
+		return err
+	}
+	var meta fileSnapshotMetadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return err
+	}
+
+	fd, err := os.Open(filepath.Join(dir, fileSnapshotState))
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	hash := crc64.New(crc64.MakeTable(crc64.ECMA))
+	if _, err := io.Copy(hash, bufio.NewReader(fd)); err != nil {
+		return err
+	}
+	if !bytes.Equal(hash.Sum(nil), meta.CRC) {
+		return errors.Wrapf(ErrSnapshotDigestMismatch, "snapshot '%s' CRC64", id)
+	}
+	return nil
+}
+
+/**
+The same JSON as metadata file written by raft.FileSnapshotStore.
+ */
+type fileSnapshotMetadata struct {
+	raft.SnapshotMeta
+	CRC []byte
+}
+
+/**
+Writes the rewritten snapshot in to the temporary directory and swaps it with the snapshot directory,
+so a crash leaves either the old or the new complete snapshot, recovered by recoverRewrites on start.
+ */
+func (t *implFileSnapshotStore) Rewrite(id string, fn func(meta *raft.SnapshotMeta, source io.Reader, sink io.Writer) error) error {
+
+	meta, source, err := t.Open(id)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	dir := filepath.Join(t.path, id)
+	rewriteDir := dir + fileSnapshotRewriteSuffix
+	oldDir := dir + fileSnapshotOldSuffix
+
+	if err := os.RemoveAll(rewriteDir); err != nil {
+		return err
+	}
+	if err := os.Mkdir(rewriteDir, 0755); err != nil {
+		return err
+	}
+
+	if err := t.writeRewrite(rewriteDir, meta, source, fn); err != nil {
+		os.RemoveAll(rewriteDir)
+		return err
+	}
+
+	t.attributesMu.Lock()
+	defer t.attributesMu.Unlock()
+
+	attributes, err := readSnapshotAttributes(dir)
+	if err == nil && len(attributes) > 0 {
+		err = writeSnapshotAttributes(rewriteDir, attributes)
+	}
+	if err != nil {
+		os.RemoveAll(rewriteDir)
+		return err
+	}
+
+	if err := os.Rename(dir, oldDir); err != nil {
+		os.RemoveAll(rewriteDir)
+		return err
+	}
+	if err := os.Rename(rewriteDir, dir); err != nil {
+		// put back the old snapshot, otherwise it is recovered on start
+		if os.Rename(oldDir, dir) == nil {
+			os.RemoveAll(rewriteDir)
+		}
+		return err
+	}
+	if err := syncDir(t.path); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(oldDir)
+}
+
+func (t *implFileSnapshotStore) writeRewrite(dir string, meta *raft.SnapshotMeta, source io.Reader, fn func(meta *raft.SnapshotMeta, source io.Reader, sink io.Writer) error) error {
+
+	rewritten := &fileSnapshotMetadata{SnapshotMeta: *meta}
+
+	err := writeSnapshotFile(filepath.Join(dir, fileSnapshotState), func(w io.Writer) error {
+		hash := crc64.New(crc64.MakeTable(crc64.ECMA))
+		counter := &countingWriter{}
+		if err := fn(meta, source, io.MultiWriter(w, hash, counter)); err != nil {
+			return err
+		}
+		rewritten.Size = counter.n
+		rewritten.CRC = hash.Sum(nil)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = writeSnapshotFile(filepath.Join(dir, fileSnapshotMeta), func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(rewritten)
+	})
+	if err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+/**
+Attributes are kept in the separate file of the snapshot directory, because raft owns the metadata file.
+ */
+func (t *implFileSnapshotStore) SetAttribute(id, name string, value []byte) error {
+
+	t.attributesMu.Lock()
+	defer t.attributesMu.Unlock()
+
+	dir := filepath.Join(t.path, id)
+	if _, err := os.Stat(filepath.Join(dir, fileSnapshotMeta)); err != nil {
+		if os.IsNotExist(err) {
+			return errors.Wrapf(ErrSnapshotNotFound, "snapshot '%s'", id)
+		}
+		return err
+	}
+
+	attributes, err := readSnapshotAttributes(dir)
+	if err != nil {
+		return err
+	}
+	attributes[name] = value
+	return writeSnapshotAttributes(dir, attributes)
+}
+
+func (t *implFileSnapshotStore) Attribute(id, name string) ([]byte, error) {
+	attributes, err := readSnapshotAttributes(filepath.Join(t.path, id))
+	if err != nil {
+		return nil, err
+	}
+	return attributes[name], nil
+}
+
+func readSnapshotAttributes(dir string) (map[string][]byte, error) {
+	attributes := make(map[string][]byte)
+	data, err := os.ReadFile(filepath.Join(dir, fileSnapshotAttributes))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return attributes, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &attributes); err != nil {
+		return nil, err
+	}
+	return attributes, nil
+}
+
+/**
+Replaces the attributes file by rename, so a crash leaves either the old or the new file.
+ */
+func writeSnapshotAttributes(dir string, attributes map[string][]byte) error {
+	path := filepath.Join(dir, fileSnapshotAttributes)
+	tmp := path + ".tmp"
+	err := writeSnapshotFile(tmp, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(attributes)
+	})
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+/**
+Completes or rolls back rewrites interrupted by a crash.
+The rewrite directory is complete once the snapshot directory is moved away, so it takes the place of the snapshot.
+ */
+func recoverRewrites(path string) error {
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	ids := make(map[string]bool)
+	for _, entry := range entries {
+		for _, suffix := range []string{fileSnapshotRewriteSuffix, fileSnapshotOldSuffix} {
+			if strings.HasSuffix(entry.Name(), suffix) {
+				ids[strings.TrimSuffix(entry.Name(), suffix)] = true
+			}
+		}
+	}
+
+	for id := range ids {
+		dir := filepath.Join(path, id)
+		rewriteDir := dir + fileSnapshotRewriteSuffix
+		oldDir := dir + fileSnapshotOldSuffix
+
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			// crashed between renames, prefer the complete rewrite
+			if err := os.Rename(rewriteDir, dir); err != nil {
+				if !os.IsNotExist(err) {
+					return err
+				}
+				if err := os.Rename(oldDir, dir); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := os.RemoveAll(rewriteDir); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(oldDir); err != nil {
+			return err
+		}
+	}
+
+	return syncDir(path)
+}
+
+/**
+Moves snapshot directory in to the 'quarantine' subdirectory of the base directory.
+ */
+func (t *implFileSnapshotStore) Quarantine(id string) error {
+	quarantine := filepath.Join(filepath.Dir(t.path), fileSnapshotQuarantineDir)
+	if err := os.MkdirAll(quarantine, 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(t.path, id), filepath.Join(quarantine, id)); err != nil {
+		return err
+	}
+	return syncDir(t.path)
+}
+
+/**
+Deletes snapshot directory.
+ */
+func (t *implFileSnapshotStore) Remove(id string) error {
+	if err := os.RemoveAll(filepath.Join(t.path, id)); err != nil {
+		return err
+	}
+	return syncDir(t.path)
+}
+
+func writeSnapshotFile(path string, fn func(w io.Writer) error) error {
+	fd, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	buffered := bufio.NewWriter(fd)
+	if err := fn(buffered); err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+	if err := fd.Sync(); err != nil {
+		return err
+	}
+	return fd.Close()
+}
+
+func syncDir(path string) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return fd.Sync()
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (t *countingWriter) Write(p []byte) (int, error) {
+	t.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"errors"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readTestSnapshot(t *testing.T, store raft.SnapshotStore, id string) string {
+	meta, reader, err := store.Open(id)
+	require.NoError(t, err)
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), meta.Size)
+	return string(content)
+}
+
+func replaceTestSnapshot(content string) func(meta *raft.SnapshotMeta, source io.Reader, sink io.Writer) error {
+	return func(meta *raft.SnapshotMeta, source io.Reader, sink io.Writer) error {
+		_, err := sink.Write([]byte(content))
+		return err
+	}
+}
+
+func TestFileSnapshotStoreRewrite(t *testing.T) {
+
+	dir, err := os.MkdirTemp(os.TempDir(), "raftmodtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileSnapshotStore(dir, 5, nil)
+	require.NoError(t, err)
+	store := s.(*implFileSnapshotStore)
+
+	sink, err := store.Create(raft.SnapshotVersionMax, 100, 1, raft.Configuration{}, 0, nil)
+	require.NoError(t, err)
+	_, err = sink.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+	id := sink.ID()
+
+	require.NoError(t, store.SetAttribute(id, "name", []byte("value")))
+	require.True(t, errors.Is(store.SetAttribute("1-1-1", "name", []byte("value")), ErrSnapshotNotFound))
+
+	require.NoError(t, store.Rewrite(id, replaceTestSnapshot("rewritten")))
+	require.Equal(t, "rewritten", readTestSnapshot(t, store, id))
+
+	// attributes are kept by the rewrite
+	value, err := store.Attribute(id, "name")
+	require.NoError(t, err)
+	require.Equal(t, "value", string(value))
+
+	snapshotDir := filepath.Join(store.path, id)
+	_, err = os.Stat(snapshotDir + fileSnapshotRewriteSuffix)
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(snapshotDir + fileSnapshotOldSuffix)
+	require.True(t, os.IsNotExist(err))
+
+	// crash after the snapshot directory is moved away, the complete rewrite takes its place
+	meta, source, err := store.Open(id)
+	require.NoError(t, err)
+	require.NoError(t, os.Mkdir(snapshotDir + fileSnapshotRewriteSuffix, 0755))
+	require.NoError(t, store.writeRewrite(snapshotDir + fileSnapshotRewriteSuffix, meta, source, replaceTestSnapshot("recovered")))
+	source.Close()
+	require.NoError(t, os.Rename(snapshotDir, snapshotDir + fileSnapshotOldSuffix))
+
+	recovered, err := NewFileSnapshotStore(dir, 5, nil)
+	require.NoError(t, err)
+	require.Equal(t, "recovered", readTestSnapshot(t, recovered, id))
+
+	// crash before the rewrite is complete, the old snapshot stays
+	require.NoError(t, os.Mkdir(snapshotDir + fileSnapshotRewriteSuffix, 0755))
+
+	recovered, err = NewFileSnapshotStore(dir, 5, nil)
+	require.NoError(t, err)
+	require.Equal(t, "recovered", readTestSnapshot(t, recovered, id))
+
+	list, err := recovered.List()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(list))
+
+	entries, err := os.ReadDir(store.path)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(entries))
+
+}
+
+func TestFileSnapshotStoreCRCMismatch(t *testing.T) {
+
+	dir, err := os.MkdirTemp(os.TempDir(), "raftmodtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileSnapshotStore(dir, 5, nil)
+	require.NoError(t, err)
+	store := s.(*implFileSnapshotStore)
+
+	sink, err := store.Create(raft.SnapshotVersionMax, 100, 1, raft.Configuration{}, 0, nil)
+	require.NoError(t, err)
+	_, err = sink.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+	id := sink.ID()
+
+	require.Equal(t, "hello", readTestSnapshot(t, store, id))
+
+	state := filepath.Join(store.path, id, fileSnapshotState)
+	require.NoError(t, os.WriteFile(state, []byte("jello"), 0644))
+
+	_, _, err = store.Open(id)
+	require.True(t, errors.Is(err, ErrSnapshotDigestMismatch), "%v", err)
+
+	// other failures are reported as is
+	require.NoError(t, os.Remove(state))
+	_, _, err = store.Open(id)
+	require.Error(t, err)
+	require.False(t, errors.Is(err, ErrSnapshotDigestMismatch))
+
+}
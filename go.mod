@@ -6,23 +6,27 @@ require (
 	github.com/codeallergy/glue v1.0.2
 	github.com/codeallergy/raftapi v1.0.2
 	github.com/codeallergy/raftbadger v1.0.0
+	github.com/codeallergy/raftpb v1.0.2
 	github.com/codeallergy/sprint v1.0.4
 	github.com/codeallergy/store v1.0.1
 	github.com/dgraph-io/badger/v3 v3.2103.5
 	github.com/go-errors/errors v1.4.2
+	github.com/hashicorp/go-hclog v0.9.2
 	github.com/hashicorp/raft v1.3.11
+	github.com/klauspost/compress v1.16.0
 	github.com/pkg/errors v0.9.1
 	github.com/stretchr/testify v1.8.2
 	go.uber.org/atomic v1.10.0
 	go.uber.org/zap v1.24.0
+	golang.org/x/crypto v0.6.0
 	google.golang.org/grpc v1.53.0
+	google.golang.org/protobuf v1.28.1
 )
 
 require (
 	github.com/armon/go-metrics v0.0.0-20190430140413-ec5e00d3c878 // indirect
 	github.com/cespare/xxhash v1.1.0 // indirect
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
-	github.com/codeallergy/raftpb v1.0.2 // indirect
 	github.com/codeallergy/sprintpb v1.0.0 // indirect
 	github.com/codeallergy/uuid v1.0.1 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
@@ -35,20 +39,16 @@ require (
 	github.com/golang/snappy v0.0.4 // indirect
 	github.com/google/flatbuffers v23.1.21+incompatible // indirect
 	github.com/grpc-ecosystem/grpc-gateway/v2 v2.15.2 // indirect
-	github.com/hashicorp/go-hclog v0.9.2 // indirect
 	github.com/hashicorp/go-immutable-radix v1.0.0 // indirect
 	github.com/hashicorp/go-msgpack v0.5.5 // indirect
 	github.com/hashicorp/golang-lru v0.5.1 // indirect
-	github.com/klauspost/compress v1.16.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	go.opencensus.io v0.24.0 // indirect
 	go.uber.org/multierr v1.9.0 // indirect
-	golang.org/x/crypto v0.6.0 // indirect
 	golang.org/x/net v0.7.0 // indirect
 	golang.org/x/sys v0.6.0 // indirect
 	golang.org/x/text v0.8.0 // indirect
 	google.golang.org/genproto v0.0.0-20230303212802-e74f57abe488 // indirect
-	google.golang.org/protobuf v1.28.1 // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,233 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/pkg/errors"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+var keyCommandTimeout = 30 * time.Second
+
+const envelopeKeyPEMType = "RAFTMOD ENVELOPE KEY"
+
+/**
+FILE KEY PROVIDER
+ */
+
+type implFileKeyProvider struct {
+	name string
+	path string
+}
+
+/**
+Reads token from the file, trailing whitespaces are removed.
+ */
+func FileKeyProvider(beanName, path string) KeyProvider {
+	return &implFileKeyProvider{name: beanName, path: path}
+}
+
+func (t *implFileKeyProvider) BeanName() string {
+	return t.name
+}
+
+func (t *implFileKeyProvider) GetKey() (string, error) {
+	content, err := os.ReadFile(t.path)
+	if err != nil {
+		return "", errors.Errorf("key file '%s' read error, %v", t.path, err)
+	}
+	token := strings.TrimRight(string(content), " \t\r\n")
+	if token == "" {
+		return "", errors.Errorf("key file '%s' is empty", t.path)
+	}
+	return token, nil
+}
+
+/**
+ENVIRONMENT KEY PROVIDER
+ */
+
+type implEnvKeyProvider struct {
+	name     string
+	variable string
+}
+
+/**
+Reads token from the environment variable.
+ */
+func EnvKeyProvider(beanName, variable string) KeyProvider {
+	return &implEnvKeyProvider{name: beanName, variable: variable}
+}
+
+func (t *implEnvKeyProvider) BeanName() string {
+	return t.name
+}
+
+func (t *implEnvKeyProvider) GetKey() (string, error) {
+	token, ok := os.LookupEnv(t.variable)
+	if !ok || token == "" {
+		return "", errors.Errorf("environment variable '%s' is empty", t.variable)
+	}
+	return token, nil
+}
+
+/**
+ENVELOPE KEY PROVIDER
+ */
+
+type implEnvelopeKeyProvider struct {
+	name           string
+	envelopePath   string
+	privateKeyPath string
+}
+
+/**
+Decrypts the envelope key by the local RSA private key, envelope file is PEM block 'RAFTMOD ENVELOPE KEY'
+with the token encrypted by RSA-OAEP SHA-256, private key file is PEM block of PKCS #1 or PKCS #8 key.
+ */
+func EnvelopeKeyProvider(beanName, envelopePath, privateKeyPath string) KeyProvider {
+	return &implEnvelopeKeyProvider{name: beanName, envelopePath: envelopePath, privateKeyPath: privateKeyPath}
+}
+
+func (t *implEnvelopeKeyProvider) BeanName() string {
+	return t.name
+}
+
+func (t *implEnvelopeKeyProvider) GetKey() (string, error) {
+
+	envelope, err := readPEMBlock(t.envelopePath, envelopeKeyPEMType)
+	if err != nil {
+		return "", err
+	}
+
+	privateKey, err := readRSAPrivateKey(t.privateKeyPath)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, envelope.Bytes, nil)
+	if err != nil {
+		return "", errors.Errorf("envelope key '%s' decrypt error, %v", t.envelopePath, err)
+	}
+	defer clean(token)
+
+	return string(token), nil
+}
+
+/**
+Encrypts token by the public key in to the PEM block readable by EnvelopeKeyProvider.
+ */
+func SealEnvelopeKey(token []byte, publicKey *rsa.PublicKey) ([]byte, error) {
+	encrypted, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, token, nil)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: envelopeKeyPEMType, Bytes: encrypted}), nil
+}
+
+func readPEMBlock(path, blockType string) (*pem.Block, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Errorf("pem file '%s' read error, %v", path, err)
+	}
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			return nil, errors.Errorf("pem block '%s' not found in file '%s'", blockType, path)
+		}
+		if block.Type == blockType {
+			return block, nil
+		}
+	}
+}
+
+func readRSAPrivateKey(path string) (*rsa.PrivateKey, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Errorf("private key file '%s' read error, %v", path, err)
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errors.Errorf("private key file '%s' is not in PEM format", path)
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+			return rsaKey, nil
+		}
+		return nil, errors.Errorf("private key file '%s' has unsupported key type %T", path, key)
+	default:
+		return nil, errors.Errorf("private key file '%s' has unsupported PEM block '%s'", path, block.Type)
+	}
+}
+
+/**
+COMMAND KEY PROVIDER
+ */
+
+type implCommandKeyProvider struct {
+	name    string
+	command string
+	args    []string
+}
+
+/**
+Runs external command, for example a secret manager client, and takes token from the standard output.
+ */
+func CommandKeyProvider(beanName, command string, args ...string) KeyProvider {
+	return &implCommandKeyProvider{name: beanName, command: command, args: args}
+}
+
+func (t *implCommandKeyProvider) BeanName() string {
+	return t.name
+}
+
+func (t *implCommandKeyProvider) GetKey() (string, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), keyCommandTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, t.command, t.args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", errors.Errorf("key command '%s' error, %v, %s", t.command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	token := strings.TrimRight(stdout.String(), " \t\r\n")
+	if token == "" {
+		return "", errors.Errorf("key command '%s' returned empty output", t.command)
+	}
+	return token, nil
+}
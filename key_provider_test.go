@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyProviders(t *testing.T) {
+
+	dir, err := os.MkdirTemp(os.TempDir(), "raftmodtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "snapshot.key")
+	require.NoError(t, os.WriteFile(keyFile, []byte("secret\n"), 0600))
+
+	token, err := FileKeyProvider("file-key", keyFile).GetKey()
+	require.NoError(t, err)
+	require.Equal(t, "secret", token)
+
+	os.Setenv("RAFTMOD_TEST_KEY", "secret")
+	defer os.Unsetenv("RAFTMOD_TEST_KEY")
+
+	token, err = EnvKeyProvider("env-key", "RAFTMOD_TEST_KEY").GetKey()
+	require.NoError(t, err)
+	require.Equal(t, "secret", token)
+
+	_, err = EnvKeyProvider("env-key", "RAFTMOD_TEST_MISSING_KEY").GetKey()
+	require.Error(t, err)
+
+	token, err = CommandKeyProvider("command-key", "echo", "secret").GetKey()
+	require.NoError(t, err)
+	require.Equal(t, "secret", token)
+
+	_, err = CommandKeyProvider("command-key", "false").GetKey()
+	require.Error(t, err)
+
+}
+
+func TestEnvelopeKeyProvider(t *testing.T) {
+
+	dir, err := os.MkdirTemp(os.TempDir(), "raftmodtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	require.NoError(t, err)
+	privateKeyFile := filepath.Join(dir, "node.key")
+	require.NoError(t, os.WriteFile(privateKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+
+	envelope, err := SealEnvelopeKey([]byte("secret"), &privateKey.PublicKey)
+	require.NoError(t, err)
+	envelopeFile := filepath.Join(dir, "snapshot.pem")
+	require.NoError(t, os.WriteFile(envelopeFile, envelope, 0600))
+
+	token, err := EnvelopeKeyProvider("envelope-key", envelopeFile, privateKeyFile).GetKey()
+	require.NoError(t, err)
+	require.Equal(t, "secret", token)
+
+	// another private key
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherKeyFile := filepath.Join(dir, "other.key")
+	require.NoError(t, os.WriteFile(otherKeyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(otherKey)}), 0600))
+
+	_, err = EnvelopeKeyProvider("envelope-key", envelopeFile, otherKeyFile).GetKey()
+	require.Error(t, err)
+
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"context"
+	"github.com/codeallergy/raftapi"
+	"github.com/codeallergy/raftpb"
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"time"
+)
+
+var (
+	applyRetryInterval  = 100 * time.Millisecond
+	defaultApplyTimeout = 10 * time.Second  // used if forwarded request has no deadline
+)
+
+func (t *implRaftServer) Apply(ctx context.Context, cmd []byte) (interface{}, error) {
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.Timeout)
+		defer cancel()
+	}
+
+	for {
+
+		resp, err := t.tryApply(ctx, cmd)
+		if err == nil || !isRetryableApply(err) {
+			return resp, err
+		}
+
+		t.Log.Debug("RaftApplyRetry", zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return nil, errors.Errorf("raft apply deadline exceeded, last error: %v", err)
+		case <-time.After(applyRetryInterval):
+		}
+
+	}
+
+}
+
+func (t *implRaftServer) tryApply(ctx context.Context, cmd []byte) (interface{}, error) {
+
+	r, ok := t.Raft()
+	if !ok || r == nil {
+		return nil, ErrRaftNotRunning
+	}
+
+	if r.State() == raft.Leader {
+		return applyLocal(ctx, r, cmd, t.Timeout)
+	}
+
+	leader := r.Leader()
+	if leader == "" {
+		return nil, ErrNoLeader
+	}
+
+	conn, err := t.leaderConn(ctx, leader)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := newRaftInternalClient(conn).Apply(ctx, &raftpb.Command{Payload: cmd})
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeApplyResponse(out)
+}
+
+/**
+Applies command on the leader, FSM response is normalized to be the same for local and forwarded calls.
+ */
+func applyLocal(ctx context.Context, r *raft.Raft, cmd []byte, timeout time.Duration) (interface{}, error) {
+
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+		if timeout <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+	}
+
+	future := r.Apply(cmd, timeout)
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+
+	return normalizeApplyResponse(future.Response())
+}
+
+/**
+Supported FSM response types are nil, []byte, error, proto.Message and raftapi.FSMResponse.
+ */
+func normalizeApplyResponse(resp interface{}) (interface{}, error) {
+	switch v := resp.(type) {
+	case nil:
+		return nil, nil
+	case error:
+		return nil, v
+	case raftapi.FSMResponse:
+		if v.Err != nil {
+			return nil, v.Err
+		}
+		return v.Status, nil
+	case *raftapi.FSMResponse:
+		if v.Err != nil {
+			return nil, v.Err
+		}
+		return v.Status, nil
+	default:
+		return resp, nil
+	}
+}
+
+func encodeApplyResponse(resp interface{}) (*anypb.Any, error) {
+	switch v := resp.(type) {
+	case nil:
+		return &anypb.Any{}, nil
+	case []byte:
+		return anypb.New(wrapperspb.Bytes(v))
+	case proto.Message:
+		return anypb.New(v)
+	default:
+		return nil, errors.Errorf("unsupported FSM response type '%T' for forwarding", resp)
+	}
+}
+
+func decodeApplyResponse(out *anypb.Any) (interface{}, error) {
+	if out.TypeUrl == "" {
+		return nil, nil
+	}
+	msg, err := out.UnmarshalNew()
+	if err != nil {
+		return nil, errors.Errorf("unmarshal FSM response '%s' error, %v", out.TypeUrl, err)
+	}
+	if b, ok := msg.(*wrapperspb.BytesValue); ok {
+		return b.Value, nil
+	}
+	return msg, nil
+}
+
+/**
+Errors caused by leader change or unreachable leader, returned before the command reached the log.
+Lost leadership and unavailable leader are not retried, because command could be already committed.
+ */
+func isRetryableApply(err error) bool {
+	if errors.Is(err, ErrNoLeader) || errors.Is(err, ErrLeaderUnreachable) {
+		return true
+	}
+	switch err {
+	case raft.ErrNotLeader, raft.ErrLeadershipTransferInProgress:
+		return true
+	}
+	if s, ok := status.FromError(err); ok {
+		// rejected by checkLeader or by raft before enqueue
+		return s.Code() == codes.FailedPrecondition
+	}
+	return false
+}
+
+/**
+Converts errors of the local apply on the leader to gRPC status.
+ */
+func applyErrorStatus(err error) error {
+	switch err {
+	case raft.ErrNotLeader, raft.ErrLeadershipTransferInProgress:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case raft.ErrLeadershipLost:
+		return status.Error(codes.Aborted, err.Error())
+	case raft.ErrRaftShutdown:
+		return status.Error(codes.Unavailable, err.Error())
+	case raft.ErrEnqueueTimeout, context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	default:
+		return status.Error(codes.Unknown, err.Error())
+	}
+}
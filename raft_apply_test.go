@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"context"
+	"errors"
+	"github.com/codeallergy/raftapi"
+	"github.com/codeallergy/raftpb"
+	"github.com/hashicorp/raft"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func TestApplyResponseForwarding(t *testing.T) {
+
+	out, err := encodeApplyResponse(nil)
+	require.NoError(t, err)
+	resp, err := decodeApplyResponse(out)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	out, err = encodeApplyResponse([]byte("Hello World!"))
+	require.NoError(t, err)
+	resp, err = decodeApplyResponse(out)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hello World!"), resp)
+
+	status, err := normalizeApplyResponse(raftapi.FSMResponse{Status: &raftpb.Status{Updated: true, Id: "123"}})
+	require.NoError(t, err)
+	out, err = encodeApplyResponse(status)
+	require.NoError(t, err)
+	resp, err = decodeApplyResponse(out)
+	require.NoError(t, err)
+	require.True(t, resp.(*raftpb.Status).Updated)
+	require.Equal(t, "123", resp.(*raftpb.Status).Id)
+
+	fsmErr := errors.New("fsm error")
+	_, err = normalizeApplyResponse(&raftapi.FSMResponse{Err: fsmErr})
+	require.Equal(t, fsmErr, err)
+
+	_, err = encodeApplyResponse(struct{}{})
+	require.Error(t, err)
+
+}
+
+func TestApplyRetryable(t *testing.T) {
+
+	for _, c := range []struct {
+		err       error
+		retryable bool
+	}{
+		{ErrNoLeader, true},
+		{pkgerrors.Wrap(ErrLeaderUnreachable, "leader '10.0.0.1:7000'"), true},
+		{raft.ErrNotLeader, true},
+		{raft.ErrLeadershipTransferInProgress, true},
+		{status.Error(codes.FailedPrecondition, "node is not the leader"), true},
+		// the command could reach the leader
+		{status.Error(codes.Unavailable, "connection reset"), false},
+		{status.Error(codes.DeadlineExceeded, "timeout"), false},
+		{raft.ErrLeadershipLost, false},
+		{errors.New("fsm error"), false},
+	} {
+		require.Equal(t, c.retryable, isRetryableApply(c.err), "%v", c.err)
+	}
+
+}
+
+func TestApplyForwarding(t *testing.T) {
+
+	servers := newTestRaftCluster(t, 3)
+	pool := serveTestInternalService(t, servers)
+	leader := waitTestLeader(t, servers)
+	follower := testFollower(servers)
+	require.NotNil(t, follower)
+
+	for _, c := range []struct {
+		name   string
+		server *implRaftServer
+		cmd    string
+	}{
+		{"leader", leader, "local"},
+		{"follower", follower, "forwarded"},
+	} {
+		resp, err := c.server.Apply(context.Background(), []byte(c.cmd))
+		require.NoError(t, err, c.name)
+		require.Equal(t, []byte(c.cmd), resp, c.name)
+	}
+	require.Equal(t, 2, leader.FSM.(*testFSM).count())
+
+	// applied command is not reported as failed if its response could not be forwarded
+	resp, err := follower.Apply(context.Background(), []byte(testUnencodableCommand))
+	require.NoError(t, err)
+	require.Nil(t, resp)
+	require.Equal(t, 3, leader.FSM.(*testFSM).count())
+
+	// leader connection fails before the command is sent, retried until the deadline
+	follower.RaftClientPool = &testClientPool{}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	start := time.Now()
+	_, err = follower.Apply(ctx, []byte("unreachable"))
+	cancel()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "deadline exceeded")
+	require.Contains(t, err.Error(), ErrLeaderUnreachable.Error())
+	require.True(t, time.Since(start) < 2*time.Second)
+
+	// request that reached a node that is not the leader is rejected and retried until the deadline
+	misdirected := &testClientPool{conns: map[raft.ServerAddress]*grpc.ClientConn{
+		raft.ServerAddress(leader.config.LocalID): pool.conns[raft.ServerAddress(follower.config.LocalID)],
+	}}
+	follower.RaftClientPool = misdirected
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	_, err = follower.Apply(ctx, []byte("misdirected"))
+	cancel()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "deadline exceeded")
+	require.Contains(t, err.Error(), "FailedPrecondition")
+	require.Equal(t, 3, leader.FSM.(*testFSM).count())
+
+	// deadline of the caller is used when it is shorter than the timeout of the server
+	follower.RaftClientPool = pool
+	ctx, cancel = context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	time.Sleep(time.Millisecond)
+	_, err = leader.Apply(ctx, []byte("late"))
+	require.Equal(t, context.DeadlineExceeded, err)
+
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+package raftmod
+
+import (
+	"crypto/x509"
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"net"
+)
+
+var ErrPeerNotAuthorized = errors.New("raft peer is not authorized")
+
+/**
+Allows connection if the node ID of the peer certificate is in the current raft configuration, the bootstrap configuration
+or 'raft-server.allowed-peers' property. Node without configuration and allowlist accepts any verified peer,
+because it waits to be added to the cluster by the leader.
+ */
+func (t *implRaftServer) authorizePeer(cert *x509.Certificate, remote net.Addr) error {
+
+	if cert == nil {
+		t.Log.Warn("RaftPeerRejected", zap.Stringer("remote", remote), zap.String("reason", "no certificate"))
+		return errors.Wrap(ErrPeerNotAuthorized, "no certificate")
+	}
+
+	allowed := t.allowedPeers(false)
+	if len(allowed) == 0 || certificateHasAnyNodeID(cert, allowed) {
+		return nil
+	}
+
+	// configuration could change before the event that invalidates the cache, so it is read again before rejecting
+	allowed = t.allowedPeers(true)
+	if len(allowed) == 0 || certificateHasAnyNodeID(cert, allowed) {
+		return nil
+	}
+
+	t.Log.Warn("RaftPeerRejected",
+		zap.Stringer("remote", remote),
+		zap.String("subject", cert.Subject.String()),
+		zap.Strings("dnsNames", cert.DNSNames),
+		zap.Strings("identity", certificateIdentities(cert)),
+		zap.String("reason", "not a member"))
+	return errors.Wrapf(ErrPeerNotAuthorized, "remote '%s'", remote)
+}
+
+func certificateHasAnyNodeID(cert *x509.Certificate, ids []raft.ServerID) bool {
+	for _, id := range ids {
+		if certificateHasNodeID(cert, id) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+Allowed node IDs cached for the version of the peers, see invalidatePeers.
+ */
+type peerAllowlist struct {
+	version uint64
+	ids     []raft.ServerID
+}
+
+/**
+Returns the version of the peers, changed by invalidatePeers, so accepted connections are authorized again only on change.
+ */
+func (t *implRaftServer) peersVersion() uint64 {
+	return t.peersVer.Load()
+}
+
+/**
+Called when the raft configuration could change: on peer and leader events and on configuration log entries.
+ */
+func (t *implRaftServer) invalidatePeers() {
+	t.peersVer.Inc()
+}
+
+func (t *implRaftServer) allowedPeers(refresh bool) []raft.ServerID {
+	version := t.peersVer.Load()
+	if !refresh {
+		if cached, ok := t.peerAllowlist.Load().(*peerAllowlist); ok && cached.version == version {
+			return cached.ids
+		}
+	}
+	allowed := t.loadAllowedPeers()
+	t.peerAllowlist.Store(&peerAllowlist{version: version, ids: allowed})
+	return allowed
+}
+
+func (t *implRaftServer) loadAllowedPeers() []raft.ServerID {
+
+	var allowed []raft.ServerID
+	for _, id := range t.AllowedPeers {
+		if id != "" {
+			allowed = append(allowed, raft.ServerID(id))
+		}
+	}
+
+	configuration := t.bootstrapConfig
+	if r := t.raft; r != nil {
+		if future := r.GetConfiguration(); future.Error() == nil && len(future.Configuration().Servers) > 0 {
+			configuration = future.Configuration()
+		}
+	}
+	for _, server := range configuration.Servers {
+		allowed = append(allowed, server.ID)
+	}
+
+	return allowed
+}
+
+/**
+Invalidates allowed peers when configuration entries are stored or logs are deleted,
+because followers do not observe peer changes and the configuration could be replaced by a snapshot.
+ */
+type configurationLogStore struct {
+	raft.LogStore
+	changed func()
+}
+
+func (t configurationLogStore) StoreLog(log *raft.Log) error {
+	if err := t.LogStore.StoreLog(log); err != nil {
+		return err
+	}
+	if log.Type == raft.LogConfiguration {
+		t.changed()
+	}
+	return nil
+}
+
+func (t configurationLogStore) StoreLogs(logs []*raft.Log) error {
+	if err := t.LogStore.StoreLogs(logs); err != nil {
+		return err
+	}
+	for _, log := range logs {
+		if log.Type == raft.LogConfiguration {
+			t.changed()
+			break
+		}
+	}
+	return nil
+}
+
+func (t configurationLogStore) DeleteRange(min, max uint64) error {
+	if err := t.LogStore.DeleteRange(min, max); err != nil {
+		return err
+	}
+	t.changed()
+	return nil
+}
+
+/**
+Returns all identities of the certificate that could be matched with node ID, used for logging.
+ */
+func certificateIdentities(cert *x509.Certificate) []string {
+	var list []string
+	list = append(list, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		list = append(list, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		list = append(list, uri.String())
+	}
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(NodeIDExtensionOID) {
+			list = append(list, certificateExtensionValue(ext.Value))
+		}
+	}
+	return list
+}
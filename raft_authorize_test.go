@@ -0,0 +1,169 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+package raftmod
+
+import (
+	"crypto/x509"
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAuthorizePeer(t *testing.T) {
+
+	ca := newTestCA(t)
+
+	server := &implRaftServer{Log: zap.NewNop()}
+	server.bootstrapConfig = raft.Configuration{Servers: []raft.Server{
+		{Suffrage: raft.Voter, ID: "node1", Address: "10.0.0.1:7000"},
+		{Suffrage: raft.Voter, ID: "node2", Address: "10.0.0.2:7000"},
+	}}
+
+	listener := newTestStreamLayer(t, ca.issue(t, "node1", false), ca, TLSModeMutual, nil)
+	defer listener.Close()
+	listener.tlsOpt.authorize = server.authorizePeer
+
+	member := newTestStreamLayer(t, ca.issue(t, "node2", true), ca, TLSModeInsecure, nil)
+	_, serverErr := dialTestStreamLayer(member, listener)
+	require.NoError(t, serverErr)
+
+	stranger := newTestStreamLayer(t, ca.issue(t, "node3", false), ca, TLSModeInsecure, nil)
+	_, serverErr = dialTestStreamLayer(stranger, listener)
+	require.True(t, errors.Is(serverErr, ErrPeerNotAuthorized), "%v", serverErr)
+
+	server.AllowedPeers = []string{"node3"}
+	_, serverErr = dialTestStreamLayer(stranger, listener)
+	require.NoError(t, serverErr)
+
+	// node waiting to join the cluster
+	server.AllowedPeers = nil
+	server.bootstrapConfig = raft.Configuration{}
+	cert, err := x509.ParseCertificate(ca.issue(t, "node4", false).Certificate[0])
+	require.NoError(t, err)
+	require.NoError(t, server.authorizePeer(cert, listener.Addr()))
+
+	require.Error(t, server.authorizePeer(nil, listener.Addr()))
+
+}
+
+func TestAuthorizePeerRemoved(t *testing.T) {
+
+	ca := newTestCA(t)
+
+	server := &implRaftServer{Log: zap.NewNop()}
+	server.bootstrapConfig = raft.Configuration{Servers: []raft.Server{
+		{Suffrage: raft.Voter, ID: "node1", Address: "10.0.0.1:7000"},
+		{Suffrage: raft.Voter, ID: "node2", Address: "10.0.0.2:7000"},
+	}}
+
+	listener := newTestStreamLayer(t, ca.issue(t, "node1", false), ca, TLSModeMutual, nil)
+	defer listener.Close()
+	var authorized atomic.Int32
+	listener.tlsOpt.authorize = func(cert *x509.Certificate, remote net.Addr) error {
+		authorized.Inc()
+		return server.authorizePeer(cert, remote)
+	}
+	listener.tlsOpt.authorizeVersion = server.peersVersion
+
+	// server reads one byte per step, raft keeps the connection between RPCs
+	step := make(chan struct{}, 1)
+	serverErr := make(chan error, 2)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		for range step {
+			_, err = conn.Read(make([]byte, 1))
+			serverErr <- err
+		}
+	}()
+	defer close(step)
+
+	member := newTestStreamLayer(t, ca.issue(t, "node2", false), ca, TLSModeInsecure, nil)
+	step <- struct{}{}
+	client, err := member.Dial(raft.ServerAddress(listener.Addr().String()), time.Second)
+	require.NoError(t, err)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = client.Write([]byte{1})
+	require.NoError(t, err)
+	require.NoError(t, <-serverErr)
+
+	// authorized once on accept, reads do not check the peer again while the peers version is the same
+	server.bootstrapConfig = raft.Configuration{Servers: []raft.Server{
+		{Suffrage: raft.Voter, ID: "node1", Address: "10.0.0.1:7000"},
+		{Suffrage: raft.Voter, ID: "node3", Address: "10.0.0.3:7000"},
+	}}
+
+	step <- struct{}{}
+	_, err = client.Write([]byte{2})
+	require.NoError(t, err)
+	require.NoError(t, <-serverErr)
+	require.Equal(t, int32(1), authorized.Load())
+
+	// the pooled connection stops working once the peer is removed from the configuration
+	server.invalidatePeers()
+
+	step <- struct{}{}
+	client.Write([]byte{3})
+	err = <-serverErr
+	require.True(t, errors.Is(err, ErrPeerNotAuthorized), "%v", err)
+	require.Equal(t, int32(2), authorized.Load())
+
+}
+
+func TestAuthorizePeerAllowlist(t *testing.T) {
+
+	ca := newTestCA(t)
+
+	server := &implRaftServer{Log: zap.NewNop()}
+	server.bootstrapConfig = raft.Configuration{Servers: []raft.Server{
+		{Suffrage: raft.Voter, ID: "node1", Address: "10.0.0.1:7000"},
+	}}
+	require.Equal(t, []raft.ServerID{"node1"}, server.allowedPeers(false))
+
+	// cached until the peers version changes, the new member is checked again before rejecting
+	server.bootstrapConfig.Servers = append(server.bootstrapConfig.Servers, raft.Server{Suffrage: raft.Voter, ID: "node2", Address: "10.0.0.2:7000"})
+	require.Equal(t, []raft.ServerID{"node1"}, server.allowedPeers(false))
+
+	cert, err := x509.ParseCertificate(ca.issue(t, "node2", false).Certificate[0])
+	require.NoError(t, err)
+	require.NoError(t, server.authorizePeer(cert, nil))
+	require.Equal(t, []raft.ServerID{"node1", "node2"}, server.allowedPeers(false))
+
+	// configuration entries and deleted logs change the peers version
+	store := configurationLogStore{LogStore: raft.NewInmemStore(), changed: server.invalidatePeers}
+	version := server.peersVersion()
+
+	require.NoError(t, store.StoreLogs([]*raft.Log{{Index: 1, Type: raft.LogCommand}, {Index: 2, Type: raft.LogNoop}}))
+	require.Equal(t, version, server.peersVersion())
+
+	require.NoError(t, store.StoreLog(&raft.Log{Index: 3, Type: raft.LogConfiguration}))
+	require.NotEqual(t, version, server.peersVersion())
+
+	version = server.peersVersion()
+	require.NoError(t, store.DeleteRange(1, 2))
+	require.NotEqual(t, version, server.peersVersion())
+
+}
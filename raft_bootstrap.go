@@ -0,0 +1,167 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"strings"
+	"time"
+)
+
+var bootstrapProbeInterval = 3 * time.Second
+
+/**
+Parses the list of 'nodeId=address' pairs from 'raft-server.bootstrap-peers' property.
+ */
+func parseBootstrapPeers(list []string) ([]raft.Server, error) {
+	var servers []raft.Server
+	seen := make(map[raft.ServerID]bool)
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		i := strings.IndexByte(entry, '=')
+		if i < 0 {
+			return nil, errors.Errorf("invalid bootstrap peer '%s', expected 'nodeId=address'", entry)
+		}
+		id := raft.ServerID(strings.TrimSpace(entry[:i]))
+		addr := raft.ServerAddress(strings.TrimSpace(entry[i+1:]))
+		if id == "" || addr == "" {
+			return nil, errors.Errorf("invalid bootstrap peer '%s', expected 'nodeId=address'", entry)
+		}
+		host, port, err := getHostAndPortNumber(string(addr))
+		if err != nil {
+			return nil, errors.Errorf("invalid bootstrap peer '%s', %v", entry, err)
+		}
+		if host == "" || port <= 0 || port > 65535 {
+			return nil, errors.Errorf("invalid bootstrap peer '%s', expected 'host:port' address", entry)
+		}
+		if seen[id] {
+			return nil, errors.Errorf("duplicate bootstrap peer '%s'", id)
+		}
+		seen[id] = true
+		servers = append(servers, raft.Server{
+			Suffrage: raft.Voter,
+			ID:       id,
+			Address:  addr,
+		})
+	}
+	return servers, nil
+}
+
+/**
+Builds the initial cluster configuration, local node is always a member of it.
+ */
+func (t *implRaftServer) bootstrapConfiguration() (raft.Configuration, error) {
+
+	servers, err := parseBootstrapPeers(t.BootstrapPeers)
+	if err != nil {
+		return raft.Configuration{}, errors.Errorf("property 'raft-server.bootstrap-peers' error, %v", err)
+	}
+
+	localID := raft.ServerID(t.NodeService.NodeIdHex())
+	found := false
+	for _, server := range servers {
+		if server.ID == localID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		servers = append(servers, raft.Server{
+			Suffrage: raft.Voter,
+			ID:       localID,
+			Address:  t.transport.LocalAddr(),
+		})
+	}
+
+	if t.BootstrapExpect > len(servers) {
+		return raft.Configuration{}, errors.Errorf("property 'raft-server.bootstrap-expect' is %d, but only %d peers are known", t.BootstrapExpect, len(servers))
+	}
+
+	return raft.Configuration{Servers: servers}, nil
+}
+
+func (t *implRaftServer) bootstrapCluster() {
+
+	err := t.raft.BootstrapCluster(t.bootstrapConfig).Error()
+	if err != nil {
+		if err == raft.ErrCantBootstrap {
+			t.Log.Info("RaftBootstrapSkipped", zap.String("reason", "existing state"))
+		} else {
+			t.Log.Error("RaftBootstrap", zap.Error(err))
+		}
+		return
+	}
+
+	t.Log.Info("RaftBootstrap", zap.Int("peers", len(t.bootstrapConfig.Servers)))
+}
+
+/**
+Waits until 'raft-server.bootstrap-expect' peers are reachable and bootstraps the cluster,
+unless this node already got configuration from the leader.
+ */
+func (t *implRaftServer) bootstrapExpect() {
+
+	ticker := time.NewTicker(bootstrapProbeInterval)
+	defer ticker.Stop()
+
+	for t.running.Load() {
+
+		if leader := t.raft.Leader(); leader != "" {
+			t.Log.Info("RaftBootstrapSkipped", zap.String("reason", "leader exist"), zap.String("leader", string(leader)))
+			return
+		}
+
+		hasState, err := raft.HasExistingState(t.LogStore, t.StableStore, t.FileSnapshotStore)
+		if err != nil {
+			t.Log.Error("RaftBootstrapState", zap.Error(err))
+		} else if hasState {
+			t.Log.Info("RaftBootstrapSkipped", zap.String("reason", "existing state"))
+			return
+		}
+
+		known := t.probePeers()
+		if known >= t.BootstrapExpect {
+			t.bootstrapCluster()
+			return
+		}
+
+		t.Log.Info("RaftBootstrapWaiting", zap.Int("known", known), zap.Int("expect", t.BootstrapExpect))
+		<-ticker.C
+	}
+
+}
+
+/**
+Returns number of reachable peers in bootstrap configuration including local node.
+ */
+func (t *implRaftServer) probePeers() int {
+	localAddr := t.transport.LocalAddr()
+	known := 0
+	for _, server := range t.bootstrapConfig.Servers {
+		if server.Address == localAddr {
+			known++
+			continue
+		}
+		conn, err := t.stream.Dial(server.Address, t.Timeout)
+		if err != nil {
+			continue
+		}
+		conn.Close()
+		known++
+	}
+	return known
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"github.com/codeallergy/sprint"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type testNodeService struct {
+	sprint.NodeService
+	id string
+}
+
+func (t testNodeService) NodeIdHex() string {
+	return t.id
+}
+
+/**
+Stream layer that dials only reachable addresses.
+ */
+type testStreamLayer struct {
+	net.Listener
+	reachable map[raft.ServerAddress]bool
+}
+
+func (t testStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	if !t.reachable[address] {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: io.EOF}
+	}
+	client, server := net.Pipe()
+	server.Close()
+	return client, nil
+}
+
+func newTestTCPTransport(t *testing.T) *raft.NetworkTransport {
+	transport, err := raft.NewTCPTransport("127.0.0.1:0", nil, 1, time.Second, io.Discard)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		transport.Close()
+	})
+	return transport
+}
+
+func TestParseBootstrapPeers(t *testing.T) {
+
+	for _, c := range []struct {
+		list    []string
+		servers []raft.Server
+		valid   bool
+	}{
+		{nil, nil, true},
+		{[]string{"node1=10.0.0.1:7000", " node2 = 10.0.0.2:7000 "}, []raft.Server{
+			{Suffrage: raft.Voter, ID: "node1", Address: "10.0.0.1:7000"},
+			{Suffrage: raft.Voter, ID: "node2", Address: "10.0.0.2:7000"},
+		}, true},
+		{[]string{"node1"}, nil, false},
+		{[]string{"=10.0.0.1:7000"}, nil, false},
+		{[]string{"node1="}, nil, false},
+		{[]string{" =10.0.0.1:7000"}, nil, false},
+		{[]string{"node1= "}, nil, false},
+		{[]string{"node1=10.0.0.1"}, nil, false},
+		{[]string{"node1=:7000"}, nil, false},
+		{[]string{"node1=10.0.0.1:port"}, nil, false},
+		{[]string{"node1=10.0.0.1:70000"}, nil, false},
+		{[]string{"node1=[::1]:7000", "node2=raft2.local:7000"}, []raft.Server{
+			{Suffrage: raft.Voter, ID: "node1", Address: "[::1]:7000"},
+			{Suffrage: raft.Voter, ID: "node2", Address: "raft2.local:7000"},
+		}, true},
+		{[]string{"node1=10.0.0.1:7000", "node1=10.0.0.2:7000"}, nil, false},
+	} {
+		servers, err := parseBootstrapPeers(c.list)
+		if c.valid {
+			require.NoError(t, err, "%v", c.list)
+			require.Equal(t, c.servers, servers)
+		} else {
+			require.Error(t, err, "%v", c.list)
+		}
+	}
+
+}
+
+func TestBootstrapConfiguration(t *testing.T) {
+
+	transport := newTestTCPTransport(t)
+	local := raft.Server{Suffrage: raft.Voter, ID: "node1", Address: transport.LocalAddr()}
+	peer := raft.Server{Suffrage: raft.Voter, ID: "node2", Address: "10.0.0.2:7000"}
+
+	for _, c := range []struct {
+		peers   []string
+		expect  int
+		servers []raft.Server
+		valid   bool
+	}{
+		{nil, 0, []raft.Server{local}, true},
+		{[]string{"node2=10.0.0.2:7000"}, 2, []raft.Server{peer, local}, true},
+		{[]string{"node1=10.0.0.1:7000", "node2=10.0.0.2:7000"}, 0, []raft.Server{{Suffrage: raft.Voter, ID: "node1", Address: "10.0.0.1:7000"}, peer}, true},
+		{[]string{"node2=10.0.0.2:7000"}, 3, nil, false},
+		{[]string{"node2"}, 0, nil, false},
+	} {
+		server := &implRaftServer{
+			NodeService:     testNodeService{id: "node1"},
+			BootstrapPeers:  c.peers,
+			BootstrapExpect: c.expect,
+			transport:       transport,
+		}
+		configuration, err := server.bootstrapConfiguration()
+		if c.valid {
+			require.NoError(t, err, "%v", c.peers)
+			require.Equal(t, c.servers, configuration.Servers)
+		} else {
+			require.Error(t, err, "%v", c.peers)
+		}
+	}
+
+}
+
+func TestProbePeers(t *testing.T) {
+
+	transport := newTestTCPTransport(t)
+	server := &implRaftServer{
+		Timeout:   time.Second,
+		transport: transport,
+		stream:    testStreamLayer{reachable: map[raft.ServerAddress]bool{"10.0.0.2:7000": true}},
+	}
+	server.bootstrapConfig = raft.Configuration{Servers: []raft.Server{
+		{Suffrage: raft.Voter, ID: "node1", Address: transport.LocalAddr()},
+		{Suffrage: raft.Voter, ID: "node2", Address: "10.0.0.2:7000"},
+		{Suffrage: raft.Voter, ID: "node3", Address: "10.0.0.3:7000"},
+	}}
+	require.Equal(t, 2, server.probePeers())
+
+}
+
+func TestBootstrapExpect(t *testing.T) {
+
+	interval := bootstrapProbeInterval
+	bootstrapProbeInterval = 10 * time.Millisecond
+	defer func() {
+		bootstrapProbeInterval = interval
+	}()
+
+	transport := newTestTCPTransport(t)
+	server := newTestRaftServer(t, "node1", transport)
+	server.transport = transport
+	server.BootstrapExpect = 2
+	server.stream = testStreamLayer{reachable: map[raft.ServerAddress]bool{}}
+	server.bootstrapConfig = raft.Configuration{Servers: []raft.Server{
+		{Suffrage: raft.Voter, ID: "node1", Address: transport.LocalAddr()},
+		{Suffrage: raft.Voter, ID: "node2", Address: "10.0.0.2:7000"},
+	}}
+
+	// waits for the second peer
+	done := make(chan struct{})
+	go func() {
+		server.bootstrapExpect()
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-done:
+		require.FailNow(t, "bootstrap without expected peers")
+	default:
+	}
+	hasState, err := raft.HasExistingState(server.LogStore, server.StableStore, server.FileSnapshotStore)
+	require.NoError(t, err)
+	require.False(t, hasState)
+
+	// single node cluster bootstraps itself
+	server.running.Store(false)
+	<-done
+	server.running.Store(true)
+	server.BootstrapExpect = 1
+	server.bootstrapConfig.Servers = server.bootstrapConfig.Servers[:1]
+	server.bootstrapExpect()
+	waitTestLeader(t, []*implRaftServer{server})
+
+	// existing state skips bootstrap
+	server.bootstrapExpect()
+
+}
@@ -17,34 +17,45 @@ package raftmod
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"github.com/codeallergy/glue"
 	"github.com/codeallergy/raftapi"
 	"github.com/go-errors/errors"
 	"github.com/hashicorp/raft"
 	"go.uber.org/zap"
-	"fmt"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/status"
 	"io"
+	"net"
 	"strconv"
-	"strings"
 	"sync"
+	"time"
 )
 
 type implRaftClientPool struct {
 
 	Properties      glue.Properties     `inject`
 	Log            *zap.Logger       `inject`
+	TlsConfig      *tls.Config       `inject:"optional"`
+	CertificateReloader  CertificateReloader  `inject:"optional"`
 
 	RaftAddress      string          `value:"raft-server.listen-address,default="`
 	APIBean          string          `value:"raft-server.api-bean,default="`
 	RaftServiceName  string          `value:"raft-server.raft-service-name,default="`
+	Timeout          time.Duration   `value:"raft-server.timeout,default=10s"`
+	TLSMode          string          `value:"raft-server.tls-mode,default=mutual"`
+	TLSCAFile        string          `value:"raft-server.tls-ca-file,default="`
 
 	portDiff         int
 
+	// API server certificates are not verified in 'insecure' TLS mode
+	insecure         bool
+	// CA pool of the CA file or the TLS config when there is no reloader, nil means system roots
+	roots            *x509.CertPool
+
 	clients   sync.Map   // key - raft.ServerAddress, value - *clientConnection or *connectingClient
 
 	closeOnce sync.Once
@@ -70,6 +81,24 @@ func (t *implRaftClientPool) PostConstruct() error {
 		t.Log.Warn("property 'raft-server.raft-service-name' is empty, health check would be disabled")
 	}
 
+	mode, err := parseTLSMode(t.TLSMode)
+	if err != nil {
+		return errors.Errorf("invalid property 'raft-server.tls-mode', %v", err)
+	}
+	t.insecure = mode == TLSModeInsecure
+	if t.insecure {
+		t.Log.Warn("RaftClientPoolInsecure", zap.String("reason", "API server certificates are not verified in 'insecure' TLS mode"))
+	} else if t.CertificateReloader == nil {
+		config := t.TlsConfig
+		if config == nil {
+			config = &tls.Config{}
+		}
+		t.roots, err = loadRootCAs(t.TLSCAFile, config)
+		if err != nil {
+			return errors.Errorf("invalid property 'raft-server.tls-ca-file', %v", err)
+		}
+	}
+
 	if t.RaftAddress != "" && t.APIBean != "" {
 		raftPort, err := getPortNumber(t.RaftAddress)
 		if err != nil {
@@ -98,51 +127,64 @@ func (t *implRaftClientPool) GetAPIEndpoint(raftAddress string) (string, error)
 		return "", err
 	}
 
-	return fmt.Sprintf("%s:%d", raftHost, raftPort + t.portDiff), nil
+	return net.JoinHostPort(raftHost, strconv.Itoa(raftPort + t.portDiff)), nil
 }
 
+/**
+Dials within 'raft-server.timeout', use GetAPIConnContext to dial within the caller deadline.
+ */
 func (t *implRaftClientPool) GetAPIConn(raftAddress raft.ServerAddress) (*grpc.ClientConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.Timeout)
+	defer cancel()
+	return t.GetAPIConnContext(ctx, raftAddress)
+}
 
-	tryAgain:
+func (t *implRaftClientPool) GetAPIConnContext(ctx context.Context, raftAddress raft.ServerAddress) (*grpc.ClientConn, error) {
 
-	if val, ok := t.clients.Load(raftAddress); ok {
-		if client, ok := val.(*clientConnection); ok {
-			return client.conn, nil
-		}
-		if stub, ok := val.(*connectingClient); ok {
-			<- stub.waitCh
-			goto tryAgain
-		}
-	}
+	for {
 
-	// let's try to connect
-	stub := &connectingClient{ waitCh: make(chan struct{}) }
-	defer close(stub.waitCh)
+		stub := &connectingClient{ waitCh: make(chan struct{}) }
+
+		actual, loaded := t.clients.LoadOrStore(raftAddress, stub)
+		if !loaded {
+			return t.connect(ctx, raftAddress, stub)
+		}
 
-	actual, loaded := t.clients.LoadOrStore(raftAddress, stub)
-	if loaded {
 		if client, ok := actual.(*clientConnection); ok {
 			return client.conn, nil
 		}
+
 		if weAreNotAlone, ok := actual.(*connectingClient); ok {
-			<- weAreNotAlone.waitCh
-			goto tryAgain
+			// the owner of the stub replaces it by the connection or removes it on failure
+			select {
+			case <-weAreNotAlone.waitCh:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
 		}
-		// go forward
-		t.clients.Store(raftAddress, stub)
+
 	}
 
-	client, err := t.doConnect(raftAddress)
+}
+
+/**
+Runs by the owner of the stub only.
+ */
+func (t *implRaftClientPool) connect(ctx context.Context, raftAddress raft.ServerAddress, stub *connectingClient) (*grpc.ClientConn, error) {
+
+	defer close(stub.waitCh)
+
+	client, err := t.doConnect(ctx, raftAddress)
 	if err != nil {
+		t.clients.Delete(raftAddress)
 		return nil, err
 	}
 
 	t.clients.Store(raftAddress, client)
 	return client.conn, nil
-
 }
 
-func (t *implRaftClientPool) doConnect(raftAddress raft.ServerAddress) (*clientConnection, error) {
+func (t *implRaftClientPool) doConnect(ctx context.Context, raftAddress raft.ServerAddress) (*clientConnection, error) {
 	endpoint, err := t.GetAPIEndpoint(string(raftAddress))
 	if err != nil {
 		return nil, err
@@ -153,7 +195,18 @@ func (t *implRaftClientPool) doConnect(raftAddress raft.ServerAddress) (*clientC
 		NextProtos: []string {"h2"},
 	}
 
-	conn, err := grpc.Dial(endpoint,
+	if t.CertificateReloader != nil {
+		// callbacks read the current certificates on every handshake, including reconnects of this connection
+		tlsConfig.GetClientCertificate = t.CertificateReloader.GetClientCertificate
+	} else if t.TlsConfig != nil {
+		tlsConfig.Certificates = t.TlsConfig.Certificates
+		tlsConfig.GetClientCertificate = t.TlsConfig.GetClientCertificate
+	}
+	if !t.insecure {
+		tlsConfig.VerifyPeerCertificate = t.verifyServerCertificate
+	}
+
+	conn, err := grpc.DialContext(ctx, endpoint,
 		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
 		grpc.WithBlock())
 	if err != nil {
@@ -176,6 +229,19 @@ func (t *implRaftClientPool) doConnect(raftAddress raft.ServerAddress) (*clientC
 	return client, nil
 }
 
+/**
+Verifies API server certificate against CA pool of the reloader, the CA file or the TLS config,
+or the system roots if there is no CA. Hostname is not checked, because peers are dialed by IP addresses.
+ */
+func (t *implRaftClientPool) verifyServerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	roots := t.roots
+	if t.CertificateReloader != nil {
+		roots = t.CertificateReloader.RootCAs()
+	}
+	_, err := verifyCertificateChain(rawCerts, roots, x509.ExtKeyUsageServerAuth)
+	return err
+}
+
 func (t *implRaftClientPool) doHealthCheck(client *clientConnection) {
 
 	resp, err := client.serviceHC.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{
@@ -254,18 +320,21 @@ func (t *implRaftClientPool) Destroy() error {
 }
 
 func getPortNumber(addr string) (int, error) {
-	hostAndPort := strings.Split(addr, ":")
-	end := hostAndPort[len(hostAndPort)-1]
-	return strconv.Atoi(end)
+	_, port, err := getHostAndPortNumber(addr)
+	return port, err
 }
 
+/**
+Supports IPv4, bracketed IPv6 literals and host names, host is empty for ':port' addresses.
+ */
 func getHostAndPortNumber(addr string) (string, int, error) {
-	hostAndPort := strings.Split(addr, ":")
-	if len(hostAndPort) != 2 {
-		return "", 0, errors.Errorf("invalid address '%s'", addr)
+	host, sport, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, errors.Errorf("invalid address '%s', %v", addr, err)
 	}
-	sport := hostAndPort[len(hostAndPort)-1]
 	port, err := strconv.Atoi(sport)
-	return hostAndPort[0], port, err
+	if err != nil {
+		return "", 0, errors.Errorf("invalid port in address '%s', %v", addr, err)
+	}
+	return host, port, nil
 }
-
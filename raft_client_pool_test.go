@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientPoolDialDeadline(t *testing.T) {
+
+	// nothing listens on the port after close
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := raft.ServerAddress(listener.Addr().String())
+	listener.Close()
+
+	pool := &implRaftClientPool{Log: zap.NewNop(), Timeout: 100 * time.Millisecond}
+
+	for i := 0; i < 2; i++ {
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200 * time.Millisecond)
+		start := time.Now()
+		_, err = pool.GetAPIConnContext(ctx, address)
+		cancel()
+		require.Error(t, err)
+		require.True(t, time.Since(start) < 5 * time.Second)
+
+		// failed dial does not leave the stub behind
+		_, ok := pool.clients.Load(address)
+		require.False(t, ok)
+	}
+
+	_, err = pool.GetAPIConn(address)
+	require.Error(t, err)
+
+	// waiter gives up on its own deadline
+	stub := &connectingClient{waitCh: make(chan struct{})}
+	pool.clients.Store(address, stub)
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	_, err = pool.GetAPIConnContext(ctx, address)
+	require.Equal(t, context.DeadlineExceeded, err)
+
+}
+
+func TestClientPoolVerifyWithoutReloader(t *testing.T) {
+
+	ca := newTestCA(t)
+	other := newTestCA(t)
+
+	// CA pool of the static TLS config is used when there is no reloader
+	pool := &implRaftClientPool{Log: zap.NewNop(), TlsConfig: &tls.Config{RootCAs: ca.pool}, TLSMode: TLSModeMutual}
+	require.NoError(t, pool.PostConstruct())
+	require.False(t, pool.insecure)
+	require.NoError(t, pool.verifyServerCertificate(ca.issue(t, "node1", false).Certificate, nil))
+	require.Error(t, pool.verifyServerCertificate(other.issue(t, "node1", false).Certificate, nil))
+
+	// without any CA the server certificate is verified against the system roots
+	pool = &implRaftClientPool{Log: zap.NewNop(), TLSMode: TLSModeVerify}
+	require.NoError(t, pool.PostConstruct())
+	require.Nil(t, pool.roots)
+	require.Error(t, pool.verifyServerCertificate(ca.issue(t, "node1", false).Certificate, nil))
+
+	// insecure mode skips verification and warns about it
+	core, logs := observer.New(zapcore.WarnLevel)
+	pool = &implRaftClientPool{Log: zap.New(core), TLSMode: TLSModeInsecure}
+	require.NoError(t, pool.PostConstruct())
+	require.True(t, pool.insecure)
+	require.Equal(t, 1, logs.FilterMessage("RaftClientPoolInsecure").Len())
+
+	pool = &implRaftClientPool{Log: zap.NewNop(), TLSMode: "unknown"}
+	require.Error(t, pool.PostConstruct())
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"github.com/hashicorp/raft"
+	"strconv"
+)
+
+func (t *implRaftServer) newConfig() *raft.Config {
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(t.NodeService.NodeIdHex())
+	config.HeartbeatTimeout = t.HeartbeatTimeout
+	config.ElectionTimeout = t.ElectionTimeout
+	config.CommitTimeout = t.CommitTimeout
+	config.LeaderLeaseTimeout = t.LeaderLeaseTimeout
+	config.SnapshotInterval = t.SnapshotInterval
+	config.SnapshotThreshold = t.SnapshotThreshold
+	config.TrailingLogs = t.TrailingLogs
+	config.MaxAppendEntries = t.MaxAppendEntries
+	config.BatchApplyCh = t.BatchApplyCh
+	config.NoSnapshotRestoreOnStart = t.NoSnapshotRestoreOnStart
+	config.Logger = t.raftLog
+	// raft keeps the latest value if the channel is full, read by dispatchEvents
+	t.notifyCh = make(chan bool, 1)
+	config.NotifyCh = t.notifyCh
+	return config
+}
+
+/**
+Reports configuration values in effect, returns false if enumeration was stopped by callback.
+ */
+func configStats(config *raft.Config, cb func(name, value string) bool) bool {
+	return cb("config_heartbeat_timeout", config.HeartbeatTimeout.String()) &&
+		cb("config_election_timeout", config.ElectionTimeout.String()) &&
+		cb("config_commit_timeout", config.CommitTimeout.String()) &&
+		cb("config_leader_lease_timeout", config.LeaderLeaseTimeout.String()) &&
+		cb("config_snapshot_interval", config.SnapshotInterval.String()) &&
+		cb("config_snapshot_threshold", strconv.FormatUint(config.SnapshotThreshold, 10)) &&
+		cb("config_trailing_logs", strconv.FormatUint(config.TrailingLogs, 10)) &&
+		cb("config_max_append_entries", strconv.Itoa(config.MaxAppendEntries)) &&
+		cb("config_batch_apply_ch", strconv.FormatBool(config.BatchApplyCh)) &&
+		cb("config_no_snapshot_restore_on_start", strconv.FormatBool(config.NoSnapshotRestoreOnStart))
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestNewConfig(t *testing.T) {
+
+	server := &implRaftServer{
+		NodeService:              testNodeService{id: "a1b2c3"},
+		HeartbeatTimeout:         2 * time.Second,
+		ElectionTimeout:          3 * time.Second,
+		CommitTimeout:            20 * time.Millisecond,
+		LeaderLeaseTimeout:       time.Second,
+		SnapshotInterval:         time.Minute,
+		SnapshotThreshold:        1000,
+		TrailingLogs:             500,
+		MaxAppendEntries:         32,
+		BatchApplyCh:             true,
+		NoSnapshotRestoreOnStart: true,
+		raftLog:                  hclog.NewNullLogger(),
+	}
+
+	config := server.newConfig()
+	require.NoError(t, raft.ValidateConfig(config))
+
+	require.Equal(t, raft.ServerID("a1b2c3"), config.LocalID)
+	require.Equal(t, server.raftLog, config.Logger)
+	require.NotNil(t, server.notifyCh)
+	require.NotNil(t, config.NotifyCh)
+
+	stats := make(map[string]string)
+	require.True(t, configStats(config, func(name, value string) bool {
+		stats[name] = value
+		return true
+	}))
+	require.Equal(t, map[string]string{
+		"config_heartbeat_timeout":            "2s",
+		"config_election_timeout":             "3s",
+		"config_commit_timeout":               "20ms",
+		"config_leader_lease_timeout":         "1s",
+		"config_snapshot_interval":            "1m0s",
+		"config_snapshot_threshold":           "1000",
+		"config_trailing_logs":                "500",
+		"config_max_append_entries":           "32",
+		"config_batch_apply_ch":               "true",
+		"config_no_snapshot_restore_on_start": "true",
+	}, stats)
+
+	// enumeration stops on the first false
+	n := 0
+	require.False(t, configStats(config, func(name, value string) bool {
+		n++
+		return false
+	}))
+	require.Equal(t, 1, n)
+
+}
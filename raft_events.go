@@ -0,0 +1,200 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+	"sync"
+)
+
+var observationBufferSize = 64
+
+type eventListeners struct {
+	sync.RWMutex
+	nextHandle  int64
+	listeners   map[int64]RaftEventListener
+}
+
+/**
+Channel could be removed while fireEvent still holds the listener, so send and close are guarded by the same lock.
+ */
+type chanEventListener struct {
+	sync.Mutex
+	ch      chan RaftEvent
+	closed  bool
+}
+
+func (t *chanEventListener) OnRaftEvent(event RaftEvent) {
+	t.Lock()
+	defer t.Unlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.ch <- event:
+	default:
+	}
+}
+
+func (t *chanEventListener) close() {
+	t.Lock()
+	defer t.Unlock()
+	if !t.closed {
+		t.closed = true
+		close(t.ch)
+	}
+}
+
+func (t *implRaftServer) AddEventListener(listener RaftEventListener) int64 {
+	t.events.Lock()
+	defer t.events.Unlock()
+	if t.events.listeners == nil {
+		t.events.listeners = make(map[int64]RaftEventListener)
+	}
+	t.events.nextHandle++
+	handle := t.events.nextHandle
+	t.events.listeners[handle] = listener
+	return handle
+}
+
+func (t *implRaftServer) EventChannel(size int) (<-chan RaftEvent, int64) {
+	listener := &chanEventListener{ ch: make(chan RaftEvent, size) }
+	return listener.ch, t.AddEventListener(listener)
+}
+
+func (t *implRaftServer) RemoveEventListener(handle int64) {
+	t.events.Lock()
+	defer t.events.Unlock()
+	if listener, ok := t.events.listeners[handle]; ok {
+		delete(t.events.listeners, handle)
+		if c, ok := listener.(*chanEventListener); ok {
+			c.close()
+		}
+	}
+}
+
+/**
+Listeners are called without the lock, so they could add or remove listeners.
+ */
+func (t *implRaftServer) fireEvent(event RaftEvent) {
+	t.events.RLock()
+	listeners := make([]RaftEventListener, 0, len(t.events.listeners))
+	for _, listener := range t.events.listeners {
+		listeners = append(listeners, listener)
+	}
+	t.events.RUnlock()
+	for _, listener := range listeners {
+		t.notifyListener(listener, event)
+	}
+}
+
+func (t *implRaftServer) notifyListener(listener RaftEventListener, event RaftEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Log.Error("RaftEventListenerPanic", zap.Stringer("event", event.Type), zap.Any("recover", r))
+		}
+	}()
+	listener.OnRaftEvent(event)
+}
+
+/**
+Registers raft observer and starts dispatching of events.
+ */
+func (t *implRaftServer) startEvents() {
+
+	observations := make(chan raft.Observation, observationBufferSize)
+	observer := raft.NewObserver(observations, false, func(o *raft.Observation) bool {
+		_, skip := o.Data.(raft.RequestVoteRequest)
+		return !skip
+	})
+
+	t.raft.RegisterObserver(observer)
+	go t.dispatchEvents(observer, observations)
+}
+
+/**
+Converts raft observations and leadership notifications in to events until shutdown.
+Leadership is taken from Config.NotifyCh, so raft.LeaderCh stays available to the application.
+ */
+func (t *implRaftServer) dispatchEvents(observer *raft.Observer, observations <-chan raft.Observation) {
+
+	defer t.raft.DeregisterObserver(observer)
+
+	localID := t.config.LocalID
+	var localAddr raft.ServerAddress
+	if t.transport != nil {
+		localAddr = t.transport.LocalAddr()
+	}
+
+	for {
+		select {
+
+		case <-t.shutdownCh:
+			if dropped := observer.GetNumDropped(); dropped > 0 {
+				t.Log.Warn("RaftEventsDropped", zap.Uint64("dropped", dropped))
+			}
+			return
+
+		case isLeader := <-t.notifyCh:
+			event := RaftEvent{
+				Type:    LeaderLost,
+				State:   t.raft.State(),
+				NodeId:  localID,
+				Address: localAddr,
+			}
+			if isLeader {
+				event.Type = LeaderElected
+			} else {
+				t.leaderVerifiedAt.Store(0)
+			}
+			t.invalidatePeers()
+			t.fireEvent(event)
+
+		case o := <-observations:
+			if event, ok := toRaftEvent(o.Data, t.raft.State()); ok {
+				switch event.Type {
+				case PeerAdded, PeerRemoved, LeaderChanged:
+					// allowed peers of the authorization are taken from the configuration again
+					t.invalidatePeers()
+				}
+				t.fireEvent(event)
+			}
+
+		}
+	}
+
+}
+
+func toRaftEvent(data interface{}, state raft.RaftState) (RaftEvent, bool) {
+	switch v := data.(type) {
+	case raft.RaftState:
+		return RaftEvent{ Type: StateChanged, State: v }, true
+	case raft.LeaderObservation:
+		return RaftEvent{ Type: LeaderChanged, State: state, NodeId: v.LeaderID, Address: v.LeaderAddr }, true
+	case raft.PeerObservation:
+		event := RaftEvent{ Type: PeerAdded, State: state, NodeId: v.Peer.ID, Address: v.Peer.Address }
+		if v.Removed {
+			event.Type = PeerRemoved
+		}
+		return event, true
+	case raft.FailedHeartbeatObservation:
+		return RaftEvent{ Type: PeerHeartbeatFailed, State: state, NodeId: v.PeerID, LastContact: v.LastContact }, true
+	case raft.ResumedHeartbeatObservation:
+		return RaftEvent{ Type: PeerHeartbeatResumed, State: state, NodeId: v.PeerID }, true
+	default:
+		return RaftEvent{}, false
+	}
+}
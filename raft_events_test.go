@@ -0,0 +1,213 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+type funcEventListener func(event RaftEvent)
+
+func (t funcEventListener) OnRaftEvent(event RaftEvent) {
+	t(event)
+}
+
+func waitTestEvent(t *testing.T, ch <-chan RaftEvent, eventType RaftEventType) RaftEvent {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-ch:
+			if event.Type == eventType {
+				return event
+			}
+		case <-timeout:
+			require.FailNow(t, "no event", eventType.String())
+		}
+	}
+}
+
+func TestRaftEventsLeadership(t *testing.T) {
+
+	server := newTestRaftCluster(t, 1)[0]
+
+	ch, _ := server.EventChannel(64)
+
+	// listener that changes subscriptions from the callback
+	added := make(chan int64, 1)
+	var handle int64
+	handle = server.AddEventListener(funcEventListener(func(event RaftEvent) {
+		server.RemoveEventListener(handle)
+		added <- server.AddEventListener(funcEventListener(func(event RaftEvent) {}))
+	}))
+
+	server.startEvents()
+
+	event := waitTestEvent(t, ch, LeaderElected)
+	require.Equal(t, raft.ServerID("node1"), event.NodeId)
+	require.Equal(t, raft.Leader, event.State)
+
+	select {
+	case <-added:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "listener is not called")
+	}
+
+	// leadership channel of raft is left to the application
+	select {
+	case isLeader := <-server.raft.LeaderCh():
+		require.True(t, isLeader)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "raft leader channel is empty")
+	}
+
+}
+
+func TestToRaftEvent(t *testing.T) {
+
+	lastContact := time.Now()
+
+	for _, c := range []struct {
+		data  interface{}
+		event RaftEvent
+		ok    bool
+	}{
+		{raft.Candidate, RaftEvent{Type: StateChanged, State: raft.Candidate}, true},
+		{raft.LeaderObservation{LeaderID: "node2", LeaderAddr: "10.0.0.2:7000"}, RaftEvent{Type: LeaderChanged, State: raft.Follower, NodeId: "node2", Address: "10.0.0.2:7000"}, true},
+		{raft.PeerObservation{Peer: raft.Server{ID: "node3", Address: "10.0.0.3:7000"}}, RaftEvent{Type: PeerAdded, State: raft.Follower, NodeId: "node3", Address: "10.0.0.3:7000"}, true},
+		{raft.PeerObservation{Removed: true, Peer: raft.Server{ID: "node3", Address: "10.0.0.3:7000"}}, RaftEvent{Type: PeerRemoved, State: raft.Follower, NodeId: "node3", Address: "10.0.0.3:7000"}, true},
+		{raft.FailedHeartbeatObservation{PeerID: "node3", LastContact: lastContact}, RaftEvent{Type: PeerHeartbeatFailed, State: raft.Follower, NodeId: "node3", LastContact: lastContact}, true},
+		{raft.ResumedHeartbeatObservation{PeerID: "node3"}, RaftEvent{Type: PeerHeartbeatResumed, State: raft.Follower, NodeId: "node3"}, true},
+		{raft.RequestVoteRequest{}, RaftEvent{}, false},
+		{nil, RaftEvent{}, false},
+	} {
+		event, ok := toRaftEvent(c.data, raft.Follower)
+		require.Equal(t, c.ok, ok, "%T", c.data)
+		require.Equal(t, c.event, event, "%T", c.data)
+	}
+
+}
+
+func TestRaftEventsDispatch(t *testing.T) {
+
+	server := &implRaftServer{Log: zap.NewNop()}
+
+	var called []string
+	server.AddEventListener(funcEventListener(func(event RaftEvent) {
+		panic("listener failure")
+	}))
+	first := server.AddEventListener(funcEventListener(func(event RaftEvent) {
+		called = append(called, "first")
+	}))
+	server.AddEventListener(funcEventListener(func(event RaftEvent) {
+		called = append(called, "second")
+	}))
+	ch, handle := server.EventChannel(1)
+
+	// panic of one listener does not stop others
+	server.fireEvent(RaftEvent{Type: StateChanged, State: raft.Candidate})
+	require.ElementsMatch(t, []string{"first", "second"}, called)
+	require.Equal(t, RaftEvent{Type: StateChanged, State: raft.Candidate}, <-ch)
+
+	// full channel drops events instead of blocking
+	server.fireEvent(RaftEvent{Type: StateChanged, State: raft.Follower})
+	server.fireEvent(RaftEvent{Type: StateChanged, State: raft.Leader})
+	require.Equal(t, raft.Follower, (<-ch).State)
+
+	called = nil
+	server.RemoveEventListener(first)
+	server.RemoveEventListener(handle)
+	server.fireEvent(RaftEvent{Type: StateChanged, State: raft.Follower})
+	require.Equal(t, []string{"second"}, called)
+	_, ok := <-ch
+	require.False(t, ok)
+
+}
+
+func TestRaftEventsRemoveWhileFiring(t *testing.T) {
+
+	core, logs := observer.New(zapcore.ErrorLevel)
+	server := &implRaftServer{Log: zap.New(core)}
+
+	// listener taken by fireEvent before it was removed
+	ch, handle := server.EventChannel(1)
+	server.events.RLock()
+	listener := server.events.listeners[handle]
+	server.events.RUnlock()
+	server.RemoveEventListener(handle)
+	server.notifyListener(listener, RaftEvent{Type: StateChanged, State: raft.Follower})
+	_, ok := <-ch
+	require.False(t, ok)
+	require.Equal(t, 0, logs.Len(), "%v", logs.All())
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					server.fireEvent(RaftEvent{Type: StateChanged, State: raft.Follower})
+					runtime.Gosched()
+				}
+			}
+		}()
+	}
+
+	// channel is closed while events are sent to it
+	for i := 0; i < 200; i++ {
+		ch, handle := server.EventChannel(1)
+		<-ch
+		server.RemoveEventListener(handle)
+		for range ch {
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	require.Equal(t, 0, logs.Len(), "%v", logs.All())
+
+}
+
+func TestRaftEventsPeers(t *testing.T) {
+
+	servers := newTestRaftCluster(t, 3)
+	leader := waitTestLeader(t, servers)
+
+	ch, _ := leader.EventChannel(64)
+	leader.startEvents()
+
+	require.NoError(t, leader.Join("node4", "node4"))
+	event := waitTestEvent(t, ch, PeerAdded)
+	require.Equal(t, raft.ServerID("node4"), event.NodeId)
+	require.Equal(t, raft.ServerAddress("node4"), event.Address)
+	require.Equal(t, raft.Leader, event.State)
+
+	require.NoError(t, leader.RemovePeer("node4"))
+	event = waitTestEvent(t, ch, PeerRemoved)
+	require.Equal(t, raft.ServerID("node4"), event.NodeId)
+
+}
@@ -0,0 +1,282 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"context"
+	"fmt"
+	"github.com/codeallergy/raftapi"
+	"github.com/codeallergy/raftpb"
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+/**
+Built-in gRPC service that the leader exposes for the requests forwarded by followers.
+The bean must be placed in to the server context of gRPC server referred by 'raft-server.api-bean' property.
+ */
+
+type implRaftInternalService struct {
+
+	Log           *zap.Logger           `inject`
+	GrpcServer    *grpc.Server          `inject`
+	RaftServer    raftapi.RaftServer    `inject`
+	Membership    RaftMembership        `inject`
+	Reader        RaftReader            `inject`
+
+}
+
+func RaftInternalService() raftapi.RaftGrpcServer {
+	return &implRaftInternalService{}
+}
+
+func (t *implRaftInternalService) PostConstruct() error {
+	t.GrpcServer.RegisterService(&raftInternalServiceDesc, t)
+	return nil
+}
+
+func (t *implRaftInternalService) BeanName() string {
+	return "raft-internal-service"
+}
+
+func (t *implRaftInternalService) GetStats(cb func(name, value string) bool) error {
+	return nil
+}
+
+func (t *implRaftInternalService) Join(ctx context.Context, node *raftpb.RaftNode) (*emptypb.Empty, error) {
+	if err := t.checkLeader(); err != nil {
+		return nil, err
+	}
+	if err := t.Membership.Join(node.NodeId, node.NodeAddr); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (t *implRaftInternalService) Remove(ctx context.Context, node *raftpb.RaftNode) (*emptypb.Empty, error) {
+	if err := t.checkLeader(); err != nil {
+		return nil, err
+	}
+	if err := t.Membership.RemovePeer(node.NodeId); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (t *implRaftInternalService) Apply(ctx context.Context, cmd *raftpb.Command) (*anypb.Any, error) {
+	if err := t.checkLeader(); err != nil {
+		return nil, err
+	}
+	r, _ := t.RaftServer.Raft()
+	resp, err := applyLocal(ctx, r, cmd.Payload, defaultApplyTimeout)
+	if err != nil {
+		return nil, applyErrorStatus(err)
+	}
+	out, err := encodeApplyResponse(resp)
+	if err != nil {
+		// the command is applied, so the forwarded apply succeeds without the response
+		t.Log.Warn("RaftApplyResponseDropped", zap.String("type", fmt.Sprintf("%T", resp)), zap.Error(err))
+		return &anypb.Any{}, nil
+	}
+	return out, nil
+}
+
+func (t *implRaftInternalService) ReadIndex(ctx context.Context, _ *emptypb.Empty) (*wrapperspb.UInt64Value, error) {
+	if err := t.checkLeader(); err != nil {
+		return nil, err
+	}
+	index, err := t.Reader.ReadIndex(ctx)
+	if err != nil {
+		return nil, applyErrorStatus(err)
+	}
+	return wrapperspb.UInt64(index), nil
+}
+
+/**
+Do not forward requests second time, follower would retry on leader change.
+Rejections are FailedPrecondition, because nothing was applied and the request is safe to retry.
+ */
+func (t *implRaftInternalService) checkLeader() error {
+	r, ok := t.RaftServer.Raft()
+	if !ok || r == nil {
+		return status.Error(codes.FailedPrecondition, ErrRaftNotRunning.Error())
+	}
+	if r.State() != raft.Leader {
+		return status.Errorf(codes.FailedPrecondition, "node is not the leader, current leader is '%s'", r.Leader())
+	}
+	return nil
+}
+
+/**
+Service definition
+ */
+
+type raftInternalServer interface {
+	Join(context.Context, *raftpb.RaftNode) (*emptypb.Empty, error)
+	Remove(context.Context, *raftpb.RaftNode) (*emptypb.Empty, error)
+	Apply(context.Context, *raftpb.Command) (*anypb.Any, error)
+	ReadIndex(context.Context, *emptypb.Empty) (*wrapperspb.UInt64Value, error)
+}
+
+var raftInternalServiceDesc = grpc.ServiceDesc{
+	ServiceName: "raftmod.RaftInternalService",
+	HandlerType: (*raftInternalServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Join",
+			Handler:    raftInternalJoinHandler,
+		},
+		{
+			MethodName: "Remove",
+			Handler:    raftInternalRemoveHandler,
+		},
+		{
+			MethodName: "Apply",
+			Handler:    raftInternalApplyHandler,
+		},
+		{
+			MethodName: "ReadIndex",
+			Handler:    raftInternalReadIndexHandler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "raftmod",
+}
+
+func raftInternalJoinHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(raftpb.RaftNode)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(raftInternalServer).Join(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/raftmod.RaftInternalService/Join",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(raftInternalServer).Join(ctx, req.(*raftpb.RaftNode))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func raftInternalRemoveHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(raftpb.RaftNode)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(raftInternalServer).Remove(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/raftmod.RaftInternalService/Remove",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(raftInternalServer).Remove(ctx, req.(*raftpb.RaftNode))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func raftInternalApplyHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(raftpb.Command)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(raftInternalServer).Apply(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/raftmod.RaftInternalService/Apply",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(raftInternalServer).Apply(ctx, req.(*raftpb.Command))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func raftInternalReadIndexHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(raftInternalServer).ReadIndex(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/raftmod.RaftInternalService/ReadIndex",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(raftInternalServer).ReadIndex(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+/**
+Client
+ */
+
+type raftInternalClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func newRaftInternalClient(cc grpc.ClientConnInterface) raftInternalClient {
+	return raftInternalClient{cc}
+}
+
+func (c raftInternalClient) Join(ctx context.Context, in *raftpb.RaftNode, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/raftmod.RaftInternalService/Join", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c raftInternalClient) Remove(ctx context.Context, in *raftpb.RaftNode, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/raftmod.RaftInternalService/Remove", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c raftInternalClient) Apply(ctx context.Context, in *raftpb.Command, opts ...grpc.CallOption) (*anypb.Any, error) {
+	out := new(anypb.Any)
+	err := c.cc.Invoke(ctx, "/raftmod.RaftInternalService/Apply", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c raftInternalClient) ReadIndex(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*wrapperspb.UInt64Value, error) {
+	out := new(wrapperspb.UInt64Value)
+	err := c.cc.Invoke(ctx, "/raftmod.RaftInternalService/ReadIndex", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
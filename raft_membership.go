@@ -0,0 +1,154 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"context"
+	"github.com/codeallergy/raftpb"
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+var (
+	ErrRaftNotRunning = errors.New("raft server is not running")
+	ErrNoLeader       = errors.New("raft leader is unknown")
+
+	// the request was not sent, so it is safe to retry
+	ErrLeaderUnreachable = errors.New("raft leader is unreachable")
+)
+
+func (t *implRaftServer) Join(nodeId, address string) error {
+
+	if nodeId == "" || address == "" {
+		return errors.Errorf("empty node id '%s' or address '%s'", nodeId, address)
+	}
+
+	r, ok := t.Raft()
+	if !ok || r == nil {
+		return ErrRaftNotRunning
+	}
+
+	if r.State() == raft.Leader {
+		return t.addVoter(raft.ServerID(nodeId), raft.ServerAddress(address))
+	}
+
+	return t.forwardToLeader(func(ctx context.Context, client raftInternalClient) error {
+		_, err := client.Join(ctx, &raftpb.RaftNode{NodeId: nodeId, NodeAddr: address})
+		return err
+	})
+}
+
+func (t *implRaftServer) Leave() error {
+	return t.RemovePeer(t.NodeService.NodeIdHex())
+}
+
+func (t *implRaftServer) RemovePeer(nodeId string) error {
+
+	if nodeId == "" {
+		return errors.New("empty node id")
+	}
+
+	r, ok := t.Raft()
+	if !ok || r == nil {
+		return ErrRaftNotRunning
+	}
+
+	if r.State() == raft.Leader {
+		return t.removeServer(raft.ServerID(nodeId))
+	}
+
+	return t.forwardToLeader(func(ctx context.Context, client raftInternalClient) error {
+		_, err := client.Remove(ctx, &raftpb.RaftNode{NodeId: nodeId})
+		return err
+	})
+}
+
+/**
+Runs on the leader only.
+ */
+func (t *implRaftServer) addVoter(id raft.ServerID, address raft.ServerAddress) error {
+
+	future := t.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return errors.Errorf("raft get configuration error, %v", err)
+	}
+
+	for _, server := range future.Configuration().Servers {
+		if server.ID == id || server.Address == address {
+			if server.ID == id && server.Address == address {
+				t.Log.Info("RaftJoinIgnored", zap.String("nodeId", string(id)), zap.String("address", string(address)), zap.String("reason", "already member"))
+				return nil
+			}
+			if err := t.raft.RemoveServer(server.ID, 0, t.Timeout).Error(); err != nil {
+				return errors.Errorf("error removing existing node '%s' at '%s', %v", server.ID, server.Address, err)
+			}
+		}
+	}
+
+	if err := t.raft.AddVoter(id, address, 0, t.Timeout).Error(); err != nil {
+		return errors.Errorf("error adding voter '%s' at '%s', %v", id, address, err)
+	}
+
+	t.Log.Info("RaftJoin", zap.String("nodeId", string(id)), zap.String("address", string(address)))
+	return nil
+}
+
+/**
+Runs on the leader only.
+ */
+func (t *implRaftServer) removeServer(id raft.ServerID) error {
+
+	if err := t.raft.RemoveServer(id, 0, t.Timeout).Error(); err != nil {
+		return errors.Errorf("error removing node '%s', %v", id, err)
+	}
+
+	t.Log.Info("RaftRemove", zap.String("nodeId", string(id)))
+	return nil
+}
+
+func (t *implRaftServer) forwardToLeader(fn func(context.Context, raftInternalClient) error) error {
+
+	leader := t.raft.Leader()
+	if leader == "" {
+		return ErrNoLeader
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.Timeout)
+	defer cancel()
+
+	conn, err := t.leaderConn(ctx, leader)
+	if err != nil {
+		return err
+	}
+
+	return fn(ctx, newRaftInternalClient(conn))
+}
+
+/**
+Dials the leader within the context if the client pool supports it.
+ */
+func (t *implRaftServer) leaderConn(ctx context.Context, leader raft.ServerAddress) (conn *grpc.ClientConn, err error) {
+	if pool, ok := t.RaftClientPool.(ContextClientPool); ok {
+		conn, err = pool.GetAPIConnContext(ctx, leader)
+	} else {
+		conn, err = t.RaftClientPool.GetAPIConn(leader)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(ErrLeaderUnreachable, "leader '%s' connection error, %v", leader, err)
+	}
+	return conn, nil
+}
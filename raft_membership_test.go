@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"errors"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func testConfiguration(t *testing.T, server *implRaftServer) map[raft.ServerID]raft.ServerAddress {
+	future := server.raft.GetConfiguration()
+	require.NoError(t, future.Error())
+	servers := make(map[raft.ServerID]raft.ServerAddress)
+	for _, s := range future.Configuration().Servers {
+		servers[s.ID] = s.Address
+	}
+	return servers
+}
+
+func TestMembership(t *testing.T) {
+
+	servers := newTestRaftCluster(t, 3)
+	serveTestInternalService(t, servers)
+	leader := waitTestLeader(t, servers)
+	follower := testFollower(servers)
+	require.NotNil(t, follower)
+
+	require.Error(t, follower.Join("", "node4"))
+	require.Error(t, follower.Join("node4", ""))
+	require.Error(t, follower.RemovePeer(""))
+
+	for _, c := range []struct {
+		name    string
+		server  *implRaftServer
+		join    bool
+		id      string
+		address string
+		servers int
+	}{
+		{"forwarded join", follower, true, "node4", "node4", 4},
+		{"join of the member", follower, true, "node4", "node4", 4},
+		{"join with new address", leader, true, "node4", "node4b", 4},
+		{"forwarded remove", follower, false, "node4", "", 3},
+		{"join on the leader", leader, true, "node5", "node5", 4},
+		{"remove on the leader", leader, false, "node5", "", 3},
+	} {
+		var err error
+		if c.join {
+			err = c.server.Join(c.id, c.address)
+		} else {
+			err = c.server.RemovePeer(c.id)
+		}
+		require.NoError(t, err, c.name)
+
+		configuration := testConfiguration(t, leader)
+		require.Equal(t, c.servers, len(configuration), c.name)
+		address, ok := configuration[raft.ServerID(c.id)]
+		require.Equal(t, c.join, ok, c.name)
+		if c.join {
+			require.Equal(t, raft.ServerAddress(c.address), address, c.name)
+		}
+	}
+
+	// leader connection is checked before the request is sent
+	follower.RaftClientPool = &testClientPool{}
+	err := follower.Join("node4", "node4")
+	require.True(t, errors.Is(err, ErrLeaderUnreachable), "%v", err)
+
+	follower.running.Store(false)
+	require.Equal(t, ErrRaftNotRunning, follower.RemovePeer("node4"))
+	follower.running.Store(true)
+
+}
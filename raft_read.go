@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"context"
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"time"
+)
+
+const (
+	ReadModeLinearizable = "linearizable"
+	ReadModeLease        = "lease"
+)
+
+var appliedIndexPollInterval = 5 * time.Millisecond
+
+func (t *implRaftServer) ConsistentRead(ctx context.Context, fn func() error) error {
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.Timeout)
+		defer cancel()
+	}
+
+	r, ok := t.Raft()
+	if !ok || r == nil {
+		return ErrRaftNotRunning
+	}
+
+	var index uint64
+	var err error
+
+	if r.State() == raft.Leader {
+		index, err = t.readIndex(ctx, r)
+	} else if t.FollowerRead {
+		index, err = t.forwardReadIndex(ctx, r)
+	} else {
+		return raft.ErrNotLeader
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := waitAppliedIndex(ctx, r, index); err != nil {
+		return err
+	}
+
+	return fn()
+}
+
+func (t *implRaftServer) ReadIndex(ctx context.Context) (uint64, error) {
+	r, ok := t.Raft()
+	if !ok || r == nil {
+		return 0, ErrRaftNotRunning
+	}
+	if r.State() != raft.Leader {
+		return 0, raft.ErrNotLeader
+	}
+	return t.readIndex(ctx, r)
+}
+
+/**
+Runs on the leader only, returns the index that must be applied to the FSM before read.
+ */
+func (t *implRaftServer) readIndex(ctx context.Context, r *raft.Raft) (uint64, error) {
+
+	if t.ReadMode == ReadModeLease {
+		verified := t.leaderVerifiedAt.Load()
+		if verified != 0 && time.Since(time.Unix(0, verified)) < t.config.LeaderLeaseTimeout {
+			return r.LastIndex(), nil
+		}
+	}
+
+	start := time.Now()
+	if err := r.VerifyLeader().Error(); err != nil {
+		return 0, err
+	}
+	t.leaderVerifiedAt.Store(start.UnixNano())
+
+	timeout := t.Timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+
+	if err := r.Barrier(timeout).Error(); err != nil {
+		return 0, err
+	}
+
+	return r.AppliedIndex(), nil
+}
+
+func (t *implRaftServer) forwardReadIndex(ctx context.Context, r *raft.Raft) (uint64, error) {
+
+	leader := r.Leader()
+	if leader == "" {
+		return 0, ErrNoLeader
+	}
+
+	conn, err := t.leaderConn(ctx, leader)
+	if err != nil {
+		return 0, err
+	}
+
+	out, err := newRaftInternalClient(conn).ReadIndex(ctx, &emptypb.Empty{})
+	if err != nil {
+		return 0, err
+	}
+
+	return out.Value, nil
+}
+
+func waitAppliedIndex(ctx context.Context, r *raft.Raft, index uint64) error {
+
+	if r.AppliedIndex() >= index {
+		return nil
+	}
+
+	ticker := time.NewTicker(appliedIndexPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return errors.Errorf("waiting for applied index %d, current %d, %v", index, r.AppliedIndex(), ctx.Err())
+		case <-ticker.C:
+			if r.AppliedIndex() >= index {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"context"
+	"errors"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestConsistentRead(t *testing.T) {
+
+	servers := newTestRaftCluster(t, 3)
+	serveTestInternalService(t, servers)
+	leader := waitTestLeader(t, servers)
+	follower := testFollower(servers)
+	require.NotNil(t, follower)
+
+	_, err := leader.Apply(context.Background(), []byte("write"))
+	require.NoError(t, err)
+
+	readErr := errors.New("read error")
+
+	for _, c := range []struct {
+		name         string
+		server       *implRaftServer
+		followerRead bool
+		fn           func() error
+		err          error
+	}{
+		{"leader", leader, false, nil, nil},
+		{"leader read error", leader, false, func() error { return readErr }, readErr},
+		{"follower", follower, false, nil, raft.ErrNotLeader},
+		{"follower read", follower, true, nil, nil},
+	} {
+		c.server.FollowerRead = c.followerRead
+		called := false
+		err := c.server.ConsistentRead(context.Background(), func() error {
+			called = true
+			// the write is applied before the read on every node
+			require.Equal(t, 1, c.server.FSM.(*testFSM).count(), c.name)
+			if c.fn != nil {
+				return c.fn()
+			}
+			return nil
+		})
+		require.Equal(t, c.err, err, c.name)
+		require.Equal(t, c.err != raft.ErrNotLeader, called, c.name)
+	}
+
+	follower.running.Store(false)
+	require.Equal(t, ErrRaftNotRunning, follower.ConsistentRead(context.Background(), func() error { return nil }))
+	follower.running.Store(true)
+
+}
+
+func TestReadIndex(t *testing.T) {
+
+	servers := newTestRaftCluster(t, 3)
+	leader := waitTestLeader(t, servers)
+	follower := testFollower(servers)
+
+	_, err := follower.ReadIndex(context.Background())
+	require.Equal(t, raft.ErrNotLeader, err)
+
+	// linearizable mode verifies leadership and waits the barrier on every read
+	future := leader.raft.Apply([]byte("write"), time.Second)
+	require.NoError(t, future.Error())
+
+	index, err := leader.ReadIndex(context.Background())
+	require.NoError(t, err)
+	require.True(t, index > future.Index())
+	verified := leader.leaderVerifiedAt.Load()
+	require.NotZero(t, verified)
+
+	index, err = leader.ReadIndex(context.Background())
+	require.NoError(t, err)
+	require.True(t, leader.leaderVerifiedAt.Load() > verified)
+
+	// lease mode skips verification within the lease
+	leader.ReadMode = ReadModeLease
+	leader.config.LeaderLeaseTimeout = time.Minute
+	verified = leader.leaderVerifiedAt.Load()
+
+	leaseIndex, err := leader.ReadIndex(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, leader.raft.LastIndex(), leaseIndex)
+	require.True(t, leaseIndex >= index)
+	require.Equal(t, verified, leader.leaderVerifiedAt.Load())
+
+	// expired lease is verified again
+	leader.config.LeaderLeaseTimeout = time.Nanosecond
+	_, err = leader.ReadIndex(context.Background())
+	require.NoError(t, err)
+	require.True(t, leader.leaderVerifiedAt.Load() > verified)
+
+}
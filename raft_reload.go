@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"strconv"
+	"time"
+)
+
+/**
+Periodically checks 'raft-server.*' properties that raft.ReloadConfig supports and applies the changed ones.
+ */
+func (t *implRaftServer) watchConfig() {
+
+	ticker := time.NewTicker(t.ReloadInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !t.running.Load() {
+			return
+		}
+		if err := t.ReloadConfig(); err != nil {
+			t.Log.Error("RaftReloadConfig", zap.Error(err))
+		}
+	}
+
+}
+
+/**
+Reads reloadable properties and applies them to the running raft instance.
+Invalid combinations are rejected and the current configuration stays in effect.
+ */
+func (t *implRaftServer) ReloadConfig() error {
+
+	r, ok := t.Raft()
+	if !ok || r == nil {
+		return ErrRaftNotRunning
+	}
+
+	current := r.ReloadableConfig()
+	next, err := t.readReloadableConfig(current)
+	if err != nil {
+		return err
+	}
+
+	if next == current {
+		return nil
+	}
+
+	check := *t.config
+	applyReloadableConfig(&check, next)
+	if err := raft.ValidateConfig(&check); err != nil {
+		return errors.Errorf("rejected 'raft-server.*' configuration, %v", err)
+	}
+
+	if err := r.ReloadConfig(next); err != nil {
+		return errors.Errorf("raft reload configuration error, %v", err)
+	}
+
+	t.logConfigChange("raft-server.trailing-logs", strconv.FormatUint(current.TrailingLogs, 10), strconv.FormatUint(next.TrailingLogs, 10))
+	t.logConfigChange("raft-server.snapshot-interval", current.SnapshotInterval.String(), next.SnapshotInterval.String())
+	t.logConfigChange("raft-server.snapshot-threshold", strconv.FormatUint(current.SnapshotThreshold, 10), strconv.FormatUint(next.SnapshotThreshold, 10))
+	t.logConfigChange("raft-server.heartbeat-timeout", current.HeartbeatTimeout.String(), next.HeartbeatTimeout.String())
+	t.logConfigChange("raft-server.election-timeout", current.ElectionTimeout.String(), next.ElectionTimeout.String())
+	return nil
+}
+
+func applyReloadableConfig(config *raft.Config, rc raft.ReloadableConfig) {
+	config.TrailingLogs = rc.TrailingLogs
+	config.SnapshotInterval = rc.SnapshotInterval
+	config.SnapshotThreshold = rc.SnapshotThreshold
+	config.HeartbeatTimeout = rc.HeartbeatTimeout
+	config.ElectionTimeout = rc.ElectionTimeout
+}
+
+func (t *implRaftServer) readReloadableConfig(current raft.ReloadableConfig) (rc raft.ReloadableConfig, err error) {
+
+	rc = current
+
+	if rc.TrailingLogs, err = t.getUint64Property("raft-server.trailing-logs", current.TrailingLogs); err != nil {
+		return
+	}
+	if rc.SnapshotInterval, err = t.getDurationProperty("raft-server.snapshot-interval", current.SnapshotInterval); err != nil {
+		return
+	}
+	if rc.SnapshotThreshold, err = t.getUint64Property("raft-server.snapshot-threshold", current.SnapshotThreshold); err != nil {
+		return
+	}
+	if rc.HeartbeatTimeout, err = t.getDurationProperty("raft-server.heartbeat-timeout", current.HeartbeatTimeout); err != nil {
+		return
+	}
+	if rc.ElectionTimeout, err = t.getDurationProperty("raft-server.election-timeout", current.ElectionTimeout); err != nil {
+		return
+	}
+
+	return rc, nil
+}
+
+func (t *implRaftServer) getUint64Property(key string, def uint64) (uint64, error) {
+	value, ok := t.Properties.Get(key)
+	if !ok || value == "" {
+		return def, nil
+	}
+	v, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return def, errors.Errorf("invalid property '%s' value '%s', %v", key, value, err)
+	}
+	return v, nil
+}
+
+func (t *implRaftServer) getDurationProperty(key string, def time.Duration) (time.Duration, error) {
+	value, ok := t.Properties.Get(key)
+	if !ok || value == "" {
+		return def, nil
+	}
+	v, err := time.ParseDuration(value)
+	if err != nil {
+		return def, errors.Errorf("invalid property '%s' value '%s', %v", key, value, err)
+	}
+	return v, nil
+}
+
+func (t *implRaftServer) logConfigChange(key, old, new string) {
+	if old != new {
+		t.Log.Info("RaftReloadConfig", zap.String("prop", key), zap.String("old", old), zap.String("new", new))
+	}
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"github.com/codeallergy/glue"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestReloadConfig(t *testing.T) {
+
+	_, transport := raft.NewInmemTransport("node1")
+	server := newTestRaftServer(t, "node1", transport)
+	server.Properties = glue.NewProperties()
+
+	initial := server.raft.ReloadableConfig()
+
+	for _, c := range []struct {
+		key   string
+		value string
+		valid bool
+		check func(rc raft.ReloadableConfig) bool
+	}{
+		{"", "", true, func(rc raft.ReloadableConfig) bool { return rc == initial }},
+		{"raft-server.trailing-logs", "100", true, func(rc raft.ReloadableConfig) bool { return rc.TrailingLogs == 100 }},
+		{"raft-server.snapshot-threshold", "200", true, func(rc raft.ReloadableConfig) bool { return rc.SnapshotThreshold == 200 }},
+		{"raft-server.snapshot-interval", "5m", true, func(rc raft.ReloadableConfig) bool { return rc.SnapshotInterval == 5*time.Minute }},
+		{"raft-server.election-timeout", "200ms", true, func(rc raft.ReloadableConfig) bool { return rc.ElectionTimeout == 200*time.Millisecond }},
+		{"raft-server.heartbeat-timeout", "100ms", true, func(rc raft.ReloadableConfig) bool { return rc.HeartbeatTimeout == 100*time.Millisecond }},
+		// leader lease is 50ms in the test server
+		{"raft-server.heartbeat-timeout", "40ms", false, func(rc raft.ReloadableConfig) bool { return rc.HeartbeatTimeout == 100*time.Millisecond }},
+		{"raft-server.trailing-logs", "many", false, func(rc raft.ReloadableConfig) bool { return rc.TrailingLogs == 100 }},
+		{"raft-server.snapshot-interval", "5", false, func(rc raft.ReloadableConfig) bool { return rc.SnapshotInterval == 5*time.Minute }},
+	} {
+		if c.key != "" {
+			server.Properties.Set(c.key, c.value)
+		}
+		err := server.ReloadConfig()
+		if c.valid {
+			require.NoError(t, err, "%s=%s", c.key, c.value)
+		} else {
+			require.Error(t, err, "%s=%s", c.key, c.value)
+			// rejected value does not block other reloads
+			server.Properties.Set(c.key, "")
+		}
+		require.True(t, c.check(server.raft.ReloadableConfig()), "%s=%s", c.key, c.value)
+	}
+
+	server.running.Store(false)
+	require.Equal(t, ErrRaftNotRunning, server.ReloadConfig())
+	server.running.Store(true)
+
+}
@@ -19,13 +19,15 @@ import (
 	"github.com/codeallergy/glue"
 	"github.com/codeallergy/sprint"
 	"github.com/codeallergy/raftapi"
+	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/raft"
 	"github.com/pkg/errors"
 	"go.uber.org/atomic"
 	"go.uber.org/zap"
 	"net"
-	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -34,7 +36,9 @@ type implRaftServer struct {
 	Properties      glue.Properties     `inject`
 	Log             *zap.Logger         `inject`
 	TlsConfig       *tls.Config         `inject:"optional"`
+	CertificateReloader  CertificateReloader  `inject:"optional"`
 	NodeService     sprint.NodeService  `inject`
+	RaftClientPool  raftapi.RaftClientPool  `inject`
 
 	LogStore           raft.LogStore       `inject`
 	StableStore        raft.StableStore    `inject`
@@ -43,16 +47,69 @@ type implRaftServer struct {
 	// should be defined by application
 	FSM      raft.FSM   `inject`
 
+	EventListeners  []RaftEventListener  `inject:"optional"`
+
 	RaftAddress  string          `value:"raft-server.listen-address,default="`
+	AdvertiseAddress  string    `value:"raft-server.advertise-address,default="`
+	LocalIPCIDRs    []string     `value:"raft-server.local-ip-cidrs,default="`
 	MaxPool      int             `value:"raft-server.max-pool,default=3"`
 	Timeout      time.Duration   `value:"raft-server.timeout,default=10s"`
+	TLSMode      string          `value:"raft-server.tls-mode,default=mutual"`
+	TLSCAFile    string          `value:"raft-server.tls-ca-file,default="`
+	AuthorizePeers  bool         `value:"raft-server.authorize-peers,default=true"`
+	AllowedPeers    []string     `value:"raft-server.allowed-peers,default="`
+	ClusterSecret   string       `value:"raft-server.cluster-secret,default="`
+
+	Bootstrap        bool        `value:"raft-server.bootstrap,default=false"`
+	BootstrapPeers   []string    `value:"raft-server.bootstrap-peers,default="`
+	BootstrapExpect  int         `value:"raft-server.bootstrap-expect,default=0"`
+
+	HeartbeatTimeout          time.Duration  `value:"raft-server.heartbeat-timeout,default=1s"`
+	ElectionTimeout           time.Duration  `value:"raft-server.election-timeout,default=1s"`
+	CommitTimeout             time.Duration  `value:"raft-server.commit-timeout,default=50ms"`
+	LeaderLeaseTimeout        time.Duration  `value:"raft-server.leader-lease-timeout,default=500ms"`
+	SnapshotInterval          time.Duration  `value:"raft-server.snapshot-interval,default=120s"`
+	SnapshotThreshold         uint64         `value:"raft-server.snapshot-threshold,default=8192"`
+	TrailingLogs              uint64         `value:"raft-server.trailing-logs,default=10240"`
+	MaxAppendEntries          int            `value:"raft-server.max-append-entries,default=64"`
+	BatchApplyCh              bool           `value:"raft-server.batch-apply-ch,default=false"`
+	NoSnapshotRestoreOnStart  bool           `value:"raft-server.no-snapshot-restore-on-start,default=false"`
+	SnapshotSchedule          string         `value:"raft-server.snapshot-schedule,default="`
+	SnapshotLogSize           string         `value:"raft-server.snapshot-log-size,default="`
+	ReloadInterval            time.Duration  `value:"raft-server.reload-interval,default=30s"`
+	LogLevel                  string         `value:"raft-server.log-level,default=INFO"`
+
+	ReadMode                  string         `value:"raft-server.read-mode,default=linearizable"`
+	FollowerRead              bool           `value:"raft-server.follower-read,default=false"`
+	leaderVerifiedAt          atomic.Int64
+
+	snapshotSchedule  *snapshotSchedule
+	snapshotLogSize   int64
+	logBytes          atomic.Int64
+	logBytesIndex     atomic.Uint64
+
+	raftLog   hclog.Logger
+
+	config    *raft.Config
+	notifyCh  chan bool
 
 	listener  net.Listener
+	stream    raft.StreamLayer
 	transport *raft.NetworkTransport
 
+	bootstrapConfig  raft.Configuration
+
+	// version of the peers and allowed node IDs of the peer authorization
+	peersVer       atomic.Uint64
+	peerAllowlist  atomic.Value
+
 	raft      *raft.Raft
 
-	running   atomic.Bool
+	events    eventListeners
+
+	running       atomic.Bool
+	shutdownCh    chan struct{}
+	shutdownOnce  sync.Once
 
 }
 
@@ -61,6 +118,10 @@ func RaftServer() raftapi.RaftServer {
 }
 
 func (t *implRaftServer) PostConstruct() error {
+	t.shutdownCh = make(chan struct{})
+	for _, listener := range t.EventListeners {
+		t.AddEventListener(listener)
+	}
 	return nil
 }
 
@@ -69,6 +130,15 @@ func (t *implRaftServer) BeanName() string {
 }
 
 func (t *implRaftServer) GetStats(cb func(name, value string) bool) error {
+	if t.config != nil {
+		config := *t.config
+		if t.raft != nil {
+			applyReloadableConfig(&config, t.raft.ReloadableConfig())
+		}
+		if !configStats(&config, cb) {
+			return nil
+		}
+	}
 	if t.raft != nil {
 		for k, v := range t.raft.Stats() {
 			cb(k, v)
@@ -84,13 +154,33 @@ func (t *implRaftServer) Bind() (err error) {
 		return nil
 	}
 
-	parts := strings.Split(t.RaftAddress, ":")
-	if parts[0] == "" {
-		ipAddr, err := LocalIP()
-		if err == nil {
-			parts[0] = ipAddr.String()
-			t.RaftAddress = strings.Join(parts, ":")
-		}
+	if _, err := ParseLogLevel(t.LogLevel); err != nil {
+		return errors.Errorf("invalid property 'raft-server.log-level', %v", err)
+	}
+	t.raftLog = NewZapLogger(t.Log, "raft", t.LogLevel)
+
+	t.config = t.newConfig()
+	if err := raft.ValidateConfig(t.config); err != nil {
+		return errors.Errorf("invalid 'raft-server.*' configuration, %v", err)
+	}
+
+	if t.ReadMode != ReadModeLinearizable && t.ReadMode != ReadModeLease {
+		return errors.Errorf("invalid property 'raft-server.read-mode' value '%s', expected '%s' or '%s'", t.ReadMode, ReadModeLinearizable, ReadModeLease)
+	}
+
+	t.snapshotSchedule, err = parseSnapshotSchedule(t.SnapshotSchedule)
+	if err != nil {
+		return errors.Errorf("invalid property 'raft-server.snapshot-schedule', %v", err)
+	}
+
+	t.snapshotLogSize, err = parseByteSize(t.SnapshotLogSize)
+	if err != nil {
+		return errors.Errorf("invalid property 'raft-server.snapshot-log-size', %v", err)
+	}
+
+	t.RaftAddress, err = t.listenAddress()
+	if err != nil {
+		return err
 	}
 
 	t.listener, err = net.Listen("tcp", t.RaftAddress)
@@ -98,21 +188,169 @@ func (t *implRaftServer) Bind() (err error) {
 		return errors.Errorf("bind failed on '%s', %v", t.RaftAddress, err)
 	}
 
-	advertise, err := net.ResolveTCPAddr("tcp", t.listener.Addr().String())
+	advertise, err := t.advertiseAddress()
 	if err != nil {
-		return errors.Errorf("tcp address resolve '%s', %v", t.listener.Addr().String(), err)
+		return err
 	}
 
-	t.transport, err = newTCPTransport(t.listener, advertise, t.TlsConfig, func(stream raft.StreamLayer) *raft.NetworkTransport {
-		return raft.NewNetworkTransport(stream, t.MaxPool, t.Timeout, os.Stderr)
+	var tlsOpt *streamTLS
+	if t.TlsConfig != nil || t.CertificateReloader != nil {
+		tlsOpt, err = t.newStreamTLS()
+		if err != nil {
+			return err
+		}
+	}
+
+	var handshakeOpt *streamHandshake
+	if t.ClusterSecret != "" {
+		handshakeOpt = &streamHandshake{secret: []byte(t.ClusterSecret), log: t.Log}
+	} else if tlsOpt == nil {
+		t.Log.Warn("RaftTransportUnauthenticated", zap.String("reason", "no TLS config and empty 'raft-server.cluster-secret'"))
+	}
+
+	t.transport, err = newTCPTransport(t.listener, advertise, tlsOpt, handshakeOpt, func(stream raft.StreamLayer) *raft.NetworkTransport {
+		t.stream = stream
+		return raft.NewNetworkTransportWithConfig(&raft.NetworkTransportConfig{
+			Stream:  stream,
+			MaxPool: t.MaxPool,
+			Timeout: t.Timeout,
+			Logger:  t.raftLog.Named("transport"),
+		})
 	})
 	if err != nil {
 		return errors.Errorf("raft transport creation error for address '%s', %v", advertise.String(), err)
 	}
 
+	if t.Bootstrap {
+		t.bootstrapConfig, err = t.bootstrapConfiguration()
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+/**
+Empty host in 'raft-server.listen-address' is replaced by the local IP from 'raft-server.local-ip-cidrs' networks.
+ */
+func (t *implRaftServer) listenAddress() (string, error) {
+
+	host, port, err := net.SplitHostPort(t.RaftAddress)
+	if err != nil {
+		return "", errors.Errorf("invalid property 'raft-server.listen-address' value '%s', %v", t.RaftAddress, err)
+	}
+	if host != "" {
+		return t.RaftAddress, nil
+	}
+
+	var cidrs []string
+	for _, cidr := range t.LocalIPCIDRs {
+		if cidr = strings.TrimSpace(cidr); cidr != "" {
+			cidrs = append(cidrs, cidr)
+		}
+	}
+
+	ipAddr, err := PreferredLocalIP(cidrs)
+	if err != nil {
+		if len(cidrs) > 0 {
+			return "", errors.Errorf("property 'raft-server.local-ip-cidrs' error, %v", err)
+		}
+		// listen on all interfaces, advertise address is required then
+		return t.RaftAddress, nil
+	}
+	return net.JoinHostPort(ipAddr.String(), port), nil
+}
+
+/**
+Returns 'raft-server.advertise-address' if set, otherwise the listener address.
+Host names are kept as is and resolved by the dialer on every connection.
+ */
+func (t *implRaftServer) advertiseAddress() (net.Addr, error) {
+
+	if t.AdvertiseAddress == "" {
+		advertise, err := net.ResolveTCPAddr("tcp", t.listener.Addr().String())
+		if err != nil {
+			return nil, errors.Errorf("tcp address resolve '%s', %v", t.listener.Addr().String(), err)
+		}
+		return advertise, nil
+	}
+
+	host, port, err := net.SplitHostPort(t.AdvertiseAddress)
+	if err != nil {
+		return nil, errors.Errorf("invalid property 'raft-server.advertise-address' value '%s', %v", t.AdvertiseAddress, err)
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		return nil, errors.Errorf("invalid port in property 'raft-server.advertise-address' value '%s', %v", t.AdvertiseAddress, err)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return net.ResolveTCPAddr("tcp", t.AdvertiseAddress)
+	}
+	return HostAddr{Address: net.JoinHostPort(host, port)}, nil
+}
+
+func (t *implRaftServer) newStreamTLS() (*streamTLS, error) {
+
+	mode, err := parseTLSMode(t.TLSMode)
+	if err != nil {
+		return nil, errors.Errorf("invalid property 'raft-server.tls-mode', %v", err)
+	}
+
+	config := t.TlsConfig
+	if config == nil {
+		config = &tls.Config{}
+	}
+
+	caFile := t.TLSCAFile
+	if t.CertificateReloader != nil {
+		// the reloader watches the CA file
+		caFile = ""
+	}
+
+	roots, err := loadRootCAs(caFile, config)
+	if err != nil {
+		return nil, errors.Errorf("invalid property 'raft-server.tls-ca-file', %v", err)
+	}
+
+	tlsOpt := &streamTLS{
+		config:   config,
+		mode:     mode,
+		roots:    roots,
+		reloader: t.CertificateReloader,
+		peerID:   t.peerID,
+	}
+
+	if t.AuthorizePeers {
+		if mode == TLSModeInsecure {
+			t.Log.Warn("RaftPeerAuthorizationDisabled", zap.String("reason", "peer certificates are not verified in 'insecure' TLS mode"))
+		} else {
+			tlsOpt.authorize = t.authorizePeer
+			tlsOpt.authorizeVersion = t.peersVersion
+		}
+	}
+
+	return tlsOpt, nil
+}
+
+/**
+Returns node ID of the peer by address from the latest raft configuration or the bootstrap configuration.
+ */
+func (t *implRaftServer) peerID(address raft.ServerAddress) (raft.ServerID, bool) {
+	configuration := t.bootstrapConfig
+	if r := t.raft; r != nil {
+		if future := r.GetConfiguration(); future.Error() == nil {
+			configuration = future.Configuration()
+		}
+	}
+	for _, server := range configuration.Servers {
+		if server.Address == address {
+			return server.ID, true
+		}
+	}
+	return "", false
+}
+
 func (t *implRaftServer) Active() bool {
 	return t.running.Load()
 }
@@ -148,24 +386,62 @@ func (t *implRaftServer) Serve() (err error) {
 		}
 	}()
 
-	t.Log.Info("RaftServerServe", zap.String("addr", t.RaftAddress), zap.Bool("tls", t.TlsConfig != nil))
+	t.Log.Info("RaftServerServe", zap.String("addr", t.RaftAddress), zap.Bool("tls", t.TlsConfig != nil || t.CertificateReloader != nil), zap.String("tlsMode", t.TLSMode))
 
 	t.running.Store(true)
 
-	config := raft.DefaultConfig()
-	config.LocalID = raft.ServerID(t.NodeService.NodeIdHex())
+	bootstrap := false
+	if t.Bootstrap {
+		hasState, err := raft.HasExistingState(t.LogStore, t.StableStore, t.FileSnapshotStore)
+		if err != nil {
+			return errors.Errorf("raft existing state check error, %v", err)
+		}
+		if hasState {
+			t.Log.Info("RaftBootstrapSkipped", zap.String("reason", "existing state"))
+		}
+		bootstrap = !hasState
+	}
+
+	logStore := t.LogStore
+	if t.snapshotLogSize > 0 {
+		logStore = countingLogStore{LogStore: logStore, bytes: &t.logBytes}
+	}
+	if t.AuthorizePeers {
+		logStore = configurationLogStore{LogStore: logStore, changed: t.invalidatePeers}
+	}
 
-	t.raft, err = raft.NewRaft(config, t.FSM, t.LogStore, t.StableStore, t.FileSnapshotStore, t.transport)
+	t.raft, err = raft.NewRaft(t.config, t.FSM, logStore, t.StableStore, t.FileSnapshotStore, t.transport)
 	if err != nil {
 		return err
 	}
 
+	t.startEvents()
+
+	if t.ReloadInterval > 0 {
+		go t.watchConfig()
+	}
+
+	if t.snapshotSchedule != nil || t.snapshotLogSize > 0 {
+		go t.scheduleSnapshots(t.snapshotSchedule, t.snapshotLogSize)
+	}
+
+	if bootstrap {
+		if t.BootstrapExpect > 1 {
+			go t.bootstrapExpect()
+		} else {
+			t.bootstrapCluster()
+		}
+	}
+
 	t.running.Store(true)
 	return nil
 }
 
 func (t *implRaftServer) Stop() {
 	t.running.Store(false)
+	t.shutdownOnce.Do(func() {
+		close(t.shutdownCh)
+	})
 	if t.running.CompareAndSwap(true, false) {
 		if t.raft != nil {
 			t.raft.Shutdown()
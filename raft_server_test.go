@@ -0,0 +1,261 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/codeallergy/raftapi"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+/**
+FSM that keeps applied commands and returns the command as the response.
+ */
+type testFSM struct {
+	sync.Mutex
+	applied [][]byte
+}
+
+// command with the response that could not be forwarded
+const testUnencodableCommand = "unencodable"
+
+func (t *testFSM) Apply(log *raft.Log) interface{} {
+	t.Lock()
+	defer t.Unlock()
+	t.applied = append(t.applied, log.Data)
+	if string(log.Data) == testUnencodableCommand {
+		return struct{}{}
+	}
+	return log.Data
+}
+
+func (t *testFSM) Snapshot() (raft.FSMSnapshot, error) {
+	t.Lock()
+	defer t.Unlock()
+	return &testFSMSnapshot{data: bytes.Join(t.applied, []byte{'\n'})}, nil
+}
+
+func (t *testFSM) Restore(source io.ReadCloser) error {
+	defer source.Close()
+	data, err := io.ReadAll(source)
+	if err != nil {
+		return err
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.applied = bytes.Split(data, []byte{'\n'})
+	return nil
+}
+
+func (t *testFSM) count() int {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.applied)
+}
+
+type testFSMSnapshot struct {
+	data []byte
+}
+
+func (t *testFSMSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(t.data); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (t *testFSMSnapshot) Release() {
+}
+
+/**
+Raft server over in-memory stores and transport, raft is started but not bootstrapped.
+ */
+func newTestRaftServer(t *testing.T, id string, trans raft.Transport) *implRaftServer {
+
+	store := raft.NewInmemStore()
+	server := &implRaftServer{
+		Log:               zap.NewNop(),
+		LogStore:          store,
+		StableStore:       store,
+		FileSnapshotStore: raft.NewInmemSnapshotStore(),
+		FSM:               &testFSM{},
+		Timeout:           2 * time.Second,
+		ReadMode:          ReadModeLinearizable,
+		shutdownCh:        make(chan struct{}),
+	}
+
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(id)
+	config.HeartbeatTimeout = 50 * time.Millisecond
+	config.ElectionTimeout = 50 * time.Millisecond
+	config.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.CommitTimeout = 5 * time.Millisecond
+	config.Logger = hclog.NewNullLogger()
+	server.notifyCh = make(chan bool, 1)
+	config.NotifyCh = server.notifyCh
+	server.config = config
+
+	var err error
+	server.raft, err = raft.NewRaft(config, server.FSM, countingLogStore{LogStore: store, bytes: &server.logBytes}, store, server.FileSnapshotStore, trans)
+	require.NoError(t, err)
+	server.running.Store(true)
+
+	t.Cleanup(func() {
+		server.running.Store(false)
+		server.shutdownOnce.Do(func() {
+			close(server.shutdownCh)
+		})
+		server.raft.Shutdown().Error()
+	})
+	return server
+}
+
+/**
+Cluster of voters connected by in-memory transports, returns servers after the leader is elected.
+ */
+func newTestRaftCluster(t *testing.T, n int) []*implRaftServer {
+
+	transports := make([]*raft.InmemTransport, n)
+	var configuration raft.Configuration
+	for i := range transports {
+		id := fmt.Sprintf("node%d", i+1)
+		_, transports[i] = raft.NewInmemTransport(raft.ServerAddress(id))
+		configuration.Servers = append(configuration.Servers, raft.Server{Suffrage: raft.Voter, ID: raft.ServerID(id), Address: raft.ServerAddress(id)})
+	}
+	for _, a := range transports {
+		for _, b := range transports {
+			if a != b {
+				a.Connect(b.LocalAddr(), b)
+			}
+		}
+	}
+
+	servers := make([]*implRaftServer, n)
+	for i := range servers {
+		servers[i] = newTestRaftServer(t, string(configuration.Servers[i].ID), transports[i])
+	}
+
+	require.NoError(t, servers[0].raft.BootstrapCluster(configuration).Error())
+	waitTestLeader(t, servers)
+
+	// followers learn the leader from the first heartbeat
+	deadline := time.Now().Add(5 * time.Second)
+	for _, server := range servers {
+		for server.raft.Leader() == "" {
+			require.True(t, time.Now().Before(deadline), "raft leader is unknown")
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return servers
+}
+
+func waitTestLeader(t *testing.T, servers []*implRaftServer) *implRaftServer {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, server := range servers {
+			if server.raft.State() == raft.Leader {
+				return server
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.FailNow(t, "raft leader is not elected")
+	return nil
+}
+
+func testFollower(servers []*implRaftServer) *implRaftServer {
+	for _, server := range servers {
+		if server.raft.State() == raft.Follower {
+			return server
+		}
+	}
+	return nil
+}
+
+/**
+Client pool with plain connections to the internal services of the test cluster.
+ */
+type testClientPool struct {
+	raftapi.RaftClientPool
+	conns map[raft.ServerAddress]*grpc.ClientConn
+}
+
+func (t *testClientPool) GetAPIConn(raftAddress raft.ServerAddress) (*grpc.ClientConn, error) {
+	if conn, ok := t.conns[raftAddress]; ok {
+		return conn, nil
+	}
+	return nil, errors.Errorf("unknown raft address '%s'", raftAddress)
+}
+
+func (t *testClientPool) GetAPIConnContext(ctx context.Context, raftAddress raft.ServerAddress) (*grpc.ClientConn, error) {
+	return t.GetAPIConn(raftAddress)
+}
+
+/**
+Serves the internal service of every node over gRPC, so followers forward requests to the leader.
+Node ID is the raft address in the test cluster.
+ */
+func serveTestInternalService(t *testing.T, servers []*implRaftServer) *testClientPool {
+
+	pool := &testClientPool{conns: make(map[raft.ServerAddress]*grpc.ClientConn)}
+	for _, server := range servers {
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		grpcServer := grpc.NewServer()
+		service := &implRaftInternalService{Log: zap.NewNop(), GrpcServer: grpcServer, RaftServer: server, Membership: server, Reader: server}
+		require.NoError(t, service.PostConstruct())
+		go grpcServer.Serve(listener)
+		t.Cleanup(grpcServer.Stop)
+
+		conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			conn.Close()
+		})
+
+		pool.conns[raft.ServerAddress(server.config.LocalID)] = conn
+		server.RaftClientPool = pool
+	}
+	return pool
+}
+
+func TestRaftServerBindLogLevel(t *testing.T) {
+
+	server := &implRaftServer{
+		Log:         zap.NewNop(),
+		RaftAddress: "127.0.0.1:0",
+		LogLevel:    "verbose",
+	}
+	err := server.Bind()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid property 'raft-server.log-level'")
+
+}
@@ -0,0 +1,295 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+package raftmod
+
+import (
+	"context"
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var snapshotLogSizePollInterval = 10 * time.Second
+
+/**
+Takes the snapshot of the local FSM, returns metadata of the created snapshot.
+Returns raft.ErrNothingNewToSnapshot if nothing was applied since the last snapshot.
+ */
+func (t *implRaftServer) TakeSnapshot(ctx context.Context) (*raft.SnapshotMeta, error) {
+
+	r, ok := t.Raft()
+	if !ok || r == nil {
+		return nil, ErrRaftNotRunning
+	}
+
+	start := time.Now()
+	future := r.Snapshot()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- future.Error()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, err
+		}
+	case <-ctx.Done():
+		return nil, errors.Errorf("snapshot is still in progress, %v", ctx.Err())
+	}
+
+	meta, err := t.lastSnapshot(r)
+	if err != nil {
+		return nil, err
+	}
+
+	t.resetLogBytes(meta.Index)
+
+	t.Log.Info("RaftSnapshotTaken", zap.String("id", meta.ID), zap.Uint64("index", meta.Index), zap.Uint64("term", meta.Term), zap.Int64("size", meta.Size), zap.Duration("duration", time.Since(start)))
+	return meta, nil
+}
+
+/**
+Finds metadata of the last snapshot of raft in the snapshot store, without opening the snapshot.
+ */
+func (t *implRaftServer) lastSnapshot(r *raft.Raft) (*raft.SnapshotMeta, error) {
+	stats := r.Stats()
+	index, err := strconv.ParseUint(stats["last_snapshot_index"], 10, 64)
+	if err != nil {
+		return nil, errors.Errorf("last snapshot index '%s' error, %v", stats["last_snapshot_index"], err)
+	}
+	term, err := strconv.ParseUint(stats["last_snapshot_term"], 10, 64)
+	if err != nil {
+		return nil, errors.Errorf("last snapshot term '%s' error, %v", stats["last_snapshot_term"], err)
+	}
+	list, err := t.FileSnapshotStore.List()
+	if err != nil {
+		return nil, errors.Errorf("snapshot list error, %v", err)
+	}
+	for _, meta := range list {
+		if meta.Index == index && meta.Term == term {
+			return meta, nil
+		}
+	}
+	return nil, errors.Errorf("snapshot of index %d and term %d is not found in the snapshot store", index, term)
+}
+
+/**
+Resets the 'raft-server.snapshot-log-size' counter once per snapshot index, for snapshots taken by raft itself too.
+ */
+func (t *implRaftServer) resetLogBytes(snapshotIndex uint64) {
+	for {
+		prev := t.logBytesIndex.Load()
+		if snapshotIndex <= prev {
+			return
+		}
+		if t.logBytesIndex.CAS(prev, snapshotIndex) {
+			t.logBytes.Store(0)
+			return
+		}
+	}
+}
+
+/**
+Takes the snapshot if the log has grown by logSize bytes since the last snapshot.
+ */
+func (t *implRaftServer) logSizeSnapshot(logSize int64) {
+	r, ok := t.Raft()
+	if !ok || r == nil {
+		return
+	}
+	if index, err := strconv.ParseUint(r.Stats()["last_snapshot_index"], 10, 64); err == nil {
+		t.resetLogBytes(index)
+	}
+	if t.logBytes.Load() >= logSize {
+		t.scheduledSnapshot("log-size")
+	}
+}
+
+/**
+Takes snapshots by 'raft-server.snapshot-schedule' and after 'raft-server.snapshot-log-size' bytes of log,
+independently of raft's own interval and threshold.
+ */
+func (t *implRaftServer) scheduleSnapshots(schedule *snapshotSchedule, logSize int64) {
+
+	var scheduled <-chan time.Time
+	var timer *time.Timer
+	if schedule != nil {
+		timer = time.NewTimer(time.Until(schedule.next(time.Now())))
+		defer timer.Stop()
+		scheduled = timer.C
+	}
+
+	var poll <-chan time.Time
+	if logSize > 0 {
+		ticker := time.NewTicker(snapshotLogSizePollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	for {
+		select {
+		case <-t.shutdownCh:
+			return
+		case <-scheduled:
+			t.scheduledSnapshot("schedule")
+			timer.Reset(time.Until(schedule.next(time.Now())))
+		case <-poll:
+			t.logSizeSnapshot(logSize)
+		}
+	}
+}
+
+func (t *implRaftServer) scheduledSnapshot(reason string) {
+	if _, err := t.TakeSnapshot(context.Background()); err != nil {
+		if err == raft.ErrNothingNewToSnapshot {
+			t.Log.Debug("RaftSnapshotSkipped", zap.String("reason", reason))
+			return
+		}
+		t.Log.Error("RaftSnapshotScheduled", zap.String("reason", reason), zap.Error(err))
+	}
+}
+
+/**
+Schedule formats:
+	@every <duration>   after each period since start, e.g. '@every 6h'
+	@hourly             at the beginning of each hour
+	@daily [HH:MM]      every day at the local time, midnight by default, e.g. '@daily 03:00'
+ */
+type snapshotSchedule struct {
+	every  time.Duration
+	hourly bool
+	hour   int
+	minute int
+}
+
+func parseSnapshotSchedule(value string) (*snapshotSchedule, error) {
+
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	switch {
+	case fields[0] == "@every" && len(fields) == 2:
+		every, err := time.ParseDuration(fields[1])
+		if err != nil || every <= 0 {
+			return nil, errors.Errorf("invalid snapshot schedule '%s', positive duration expected", value)
+		}
+		return &snapshotSchedule{every: every}, nil
+
+	case fields[0] == "@hourly" && len(fields) == 1:
+		return &snapshotSchedule{hourly: true}, nil
+
+	case fields[0] == "@daily" && len(fields) == 1:
+		return &snapshotSchedule{}, nil
+
+	case fields[0] == "@daily" && len(fields) == 2:
+		at, err := time.Parse("15:04", fields[1])
+		if err != nil {
+			return nil, errors.Errorf("invalid snapshot schedule '%s', time 'HH:MM' expected, %v", value, err)
+		}
+		return &snapshotSchedule{hour: at.Hour(), minute: at.Minute()}, nil
+
+	default:
+		return nil, errors.Errorf("invalid snapshot schedule '%s', expected '@every <duration>', '@hourly' or '@daily [HH:MM]'", value)
+	}
+}
+
+/**
+Returns the next time after now.
+ */
+func (t *snapshotSchedule) next(now time.Time) time.Time {
+	switch {
+	case t.every > 0:
+		return now.Add(t.every)
+	case t.hourly:
+		return now.Truncate(time.Hour).Add(time.Hour)
+	default:
+		// wall clock time, so days with DST change are not shifted
+		year, month, day := now.Date()
+		next := time.Date(year, month, day, t.hour, t.minute, 0, 0, now.Location())
+		if !next.After(now) {
+			next = time.Date(year, month, day+1, t.hour, t.minute, 0, 0, now.Location())
+		}
+		return next
+	}
+}
+
+/**
+Parses size with optional KB, MB, GB suffix, empty value means zero.
+ */
+func parseByteSize(value string) (int64, error) {
+
+	s := strings.ToUpper(strings.TrimSpace(value))
+	if s == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("invalid size '%s'", value)
+	}
+	return n * multiplier, nil
+}
+
+/**
+Counts bytes of appended log entries for the 'raft-server.snapshot-log-size' trigger.
+ */
+type countingLogStore struct {
+	raft.LogStore
+	bytes *atomic.Int64
+}
+
+func (t countingLogStore) StoreLog(log *raft.Log) error {
+	if err := t.LogStore.StoreLog(log); err != nil {
+		return err
+	}
+	t.bytes.Add(int64(len(log.Data)))
+	return nil
+}
+
+func (t countingLogStore) StoreLogs(logs []*raft.Log) error {
+	if err := t.LogStore.StoreLogs(logs); err != nil {
+		return err
+	}
+	var n int64
+	for _, log := range logs {
+		n += int64(len(log.Data))
+	}
+	t.bytes.Add(n)
+	return nil
+}
@@ -15,14 +15,21 @@
 package raftmod
 
 import (
+	"context"
 	"fmt"
 	"github.com/codeallergy/glue"
+	"github.com/codeallergy/store"
 	"github.com/codeallergy/sprint"
+	"github.com/dgraph-io/badger/v3"
 	"github.com/hashicorp/raft"
 	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"math"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
+	"time"
 )
 
 var SnapshotStoreClass = reflect.TypeOf((*raft.SnapshotStore)(nil)).Elem()
@@ -32,9 +39,28 @@ type implRaftSnapshotFactory struct {
 	Application sprint.Application `inject`
 	Properties  glue.Properties `inject`
 	SystemEnvironmentPropertyResolver sprint.SystemEnvironmentPropertyResolver `inject`
+	Log         *zap.Logger     `inject`
+	RaftStore   store.ManagedDataStore `inject:"bean=raft-storage,optional"`
+	KeyProviders map[string]KeyProvider `inject:"optional"`
 
-	RetainSnapshotCount int    `value:"raft-snapshot.retain-count,default=5"`
-	KeyProperty         string `value:"raft-snapshot.key-bean,default="`
+	RetainSnapshotCount int      `value:"raft-snapshot.retain-count,default=5"`
+	DailyDays           int      `value:"raft-snapshot.daily-days,default=0"`
+	MaxAge              time.Duration `value:"raft-snapshot.max-age,default=0s"`
+	MaxSize             string   `value:"raft-snapshot.max-size,default="`
+	Pinned              []string `value:"raft-snapshot.pinned,default="`
+	StoreType           string   `value:"raft-snapshot.store,default=file"`
+	SnapshotPrefix      string   `value:"raft-storage.snapshot-prefix,default=snapshot"`
+	KeyProperty         string   `value:"raft-snapshot.key-bean,default="`
+	KeyID               string   `value:"raft-snapshot.key-id,default="`
+	Keyring             []string `value:"raft-snapshot.keyring,default="`
+	RotateOnStart       bool     `value:"raft-snapshot.rotate-on-start,default=false"`
+	Cipher              string   `value:"raft-snapshot.cipher,default=aes-gcm"`
+	ChunkSize           int      `value:"raft-snapshot.chunk-size,default=65536"`
+	Compression         string   `value:"raft-snapshot.compression,default=none"`
+	Verify              bool     `value:"raft-snapshot.verify,default=false"`
+	KDF                 string   `value:"raft-snapshot.kdf,default=scrypt"`
+	KDFSalt             string   `value:"raft-snapshot.kdf-salt,default=raftmod-snapshot"`
+	LogLevel            string   `value:"raft-server.log-level,default=INFO"`
 
 	DataDir           string       `value:"application.data.dir,default="`
 	DataDirPerm       os.FileMode  `value:"application.perm.data.dir,default=-rwxrwx---"`
@@ -60,6 +86,101 @@ func (t *implRaftSnapshotFactory) Object() (object interface{}, err error) {
 		}
 	}()
 
+	retention, err := t.retention()
+	if err != nil {
+		return nil, err
+	}
+
+	retain := t.RetainSnapshotCount
+	if retention != nil {
+		// retention store applies the count with other policies
+		retain = math.MaxInt32
+	}
+
+	snapshots, err := t.newSnapshotStore(retain)
+	if err != nil {
+		return nil, err
+	}
+
+	if retention != nil {
+		snapshots, err = NewRetentionSnapshotStore(snapshots, *retention, t.Log)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if t.Verify {
+		// digest covers stored bytes, so the verifying store is placed below encryption and compression,
+		// the retention store in between passes content and quarantine through unchanged
+		verifying := NewVerifyingSnapshotStore(snapshots, t.Log)
+		if _, err := verifying.Scan(); err != nil {
+			return nil, errors.Errorf("raft snapshots scan error, %v", err)
+		}
+		snapshots = verifying
+	}
+
+	compression, err := ParseSnapshotCompression(t.Compression)
+	if err != nil {
+		return nil, errors.Errorf("property 'raft-snapshot.compression' error, %v", err)
+	}
+
+	var snapshotStore raft.SnapshotStore = snapshots
+
+	if t.KeyProperty != "" {
+		encryptionToken, err := t.encryptionToken(t.KeyProperty)
+		if err != nil {
+			return nil, err
+		}
+		options := []EncryptionOption{WithCipher(t.Cipher), WithChunkSize(t.ChunkSize), WithKDF(t.KDF, t.KDFSalt), WithKeyID(t.KeyID)}
+		for _, entry := range t.Keyring {
+			i := strings.IndexByte(entry, '=')
+			if i < 0 || i == len(entry)-1 {
+				return nil, errors.Errorf("invalid 'raft-snapshot.keyring' entry '%s', expected 'keyId=key-bean'", entry)
+			}
+			token, err := t.encryptionToken(strings.TrimSpace(entry[i+1:]))
+			if err != nil {
+				return nil, err
+			}
+			options = append(options, WithKey(strings.TrimSpace(entry[:i]), token))
+		}
+		snapshotStore, err = NewEncryptedSnapshotStore(snapshots, encryptionToken, options...)
+		if err != nil {
+			return nil, err
+		}
+		if t.RotateOnStart {
+			go t.rotate(snapshotStore.(EncryptedSnapshotStore))
+		}
+	}
+
+	if compression != CompressionNone {
+		// compress before encryption, encrypted data is not compressible,
+		// key management of the wrapped store is reached by FindSnapshotStore
+		snapshotStore = NewCompressedSnapshotStore(snapshotStore, compression)
+	}
+
+	return snapshotStore, nil
+}
+
+/**
+Creates the base store selected by 'raft-snapshot.store' property, 'file' or 'badger'.
+ */
+func (t *implRaftSnapshotFactory) newSnapshotStore(retain int) (raft.SnapshotStore, error) {
+
+	switch t.StoreType {
+	case "file", "":
+	case "badger":
+		if t.RaftStore == nil {
+			return nil, errors.New("managed data store 'raft-storage' is required by 'raft-snapshot.store=badger'")
+		}
+		db, ok := t.RaftStore.Instance().(*badger.DB)
+		if !ok {
+			return nil, errors.New("managed data delegate 'raft-storage' must have badger backend")
+		}
+		return NewBadgerSnapshotStore(db, []byte(t.SnapshotPrefix), retain)
+	default:
+		return nil, errors.Errorf("unknown snapshot store '%s' in property 'raft-snapshot.store'", t.StoreType)
+	}
+
 	dataDir := t.DataDir
 	if dataDir == "" {
 		dataDir = filepath.Join(t.Application.ApplicationDir(), "db")
@@ -81,25 +202,78 @@ func (t *implRaftSnapshotFactory) Object() (object interface{}, err error) {
 		return nil, err
 	}
 
+	if _, err := ParseLogLevel(t.LogLevel); err != nil {
+		return nil, errors.Errorf("invalid property 'raft-server.log-level', %v", err)
+	}
+
 	// Create the snapshot delegate. This allows the Raft to truncate the log.
-	snapshots, err := raft.NewFileSnapshotStore(snapshotsFolder, t.RetainSnapshotCount, os.Stderr)
+	snapshots, err := NewFileSnapshotStore(snapshotsFolder, retain, NewZapLogger(t.Log, "raft", t.LogLevel).Named("snapshot"))
 	if err != nil {
 		return nil, fmt.Errorf("raft snapshots '%s' creation error, %v", snapshotsFolder, err)
 	}
 
-	if t.KeyProperty != "" {
-		encryptionToken := t.Properties.GetString(t.KeyProperty, "")
-		if encryptionToken == "" {
-			var ok bool
-			encryptionToken, ok = t.SystemEnvironmentPropertyResolver.PromptProperty(t.KeyProperty)
-			if !ok || encryptionToken == "" {
-				return nil, errors.Errorf("'%s' encryption token is required", t.KeyProperty)
-			}
+	return snapshots, nil
+}
+
+/**
+Returns retention policies if any of them is configured beyond 'raft-snapshot.retain-count', otherwise nil.
+ */
+func (t *implRaftSnapshotFactory) retention() (*SnapshotRetention, error) {
+
+	maxSize, err := parseByteSize(t.MaxSize)
+	if err != nil {
+		return nil, errors.Errorf("invalid property 'raft-snapshot.max-size', %v", err)
+	}
+
+	var pinned []string
+	for _, id := range t.Pinned {
+		if id = strings.TrimSpace(id); id != "" {
+			pinned = append(pinned, id)
 		}
-		return NewEncryptedSnapshotStore(snapshots, encryptionToken)
 	}
 
-	return snapshots, nil
+	if t.DailyDays <= 0 && t.MaxAge <= 0 && maxSize <= 0 && len(pinned) == 0 {
+		return nil, nil
+	}
+
+	return &SnapshotRetention{
+		RetainCount: t.RetainSnapshotCount,
+		DailyDays:   t.DailyDays,
+		MaxAge:      t.MaxAge,
+		MaxSize:     maxSize,
+		Pinned:      pinned,
+	}, nil
+}
+
+/**
+Resolves token by the KeyProvider bean name, falls back to the property and prompt.
+ */
+func (t *implRaftSnapshotFactory) encryptionToken(keyProperty string) (string, error) {
+	if provider, ok := t.KeyProviders[keyProperty]; ok {
+		token, err := provider.GetKey()
+		if err != nil {
+			return "", errors.Errorf("key provider '%s' error, %v", keyProperty, err)
+		}
+		return token, nil
+	}
+	encryptionToken := t.Properties.GetString(keyProperty, "")
+	if encryptionToken == "" {
+		var ok bool
+		encryptionToken, ok = t.SystemEnvironmentPropertyResolver.PromptProperty(keyProperty)
+		if !ok || encryptionToken == "" {
+			return "", errors.Errorf("'%s' encryption token is required", keyProperty)
+		}
+	}
+	return encryptionToken, nil
+}
+
+func (t *implRaftSnapshotFactory) rotate(store EncryptedSnapshotStore) {
+	keyId := store.ActiveKeyID()
+	if err := <-store.Rotate(context.Background()); err != nil {
+		t.Log.Error("RaftSnapshotRotate", zap.String("keyId", keyId), zap.Error(err))
+	} else {
+		t.Log.Info("RaftSnapshotRotate", zap.String("keyId", keyId))
+	}
 }
 
 func (t *implRaftSnapshotFactory) ObjectType() reflect.Type {
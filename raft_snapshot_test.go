@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+package raftmod
+
+import (
+	"context"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestSnapshotSchedule(t *testing.T) {
+
+	now := time.Date(2023, 3, 10, 14, 25, 0, 0, time.Local)
+
+	schedule, err := parseSnapshotSchedule("")
+	require.NoError(t, err)
+	require.Nil(t, schedule)
+
+	schedule, err = parseSnapshotSchedule("@every 90m")
+	require.NoError(t, err)
+	require.Equal(t, now.Add(90*time.Minute), schedule.next(now))
+
+	schedule, err = parseSnapshotSchedule("@hourly")
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2023, 3, 10, 15, 0, 0, 0, time.Local), schedule.next(now))
+
+	schedule, err = parseSnapshotSchedule("@daily")
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2023, 3, 11, 0, 0, 0, 0, time.Local), schedule.next(now))
+
+	schedule, err = parseSnapshotSchedule("@daily 03:30")
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2023, 3, 11, 3, 30, 0, 0, time.Local), schedule.next(now))
+
+	schedule, err = parseSnapshotSchedule("@daily 18:00")
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2023, 3, 10, 18, 0, 0, 0, time.Local), schedule.next(now))
+
+	// daylight saving time starts on 2023-03-12, midnight plus duration would be 04:30
+	location, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+	schedule, err = parseSnapshotSchedule("@daily 03:30")
+	require.NoError(t, err)
+	next := schedule.next(time.Date(2023, 3, 11, 14, 0, 0, 0, location))
+	require.Equal(t, 3, next.Hour())
+	require.Equal(t, 30, next.Minute())
+	require.Equal(t, 12, next.Day())
+
+	for _, invalid := range []string{"@every", "@every -1s", "@daily 25:00", "@weekly", "0 3 * * *"} {
+		_, err = parseSnapshotSchedule(invalid)
+		require.Error(t, err, invalid)
+	}
+
+}
+
+func TestSnapshotLogSize(t *testing.T) {
+
+	for value, expected := range map[string]int64{"": 0, "100": 100, "64KB": 64 << 10, "16 MB": 16 << 20, "2gb": 2 << 30} {
+		size, err := parseByteSize(value)
+		require.NoError(t, err, value)
+		require.Equal(t, expected, size, value)
+	}
+
+	_, err := parseByteSize("MB")
+	require.Error(t, err)
+
+	var counter atomic.Int64
+	logs := countingLogStore{LogStore: raft.NewInmemStore(), bytes: &counter}
+
+	require.NoError(t, logs.StoreLog(&raft.Log{Index: 1, Data: make([]byte, 10)}))
+	require.NoError(t, logs.StoreLogs([]*raft.Log{{Index: 2, Data: make([]byte, 20)}, {Index: 3, Data: make([]byte, 30)}}))
+	require.Equal(t, int64(60), counter.Load())
+
+}
+
+func TestTakeSnapshot(t *testing.T) {
+
+	server := newTestRaftCluster(t, 1)[0]
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, server.raft.Apply([]byte("command"), time.Second).Error())
+	}
+	// includes configuration entries
+	require.True(t, server.logBytes.Load() >= 35)
+
+	meta, err := server.TakeSnapshot(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, server.raft.AppliedIndex(), meta.Index)
+	require.Equal(t, int64(len("command\n") * 5 - 1), meta.Size)
+	list, err := server.FileSnapshotStore.List()
+	require.NoError(t, err)
+	require.Equal(t, list[0].ID, meta.ID)
+	require.Equal(t, int64(0), server.logBytes.Load())
+
+	// snapshot taken by raft itself resets the counter too
+	require.NoError(t, server.raft.Apply([]byte("command"), time.Second).Error())
+	require.NoError(t, server.raft.Snapshot().Error())
+	require.Equal(t, int64(7), server.logBytes.Load())
+
+	server.logSizeSnapshot(1000)
+	require.Equal(t, int64(0), server.logBytes.Load())
+	require.Equal(t, server.raft.AppliedIndex(), server.logBytesIndex.Load())
+
+}
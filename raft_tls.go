@@ -0,0 +1,321 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+/**
+Modes of 'raft-server.tls-mode' property:
+	insecure   encryption only, certificates are not verified
+	verify     dialer verifies the server certificate and its node identity, client certificates are verified if given
+	mutual     both sides verify certificates, client certificate is required on accept
+*/
+const (
+	TLSModeInsecure = "insecure"
+	TLSModeVerify   = "verify"
+	TLSModeMutual   = "mutual"
+)
+
+/**
+Certificate extension with the raft node ID as UTF8String or raw bytes, used when SAN does not contain the node ID.
+ */
+var NodeIDExtensionOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+
+var ErrUnknownPeerAddress = errors.New("raft peer address is not in the configuration")
+
+/**
+TLS settings of the stream layer.
+ */
+type streamTLS struct {
+	config *tls.Config
+	mode   string
+	// nil means system roots
+	roots  *x509.CertPool
+	// replaces certificates of config and roots if set
+	reloader CertificateReloader
+	// returns expected node ID for the dialed address
+	peerID func(raft.ServerAddress) (raft.ServerID, bool)
+	// checks identity of the accepted peer, can be nil
+	authorize func(cert *x509.Certificate, remote net.Addr) error
+	// changes when authorize could give another result, nil means the peer is authorized on every read
+	authorizeVersion func() uint64
+}
+
+func parseTLSMode(mode string) (string, error) {
+	switch mode {
+	case TLSModeInsecure, TLSModeVerify, TLSModeMutual:
+		return mode, nil
+	default:
+		return "", errors.Errorf("unknown TLS mode '%s', expected '%s', '%s' or '%s'", mode, TLSModeInsecure, TLSModeVerify, TLSModeMutual)
+	}
+}
+
+/**
+Loads CA pool from PEM file, falls back to RootCAs and ClientCAs of the TLS config.
+ */
+func loadRootCAs(caFile string, config *tls.Config) (*x509.CertPool, error) {
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Errorf("CA file '%s' read error, %v", caFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.Errorf("CA file '%s' has no PEM certificates", caFile)
+		}
+		return pool, nil
+	}
+	if config.RootCAs != nil {
+		return config.RootCAs, nil
+	}
+	return config.ClientCAs, nil
+}
+
+/**
+Hostname verification is replaced by the node identity check, because peers are dialed by IP addresses or host names that are not in certificates.
+ */
+func (t *streamTLS) clientConfig(address raft.ServerAddress) *tls.Config {
+	conf := &tls.Config{
+		Rand:                 rand.Reader,
+		MinVersion:           tls.VersionTLS12,
+		InsecureSkipVerify:   true,
+	}
+	if t.reloader != nil {
+		conf.GetClientCertificate = t.reloader.GetClientCertificate
+	} else {
+		conf.Certificates = t.config.Certificates
+		conf.GetClientCertificate = t.config.GetClientCertificate
+	}
+	if t.mode != TLSModeInsecure {
+		conf.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			cert, err := t.verifyChain(rawCerts, x509.ExtKeyUsageServerAuth)
+			if err != nil {
+				return err
+			}
+			return t.verifyIdentity(cert, address)
+		}
+	}
+	return conf
+}
+
+func (t *streamTLS) serverConfig() *tls.Config {
+	conf := &tls.Config{
+		Rand:           rand.Reader,
+		MinVersion:     tls.VersionTLS12,
+		// config is built for every connection, so it has the current CA pool
+		ClientCAs:      t.rootCAs(),
+	}
+	if t.reloader != nil {
+		conf.GetCertificate = t.reloader.GetCertificate
+	} else {
+		conf.Certificates = t.config.Certificates
+		conf.GetCertificate = t.config.GetCertificate
+	}
+	switch t.mode {
+	case TLSModeMutual:
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	case TLSModeVerify:
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		conf.ClientAuth = tls.NoClientCert
+	}
+	return conf
+}
+
+/**
+Wraps accepted connection, so the handshake and the authorization run on the first read in the connection goroutine.
+ */
+func (t *streamTLS) accept(conn net.Conn) net.Conn {
+	server := tls.Server(conn, t.serverConfig())
+	if t.authorize == nil {
+		return server
+	}
+	return &authorizedConn{Conn: server, authorize: t.authorize, version: t.authorizeVersion}
+}
+
+func (t *streamTLS) rootCAs() *x509.CertPool {
+	if t.reloader != nil {
+		if roots := t.reloader.RootCAs(); roots != nil {
+			return roots
+		}
+	}
+	return t.roots
+}
+
+func (t *streamTLS) verifyChain(rawCerts [][]byte, usage x509.ExtKeyUsage) (*x509.Certificate, error) {
+	return verifyCertificateChain(rawCerts, t.rootCAs(), usage)
+}
+
+/**
+Verifies the peer chain without hostname check, nil roots means system roots.
+ */
+func verifyCertificateChain(rawCerts [][]byte, roots *x509.CertPool, usage x509.ExtKeyUsage) (*x509.Certificate, error) {
+
+	if len(rawCerts) == 0 {
+		return nil, errors.New("raft peer has no certificate")
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, errors.Errorf("raft peer certificate parse error, %v", err)
+		}
+		certs[i] = cert
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+	if err != nil {
+		return nil, errors.Errorf("raft peer certificate verification error, %v", err)
+	}
+	return certs[0], nil
+}
+
+func (t *streamTLS) verifyIdentity(cert *x509.Certificate, address raft.ServerAddress) error {
+	if t.peerID == nil {
+		return nil
+	}
+	id, ok := t.peerID(address)
+	if !ok {
+		return errors.Wrapf(ErrUnknownPeerAddress, "address '%s'", address)
+	}
+	if !certificateHasNodeID(cert, id) {
+		return errors.Errorf("raft peer certificate at '%s' does not belong to node '%s'", address, id)
+	}
+	return nil
+}
+
+/**
+Node ID is matched against SAN DNS names, IP addresses, URIs (exact or the last path segment) and the node ID extension.
+ */
+func certificateHasNodeID(cert *x509.Certificate, id raft.ServerID) bool {
+	expected := string(id)
+	if expected == "" {
+		return false
+	}
+	for _, name := range cert.DNSNames {
+		if strings.EqualFold(name, expected) {
+			return true
+		}
+	}
+	if ip := net.ParseIP(expected); ip != nil {
+		for _, addr := range cert.IPAddresses {
+			if addr.Equal(ip) {
+				return true
+			}
+		}
+	}
+	for _, uri := range cert.URIs {
+		if uri.String() == expected || (uri.Path != "" && path.Base(uri.Path) == expected) {
+			return true
+		}
+	}
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(NodeIDExtensionOID) && certificateExtensionValue(ext.Value) == expected {
+			return true
+		}
+	}
+	return false
+}
+
+func certificateExtensionValue(value []byte) string {
+	var s string
+	if rest, err := asn1.Unmarshal(value, &s); err == nil && len(rest) == 0 {
+		return s
+	}
+	return string(value)
+}
+
+/**
+Connection that is closed before any data is exchanged if the peer is not authorized.
+Raft keeps connections open between RPCs, so the peer is authorized again on read once the peers version changes,
+and the connection of the peer removed from the configuration is closed on the next RPC.
+ */
+type authorizedConn struct {
+	*tls.Conn
+	authorize func(cert *x509.Certificate, remote net.Addr) error
+	version   func() uint64
+	once      sync.Once
+	cert      *x509.Certificate
+	err       error
+	// peers version of the last authorization, used by Read only
+	authorized uint64
+}
+
+func (t *authorizedConn) check() error {
+	t.once.Do(func() {
+		t.err = t.Conn.Handshake()
+		if t.err == nil {
+			if certs := t.Conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+				t.cert = certs[0]
+			}
+			t.authorized = t.currentVersion()
+			t.err = t.authorize(t.cert, t.Conn.RemoteAddr())
+		}
+		if t.err != nil {
+			t.Conn.Close()
+		}
+	})
+	return t.err
+}
+
+func (t *authorizedConn) currentVersion() uint64 {
+	if t.version == nil {
+		return 0
+	}
+	return t.version()
+}
+
+func (t *authorizedConn) Read(p []byte) (int, error) {
+	if err := t.check(); err != nil {
+		return 0, err
+	}
+	if version := t.currentVersion(); t.version == nil || version != t.authorized {
+		if err := t.authorize(t.cert, t.Conn.RemoteAddr()); err != nil {
+			t.Conn.Close()
+			return 0, err
+		}
+		t.authorized = version
+	}
+	return t.Conn.Read(p)
+}
+
+func (t *authorizedConn) Write(p []byte) (int, error) {
+	if err := t.check(); err != nil {
+		return 0, err
+	}
+	return t.Conn.Write(p)
+}
@@ -0,0 +1,201 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+package raftmod
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "raftmod test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+/**
+Issues certificate for the node, extension is used instead of SAN if set.
+ */
+func (ca *testCA) issue(t *testing.T, nodeId string, extension bool) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: nodeId},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if extension {
+		value, err := asn1.MarshalWithParams(nodeId, "utf8")
+		require.NoError(t, err)
+		template.ExtraExtensions = []pkix.Extension{{Id: NodeIDExtensionOID, Value: value}}
+	} else {
+		template.DNSNames = []string{nodeId}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func newTestStreamLayer(t *testing.T, cert tls.Certificate, ca *testCA, mode string, peers map[raft.ServerAddress]raft.ServerID) *TCPStreamLayer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	return &TCPStreamLayer{
+		listener: listener,
+		tlsOpt: &streamTLS{
+			config: &tls.Config{Certificates: []tls.Certificate{cert}},
+			mode:   mode,
+			roots:  ca.pool,
+			peerID: func(address raft.ServerAddress) (raft.ServerID, bool) {
+				id, ok := peers[address]
+				return id, ok
+			},
+		},
+	}
+}
+
+/**
+Dials the server stream layer, returns client and server handshake errors.
+ */
+func dialTestStreamLayer(client, server *TCPStreamLayer) (error, error) {
+
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		serverErr <- err
+	}()
+
+	conn, err := client.Dial(raft.ServerAddress(server.Addr().String()), time.Second)
+	if err == nil {
+		// TLS 1.3 client completes handshake before the server verifies the certificate
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err = conn.Write([]byte{1}); err == nil {
+			_, err = conn.Read(make([]byte, 1))
+		}
+		if err == io.EOF {
+			err = nil
+		}
+		conn.Close()
+	}
+	return err, <-serverErr
+}
+
+func TestStreamLayerTLS(t *testing.T) {
+
+	ca := newTestCA(t)
+	otherCA := newTestCA(t)
+
+	server := newTestStreamLayer(t, ca.issue(t, "node1", false), ca, TLSModeMutual, nil)
+	defer server.Close()
+	address := raft.ServerAddress(server.Addr().String())
+
+	peers := map[raft.ServerAddress]raft.ServerID{address: "node1"}
+
+	clientErr, serverErr := dialTestStreamLayer(newTestStreamLayer(t, ca.issue(t, "node2", true), ca, TLSModeMutual, peers), server)
+	require.NoError(t, clientErr)
+	require.NoError(t, serverErr)
+
+	// server certificate of another node
+	clientErr, _ = dialTestStreamLayer(newTestStreamLayer(t, ca.issue(t, "node2", false), ca, TLSModeMutual, map[raft.ServerAddress]raft.ServerID{address: "node3"}), server)
+	require.Error(t, clientErr)
+
+	// unknown address
+	clientErr, _ = dialTestStreamLayer(newTestStreamLayer(t, ca.issue(t, "node2", false), ca, TLSModeMutual, nil), server)
+	require.ErrorContains(t, clientErr, ErrUnknownPeerAddress.Error())
+
+	// client certificate of another CA
+	_, serverErr = dialTestStreamLayer(newTestStreamLayer(t, otherCA.issue(t, "node2", false), ca, TLSModeMutual, peers), server)
+	require.Error(t, serverErr)
+
+	// insecure client does not verify the server
+	clientErr, serverErr = dialTestStreamLayer(newTestStreamLayer(t, ca.issue(t, "node2", false), otherCA, TLSModeInsecure, nil), server)
+	require.NoError(t, clientErr)
+	require.NoError(t, serverErr)
+
+}
+
+func TestCertificateNodeID(t *testing.T) {
+
+	ca := newTestCA(t)
+
+	for _, extension := range []bool{false, true} {
+		cert, err := x509.ParseCertificate(ca.issue(t, "a1b2c3", extension).Certificate[0])
+		require.NoError(t, err)
+		require.True(t, certificateHasNodeID(cert, "a1b2c3"))
+		require.False(t, certificateHasNodeID(cert, "a1b2c4"))
+		require.False(t, certificateHasNodeID(cert, ""))
+	}
+
+	for _, c := range []struct {
+		uri   string
+		id    raft.ServerID
+		match bool
+	}{
+		{"spiffe://cluster/raft/node1", "node1", true},
+		{"spiffe://cluster/raft/node1", "spiffe://cluster/raft/node1", true},
+		{"spiffe://cluster/raft/evilnode1", "node1", false},
+		{"spiffe://cluster/raft/node1", "raft/node1", false},
+		{"spiffe://cluster/node1/other", "node1", false},
+		{"spiffe://node1", "node1", false},
+	} {
+		uri, err := url.Parse(c.uri)
+		require.NoError(t, err)
+		cert := &x509.Certificate{URIs: []*url.URL{uri}}
+		require.Equal(t, c.match, certificateHasNodeID(cert, c.id), "%s %s", c.uri, c.id)
+	}
+
+}
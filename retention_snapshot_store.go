@@ -0,0 +1,314 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+package raftmod
+
+import (
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+Retention policies applied after each successful snapshot.
+The latest snapshot, pinned snapshots and snapshots opened for restore are never deleted.
+ */
+type SnapshotRetention struct {
+
+	// keeps the latest snapshots
+	RetainCount  int
+
+	// keeps the latest snapshot of each day for the last days, including today
+	DailyDays    int
+
+	// deletes snapshots older than the age, even if they are kept by count or daily policy
+	MaxAge       time.Duration
+
+	// deletes the oldest snapshots while total size exceeds the limit
+	MaxSize      int64
+
+	Pinned       []string
+}
+
+type implRetentionSnapshotStore struct {
+	delegate raft.SnapshotStore
+	remover  SnapshotRemover
+	policy   SnapshotRetention
+	log      *zap.Logger
+
+	// guards pinned and opened, held during pruning, so the snapshot could not be opened while it is deleted
+	mu      sync.Mutex
+	pinned  map[string]bool
+	opened  map[string]int
+}
+
+/**
+Wraps the base store, the store must implement SnapshotRemover and should retain all snapshots by itself.
+ */
+func NewRetentionSnapshotStore(store raft.SnapshotStore, policy SnapshotRetention, log *zap.Logger) (RetentionSnapshotStore, error) {
+
+	remover, ok := store.(SnapshotRemover)
+	if !ok {
+		return nil, errors.New("snapshot store does not support remove")
+	}
+
+	if policy.RetainCount < 1 {
+		policy.RetainCount = 1
+	}
+
+	t := &implRetentionSnapshotStore{
+		delegate: store,
+		remover:  remover,
+		policy:   policy,
+		log:      log,
+		pinned:   make(map[string]bool),
+		opened:   make(map[string]int),
+	}
+	for _, id := range policy.Pinned {
+		t.pinned[id] = true
+	}
+	return t, nil
+}
+
+func (t *implRetentionSnapshotStore) Create(version raft.SnapshotVersion, index, term uint64, configuration raft.Configuration,
+	configurationIndex uint64, trans raft.Transport) (raft.SnapshotSink, error) {
+
+	sink, err := t.delegate.Create(version, index, term, configuration, configurationIndex, trans)
+	if err != nil {
+		return nil, err
+	}
+	return &implRetentionSink{SnapshotSink: sink, parent: t}, nil
+}
+
+func (t *implRetentionSnapshotStore) Unwrap() raft.SnapshotStore {
+	return t.delegate
+}
+
+func (t *implRetentionSnapshotStore) List() ([]*raft.SnapshotMeta, error) {
+	return t.delegate.List()
+}
+
+/**
+Snapshot stays protected from pruning until the reader is closed.
+ */
+func (t *implRetentionSnapshotStore) Open(id string) (*raft.SnapshotMeta, io.ReadCloser, error) {
+
+	t.mu.Lock()
+	t.opened[id]++
+	t.mu.Unlock()
+
+	meta, source, err := t.delegate.Open(id)
+	if err != nil {
+		t.release(id)
+		return nil, nil, err
+	}
+
+	return meta, &implRetentionReader{ReadCloser: source, release: func() { t.release(id) }}, nil
+}
+
+func (t *implRetentionSnapshotStore) release(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.opened[id] <= 1 {
+		delete(t.opened, id)
+	} else {
+		t.opened[id]--
+	}
+}
+
+func (t *implRetentionSnapshotStore) Pin(id string) {
+	t.mu.Lock()
+	t.pinned[id] = true
+	t.mu.Unlock()
+}
+
+func (t *implRetentionSnapshotStore) Unpin(id string) {
+	t.mu.Lock()
+	delete(t.pinned, id)
+	t.mu.Unlock()
+}
+
+func (t *implRetentionSnapshotStore) Prune() ([]string, error) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	list, err := t.delegate.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []string
+	for _, meta := range t.selectExpired(list, time.Now()) {
+		if err := t.remover.Remove(meta.ID); err != nil {
+			return deleted, errors.Errorf("snapshot '%s' remove error, %v", meta.ID, err)
+		}
+		deleted = append(deleted, meta.ID)
+		t.log.Info("RaftSnapshotPruned", zap.String("id", meta.ID), zap.Uint64("index", meta.Index), zap.Int64("size", meta.Size))
+	}
+	return deleted, nil
+}
+
+/**
+Returns snapshots to delete, list is ordered from the newest to the oldest as returned by raft stores.
+ */
+func (t *implRetentionSnapshotStore) selectExpired(list []*raft.SnapshotMeta, now time.Time) []*raft.SnapshotMeta {
+
+	list = append([]*raft.SnapshotMeta{}, list...)
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Term != list[j].Term {
+			return list[i].Term > list[j].Term
+		}
+		return list[i].Index > list[j].Index
+	})
+
+	protected := func(i int) bool {
+		return i == 0 || t.pinned[list[i].ID] || t.opened[list[i].ID] > 0
+	}
+
+	keep := make([]bool, len(list))
+	for i := range list {
+		keep[i] = i < t.policy.RetainCount || protected(i)
+	}
+
+	if t.policy.DailyDays > 0 {
+		year, month, day := now.Date()
+		since := time.Date(year, month, day-t.policy.DailyDays+1, 0, 0, 0, 0, now.Location())
+		days := make(map[string]bool)
+		for i, meta := range list {
+			created, ok := snapshotCreated(meta.ID)
+			if !ok || created.Before(since) {
+				continue
+			}
+			key := created.In(now.Location()).Format("2006-01-02")
+			if !days[key] {
+				days[key] = true
+				keep[i] = true
+			}
+		}
+	}
+
+	if t.policy.MaxAge > 0 {
+		for i, meta := range list {
+			if created, ok := snapshotCreated(meta.ID); ok && now.Sub(created) > t.policy.MaxAge && !protected(i) {
+				keep[i] = false
+			}
+		}
+	}
+
+	if t.policy.MaxSize > 0 {
+		var total int64
+		for i, meta := range list {
+			if keep[i] {
+				total += meta.Size
+			}
+		}
+		for i := len(list) - 1; i >= 0 && total > t.policy.MaxSize; i-- {
+			if keep[i] && !protected(i) {
+				keep[i] = false
+				total -= list[i].Size
+			}
+		}
+	}
+
+	var expired []*raft.SnapshotMeta
+	for i, meta := range list {
+		if !keep[i] {
+			expired = append(expired, meta)
+		}
+	}
+	return expired
+}
+
+/**
+Both file and badger stores name snapshots 'term-index-unixMillis'.
+ */
+func snapshotCreated(id string) (time.Time, bool) {
+	i := strings.LastIndexByte(id, '-')
+	if i < 0 {
+		return time.Time{}, false
+	}
+	ms, err := strconv.ParseInt(id[i+1:], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)), true
+}
+
+func (t *implRetentionSnapshotStore) Rewrite(id string, fn func(meta *raft.SnapshotMeta, source io.Reader, sink io.Writer) error) error {
+	rewriter, ok := t.delegate.(SnapshotRewriter)
+	if !ok {
+		return errors.New("snapshot store does not support rewrite")
+	}
+	return rewriter.Rewrite(id, fn)
+}
+
+func (t *implRetentionSnapshotStore) Quarantine(id string) error {
+	q, ok := t.delegate.(SnapshotQuarantine)
+	if !ok {
+		return errors.New("snapshot store does not support quarantine")
+	}
+	return q.Quarantine(id)
+}
+
+func (t *implRetentionSnapshotStore) SetAttribute(id, name string, value []byte) error {
+	attributes, ok := t.delegate.(SnapshotAttributes)
+	if !ok {
+		return errors.New("snapshot store does not support attributes")
+	}
+	return attributes.SetAttribute(id, name, value)
+}
+
+func (t *implRetentionSnapshotStore) Attribute(id, name string) ([]byte, error) {
+	attributes, ok := t.delegate.(SnapshotAttributes)
+	if !ok {
+		return nil, errors.New("snapshot store does not support attributes")
+	}
+	return attributes.Attribute(id, name)
+}
+
+type implRetentionSink struct {
+	raft.SnapshotSink
+	parent *implRetentionSnapshotStore
+}
+
+/**
+Pruning errors are logged, the snapshot itself is already persisted.
+ */
+func (t *implRetentionSink) Close() error {
+	if err := t.SnapshotSink.Close(); err != nil {
+		return err
+	}
+	if _, err := t.parent.Prune(); err != nil {
+		t.parent.log.Error("RaftSnapshotPrune", zap.String("id", t.ID()), zap.Error(err))
+	}
+	return nil
+}
+
+type implRetentionReader struct {
+	io.ReadCloser
+	release  func()
+	once     sync.Once
+}
+
+func (t *implRetentionReader) Close() error {
+	err := t.ReadCloser.Close()
+	t.once.Do(t.release)
+	return err
+}
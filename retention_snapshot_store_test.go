@@ -0,0 +1,124 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+package raftmod
+
+import (
+	"fmt"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRetentionSnapshotStore(t *testing.T) {
+
+	dir, err := os.MkdirTemp(os.TempDir(), "raftmodtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	base, err := NewFileSnapshotStore(dir, math.MaxInt32, nil)
+	require.NoError(t, err)
+
+	store, err := NewRetentionSnapshotStore(base, SnapshotRetention{RetainCount: 2}, zap.NewNop())
+	require.NoError(t, err)
+
+	create := func(index uint64) string {
+		sink, err := store.Create(raft.SnapshotVersionMax, index, 1, raft.Configuration{}, 0, nil)
+		require.NoError(t, err)
+		_, err = sink.Write([]byte("snapshot"))
+		require.NoError(t, err)
+		require.NoError(t, sink.Close())
+		return sink.ID()
+	}
+
+	pinned := create(1)
+	store.Pin(pinned)
+	restoring := create(2)
+	_, reader, err := store.Open(restoring)
+	require.NoError(t, err)
+
+	create(3)
+	create(4)
+	latest := create(5)
+
+	list, err := store.List()
+	require.NoError(t, err)
+	require.Equal(t, 4, len(list))
+	require.Equal(t, latest, list[0].ID)
+	require.Equal(t, restoring, list[2].ID)
+	require.Equal(t, pinned, list[3].ID)
+
+	require.NoError(t, reader.Close())
+	store.Unpin(pinned)
+
+	deleted, err := store.Prune()
+	require.NoError(t, err)
+	require.Equal(t, []string{restoring, pinned}, deleted)
+
+	list, err = store.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(list))
+
+}
+
+func TestRetentionPolicies(t *testing.T) {
+
+	now := time.Date(2023, 3, 10, 12, 0, 0, 0, time.Local)
+
+	// two snapshots per day for 10 days, each 100 bytes
+	var list []*raft.SnapshotMeta
+	for i := 0; i < 20; i++ {
+		created := now.Add(-time.Duration(i) * 12 * time.Hour)
+		list = append(list, &raft.SnapshotMeta{
+			ID:    fmt.Sprintf("1-%d-%d", 100-i, created.UnixNano()/int64(time.Millisecond)),
+			Index: uint64(100 - i),
+			Term:  1,
+			Size:  100,
+		})
+	}
+
+	kept := func(policy SnapshotRetention, pinned ...string) []uint64 {
+		store := &implRetentionSnapshotStore{policy: policy, pinned: make(map[string]bool), opened: make(map[string]int)}
+		for _, id := range pinned {
+			store.pinned[id] = true
+		}
+		expired := make(map[string]bool)
+		for _, meta := range store.selectExpired(list, now) {
+			expired[meta.ID] = true
+		}
+		var result []uint64
+		for _, meta := range list {
+			if !expired[meta.ID] {
+				result = append(result, meta.Index)
+			}
+		}
+		return result
+	}
+
+	require.Equal(t, []uint64{100, 99, 98}, kept(SnapshotRetention{RetainCount: 3}))
+
+	// latest of each day for 3 days, today at 12:00 and 00:00, yesterday at 12:00, day before at 12:00
+	require.Equal(t, []uint64{100, 98, 96}, kept(SnapshotRetention{RetainCount: 1, DailyDays: 3}))
+
+	require.Equal(t, []uint64{100, 99, 98}, kept(SnapshotRetention{RetainCount: 10, MaxAge: 25 * time.Hour}))
+
+	require.Equal(t, []uint64{100, 99, 98, 97}, kept(SnapshotRetention{RetainCount: 10, MaxSize: 450}))
+
+	// latest and pinned survive any policy
+	require.Equal(t, []uint64{100, 81}, kept(SnapshotRetention{RetainCount: 1, MaxAge: time.Nanosecond, MaxSize: 1}, list[19].ID))
+
+}
@@ -0,0 +1,276 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"io"
+	"time"
+)
+
+/**
+SNAPSHOT ARCHIVE
+
+Portable snapshot that could be moved between clusters:
+	magic        [4]byte  "RMSA"
+	version      uint8
+	infoLen      uint32
+	info         JSON of SnapshotArchiveInfo
+	payload      FSM state, encrypted by the archive key if 'encrypted' is set
+*/
+
+var archiveMagic = []byte("RMSA")
+
+const (
+	archiveVersion = 1
+
+	maxArchiveInfoSize = 16 * 1024 * 1024
+)
+
+var ErrNoSnapshots = errors.New("no snapshots in the store")
+
+type SnapshotArchiveInfo struct {
+	Version   int               `json:"version"`
+	Meta      raft.SnapshotMeta `json:"meta"`
+	Encrypted bool              `json:"encrypted"`
+	Created   time.Time         `json:"created"`
+}
+
+type archiveOptions struct {
+	key                string
+	kdf                string
+	configuration      *raft.Configuration
+	configurationIndex uint64
+}
+
+type ArchiveOption func(*archiveOptions)
+
+/**
+Encrypts archive payload on export and decrypts on import.
+ */
+func WithArchiveKey(token, kdf string) ArchiveOption {
+	return func(t *archiveOptions) {
+		t.key = token
+		t.kdf = kdf
+	}
+}
+
+/**
+Replaces cluster configuration of the imported snapshot, needed to seed a new cluster with different nodes.
+Zero configurationIndex means the index of the imported snapshot.
+ */
+func WithArchiveConfiguration(configuration raft.Configuration, configurationIndex uint64) ArchiveOption {
+	return func(t *archiveOptions) {
+		t.configuration = &configuration
+		t.configurationIndex = configurationIndex
+	}
+}
+
+func (t *archiveOptions) encryption() (*implEncryptedSnapshotStore, error) {
+	store, err := NewEncryptedSnapshotStore(nil, t.key, WithKDF(t.kdf, ""))
+	if err != nil {
+		return nil, err
+	}
+	return store.(*implEncryptedSnapshotStore), nil
+}
+
+/**
+Writes the snapshot in to the archive, empty id means the latest snapshot.
+The store must be able to decrypt snapshots, so it is usually the same stack of stores that raft uses.
+ */
+func ExportSnapshot(store raft.SnapshotStore, id string, w io.Writer, options ...ArchiveOption) (*SnapshotArchiveInfo, error) {
+
+	opts := &archiveOptions{}
+	for _, opt := range options {
+		opt(opts)
+	}
+
+	if id == "" {
+		list, err := store.List()
+		if err != nil {
+			return nil, err
+		}
+		if len(list) == 0 {
+			return nil, ErrNoSnapshots
+		}
+		id = list[0].ID
+	}
+
+	meta, source, err := store.Open(id)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+
+	info := &SnapshotArchiveInfo{
+		Version:   archiveVersion,
+		Meta:      *meta,
+		Encrypted: opts.key != "",
+		Created:   time.Now().UTC(),
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+
+	var header bytes.Buffer
+	header.Write(archiveMagic)
+	header.WriteByte(archiveVersion)
+	binary.Write(&header, binary.BigEndian, uint32(len(data)))
+	header.Write(data)
+	if err := writeFull(w, header.Bytes()); err != nil {
+		return nil, err
+	}
+
+	sink := raft.SnapshotSink(&writerSink{Writer: w, id: meta.ID})
+	if info.Encrypted {
+		enc, err := opts.encryption()
+		if err != nil {
+			return nil, err
+		}
+		sink, err = enc.newSink(sink, meta.Index, meta.Term)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := io.Copy(sink, source); err != nil {
+		sink.Cancel()
+		return nil, err
+	}
+	if err := sink.Close(); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+/**
+Reads archive header without the payload.
+ */
+func ReadSnapshotArchiveInfo(r io.Reader) (*SnapshotArchiveInfo, error) {
+
+	header := make([]byte, len(archiveMagic)+5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.Errorf("snapshot archive header read error, %v", err)
+	}
+	if !bytes.Equal(header[:len(archiveMagic)], archiveMagic) {
+		return nil, errors.New("not a snapshot archive")
+	}
+	if header[len(archiveMagic)] != archiveVersion {
+		return nil, errors.Errorf("unsupported snapshot archive version %d", header[len(archiveMagic)])
+	}
+
+	size := binary.BigEndian.Uint32(header[len(archiveMagic)+1:])
+	if size > maxArchiveInfoSize {
+		return nil, errors.Errorf("snapshot archive info is too large, %d bytes", size)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, errors.Errorf("snapshot archive info read error, %v", err)
+	}
+
+	info := new(SnapshotArchiveInfo)
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, errors.Errorf("snapshot archive info error, %v", err)
+	}
+	return info, nil
+}
+
+/**
+Creates the snapshot from the archive in the store, so raft restores it on boot.
+Fails if the store already has snapshots.
+ */
+func ImportSnapshot(store raft.SnapshotStore, r io.Reader, options ...ArchiveOption) (*raft.SnapshotMeta, error) {
+
+	opts := &archiveOptions{}
+	for _, opt := range options {
+		opt(opts)
+	}
+
+	list, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	if len(list) > 0 {
+		return nil, errors.Errorf("snapshot store is not empty, has %d snapshots", len(list))
+	}
+
+	info, err := ReadSnapshotArchiveInfo(r)
+	if err != nil {
+		return nil, err
+	}
+	meta := info.Meta
+
+	payload := io.NopCloser(r)
+	if info.Encrypted {
+		if opts.key == "" {
+			return nil, errors.New("snapshot archive is encrypted, key is required")
+		}
+		enc, err := opts.encryption()
+		if err != nil {
+			return nil, err
+		}
+		payload, err = enc.openStream(&meta, meta.ID, payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	configuration, configurationIndex := meta.Configuration, meta.ConfigurationIndex
+	if opts.configuration != nil {
+		configuration, configurationIndex = *opts.configuration, opts.configurationIndex
+		if configurationIndex == 0 {
+			configurationIndex = meta.Index
+		}
+	}
+
+	sink, err := store.Create(meta.Version, meta.Index, meta.Term, configuration, configurationIndex, archivePeerEncoder{})
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := io.Copy(sink, payload)
+	if err != nil {
+		sink.Cancel()
+		return nil, err
+	}
+	if err := sink.Close(); err != nil {
+		return nil, err
+	}
+
+	meta.ID = sink.ID()
+	meta.Size = n
+	meta.Configuration = configuration
+	meta.ConfigurationIndex = configurationIndex
+	return &meta, nil
+}
+
+/**
+Encodes deprecated peers of the snapshot metadata the same way as raft.NetworkTransport.
+ */
+type archivePeerEncoder struct {
+	raft.Transport
+}
+
+func (t archivePeerEncoder) EncodePeer(id raft.ServerID, addr raft.ServerAddress) []byte {
+	return []byte(addr)
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+package raftmod
+
+import (
+	"bytes"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestSnapshotArchive(t *testing.T) {
+
+	dir, err := os.MkdirTemp(os.TempDir(), "raftmodtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	source, err := NewFileSnapshotStore(dir+"/source", 5, nil)
+	require.NoError(t, err)
+
+	source, err = NewEncryptedSnapshotStore(source, "123", WithKDF("sha256", ""))
+	require.NoError(t, err)
+
+	content := bytes.Repeat([]byte("snapshot"), 10000)
+	configuration := raft.Configuration{Servers: []raft.Server{{Suffrage: raft.Voter, ID: "node1", Address: "127.0.0.1:7000"}}}
+
+	for i := 1; i <= 2; i++ {
+		sink, err := source.Create(raft.SnapshotVersionMax, uint64(100*i), 1, configuration, 1, &raft.InmemTransport{})
+		require.NoError(t, err)
+		_, err = sink.Write(content[:len(content)/i])
+		require.NoError(t, err)
+		require.NoError(t, sink.Close())
+	}
+
+	var archive bytes.Buffer
+	info, err := ExportSnapshot(source, "", &archive, WithArchiveKey("archive", "sha256"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(200), info.Meta.Index)
+	require.True(t, info.Encrypted)
+	require.False(t, bytes.Contains(archive.Bytes(), content[:64]))
+
+	header, err := ReadSnapshotArchiveInfo(bytes.NewReader(archive.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, info.Meta.ID, header.Meta.ID)
+
+	// different key and compression in the new cluster
+	target, err := NewFileSnapshotStore(dir+"/target", 5, nil)
+	require.NoError(t, err)
+	target, err = NewEncryptedSnapshotStore(target, "456", WithKDF("sha256", ""))
+	require.NoError(t, err)
+	target = NewCompressedSnapshotStore(target, CompressionZstd)
+
+	_, err = ImportSnapshot(target, bytes.NewReader(archive.Bytes()))
+	require.Error(t, err)
+
+	peers := raft.Configuration{Servers: []raft.Server{{Suffrage: raft.Voter, ID: "node2", Address: "10.0.0.2:7000"}}}
+	meta, err := ImportSnapshot(target, bytes.NewReader(archive.Bytes()), WithArchiveKey("archive", "sha256"), WithArchiveConfiguration(peers, 0))
+	require.NoError(t, err)
+	require.Equal(t, uint64(200), meta.Index)
+	require.Equal(t, int64(len(content)/2), meta.Size)
+
+	restored, reader, err := target.Open(meta.ID)
+	require.NoError(t, err)
+	require.Equal(t, peers, restored.Configuration)
+	require.Equal(t, uint64(200), restored.ConfigurationIndex)
+	actual, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(content[:len(content)/2], actual))
+	require.NoError(t, reader.Close())
+
+	// only empty store
+	_, err = ImportSnapshot(target, bytes.NewReader(archive.Bytes()), WithArchiveKey("archive", "sha256"))
+	require.Error(t, err)
+
+	// plain archive of the named snapshot
+	archive.Reset()
+	list, err := source.List()
+	require.NoError(t, err)
+	info, err = ExportSnapshot(source, list[1].ID, &archive)
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), info.Meta.Index)
+	require.False(t, info.Encrypted)
+
+	plain, err := NewFileSnapshotStore(dir+"/plain", 5, nil)
+	require.NoError(t, err)
+	meta, err = ImportSnapshot(plain, &archive)
+	require.NoError(t, err)
+	require.Equal(t, configuration, meta.Configuration)
+	require.Equal(t, int64(len(content)), meta.Size)
+}
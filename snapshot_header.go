@@ -0,0 +1,191 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+	"math"
+)
+
+/**
+SNAPSHOT ENCRYPTION HEADER
+
+Snapshots written by the legacy CTR encrypter start with random IV and have no header,
+so the magic is used to distinguish formats on read.
+
+Version 1, session key is SHA-256 of the token:
+	magic        [4]byte  "RMSE"
+	version      uint8
+	cipher       uint8
+	chunkSize    uint32
+	noncePrefix  [7]byte
+
+Version 2, session key is derived by HKDF from the master key:
+	...version 1 fields
+	kdf          uint8
+	salt         [32]byte
+
+Version 3, master key is selected from the keyring by ID:
+	...version 2 fields
+	keyIdLen     uint8
+	keyId        [keyIdLen]byte
+*/
+
+var snapshotMagic = []byte("RMSE")
+
+const (
+	snapshotVersionAEAD = 1
+	snapshotVersionHKDF = 2
+	snapshotVersionKeyID = 3
+
+	noncePrefixSize = 7
+
+	// the header is not authenticated before the chunk buffer is allocated
+	maxSnapshotChunkSize = 16 * 1024 * 1024
+)
+
+type SnapshotCipher uint8
+
+const (
+	CipherAESGCM SnapshotCipher = iota + 1
+	CipherChaCha20Poly1305
+)
+
+func (t SnapshotCipher) String() string {
+	switch t {
+	case CipherAESGCM:
+		return "aes-gcm"
+	case CipherChaCha20Poly1305:
+		return "chacha20-poly1305"
+	default:
+		return "unknown"
+	}
+}
+
+func ParseSnapshotCipher(s string) (SnapshotCipher, error) {
+	switch s {
+	case "aes-gcm", "":
+		return CipherAESGCM, nil
+	case "chacha20-poly1305":
+		return CipherChaCha20Poly1305, nil
+	default:
+		return 0, errors.Errorf("unknown snapshot cipher '%s'", s)
+	}
+}
+
+type snapshotHeader struct {
+	version      uint8
+	cipher       SnapshotCipher
+	chunkSize    uint32
+	noncePrefix  []byte
+	kdf          SnapshotKDF
+	salt         []byte
+	keyId        string
+}
+
+func newSnapshotHeader(cipher SnapshotCipher, chunkSize int, kdf SnapshotKDF, keyId string) (*snapshotHeader, error) {
+	if chunkSize <= 0 || chunkSize > maxSnapshotChunkSize {
+		return nil, errors.Errorf("invalid chunk size %d, expected up to %d", chunkSize, maxSnapshotChunkSize)
+	}
+	if len(keyId) > math.MaxUint8 {
+		return nil, errors.Errorf("snapshot key ID '%s' is longer than %d bytes", keyId, math.MaxUint8)
+	}
+	h := &snapshotHeader{
+		version:     snapshotVersionKeyID,
+		cipher:      cipher,
+		chunkSize:   uint32(chunkSize),
+		noncePrefix: make([]byte, noncePrefixSize),
+		kdf:         kdf,
+		salt:        make([]byte, snapshotSaltSize),
+		keyId:       keyId,
+	}
+	if _, err := rand.Read(h.noncePrefix); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(h.salt); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (t *snapshotHeader) marshal() []byte {
+	var buf bytes.Buffer
+	buf.Write(snapshotMagic)
+	buf.WriteByte(t.version)
+	buf.WriteByte(byte(t.cipher))
+	binary.Write(&buf, binary.BigEndian, t.chunkSize)
+	buf.Write(t.noncePrefix)
+	if t.version >= snapshotVersionHKDF {
+		buf.WriteByte(byte(t.kdf))
+		buf.Write(t.salt)
+	}
+	if t.version >= snapshotVersionKeyID {
+		buf.WriteByte(byte(len(t.keyId)))
+		buf.WriteString(t.keyId)
+	}
+	return buf.Bytes()
+}
+
+/**
+Reads header after the magic and version, returns raw header bytes used as additional data.
+ */
+func readSnapshotHeader(version uint8, source io.Reader) (*snapshotHeader, []byte, error) {
+
+	size := 1 + 4 + noncePrefixSize
+	switch version {
+	case snapshotVersionAEAD:
+	case snapshotVersionHKDF:
+		size += 1 + snapshotSaltSize
+	case snapshotVersionKeyID:
+		size += 1 + snapshotSaltSize + 1
+	default:
+		return nil, nil, errors.Errorf("unsupported snapshot encryption version %d", version)
+	}
+
+	rest := make([]byte, size)
+	if _, err := io.ReadFull(source, rest); err != nil {
+		return nil, nil, errors.Errorf("snapshot header read error, %v", err)
+	}
+
+	h := &snapshotHeader{
+		version:     version,
+		cipher:      SnapshotCipher(rest[0]),
+		chunkSize:   binary.BigEndian.Uint32(rest[1:5]),
+		noncePrefix: rest[5:5+noncePrefixSize],
+	}
+
+	if h.chunkSize == 0 || h.chunkSize > maxSnapshotChunkSize {
+		return nil, nil, errors.Wrapf(ErrSnapshotCorrupted, "invalid chunk size %d", h.chunkSize)
+	}
+
+	if version >= snapshotVersionHKDF {
+		h.kdf = SnapshotKDF(rest[5+noncePrefixSize])
+		h.salt = rest[6+noncePrefixSize:6+noncePrefixSize+snapshotSaltSize]
+	}
+
+	if version >= snapshotVersionKeyID {
+		keyId := make([]byte, rest[size-1])
+		if _, err := io.ReadFull(source, keyId); err != nil {
+			return nil, nil, errors.Errorf("snapshot header read error, %v", err)
+		}
+		h.keyId = string(keyId)
+	}
+
+	return h, h.marshal(), nil
+}
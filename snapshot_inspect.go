@@ -0,0 +1,259 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"io"
+	"reflect"
+)
+
+const (
+	SnapshotStatusOK      = "ok"
+	SnapshotStatusCorrupt = "corrupt"
+	SnapshotStatusError   = "error"
+)
+
+/**
+Description of the stored snapshot, formats are detected by headers written by the wrapping stores.
+Legacy CTR snapshots have no header, so they are reported as 'ctr' only if the store has the key.
+ */
+type SnapshotInspection struct {
+	ID                 string   `json:"id"`
+	Index              uint64   `json:"index"`
+	Term               uint64   `json:"term"`
+	Size               int64    `json:"size"`
+	PayloadSize        int64    `json:"payloadSize"`
+	ConfigurationIndex uint64   `json:"configurationIndex"`
+	Voters             []string `json:"voters"`
+	NonVoters          []string `json:"nonVoters"`
+	Digest             string   `json:"digest"`
+	Encryption         string   `json:"encryption"`
+	EncryptionVersion  int      `json:"encryptionVersion,omitempty"`
+	KDF                string   `json:"kdf,omitempty"`
+	KeyID              string   `json:"keyId,omitempty"`
+	Compression        string   `json:"compression"`
+	Status             string   `json:"status"`
+	Error              string   `json:"error,omitempty"`
+}
+
+type inspectOptions struct {
+	id   string
+	dump io.Writer
+}
+
+type InspectOption func(*inspectOptions)
+
+/**
+Inspects only the snapshot with the ID.
+ */
+func WithInspectID(id string) InspectOption {
+	return func(t *inspectOptions) {
+		t.id = id
+	}
+}
+
+/**
+Writes decrypted and decompressed FSM payload of the inspected snapshot, requires WithInspectID.
+ */
+func WithInspectDump(w io.Writer) InspectOption {
+	return func(t *inspectOptions) {
+		t.dump = w
+	}
+}
+
+/**
+Returns the first store of the stack implementing the interface, like EncryptedSnapshotStoreClass for key management
+of the store wrapped by compression.
+ */
+func FindSnapshotStore(store raft.SnapshotStore, iface reflect.Type) (raft.SnapshotStore, bool) {
+	for store != nil {
+		if reflect.TypeOf(store).Implements(iface) {
+			return store, true
+		}
+		wrapper, ok := store.(SnapshotStoreWrapper)
+		if !ok {
+			break
+		}
+		store = wrapper.Unwrap()
+	}
+	return nil, false
+}
+
+/**
+Returns the base store that holds stored bytes and the encryption store of the stack if any.
+ */
+func unwrapSnapshotStore(store raft.SnapshotStore) (raft.SnapshotStore, *implEncryptedSnapshotStore) {
+	var enc *implEncryptedSnapshotStore
+	for {
+		if e, ok := store.(*implEncryptedSnapshotStore); ok && enc == nil {
+			enc = e
+		}
+		wrapper, ok := store.(SnapshotStoreWrapper)
+		if !ok || wrapper.Unwrap() == nil {
+			return store, enc
+		}
+		store = wrapper.Unwrap()
+	}
+}
+
+/**
+Reads every snapshot of the configured store stack, newest first, and checks integrity of the whole stream.
+Snapshots are read from the base store, so corrupt snapshots are reported but not quarantined.
+ */
+func InspectSnapshots(store raft.SnapshotStore, options ...InspectOption) ([]*SnapshotInspection, error) {
+
+	opts := &inspectOptions{}
+	for _, opt := range options {
+		opt(opts)
+	}
+
+	if opts.dump != nil && opts.id == "" {
+		return nil, errors.New("snapshot ID is required to dump payload")
+	}
+
+	base, enc := unwrapSnapshotStore(store)
+
+	list, err := base.List()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*SnapshotInspection{}
+	for _, meta := range list {
+		if opts.id != "" && meta.ID != opts.id {
+			continue
+		}
+		info := newSnapshotInspection(meta)
+		dump := io.Discard
+		if opts.dump != nil {
+			dump = opts.dump
+		}
+		if err := info.read(base, enc, meta, dump); err != nil {
+			info.Error = err.Error()
+			if errors.Is(err, ErrSnapshotDigestMismatch) || errors.Is(err, ErrSnapshotTruncated) {
+				info.Status = SnapshotStatusCorrupt
+			} else {
+				info.Status = SnapshotStatusError
+			}
+		}
+		result = append(result, info)
+	}
+
+	if opts.id != "" && len(result) == 0 {
+		return nil, errors.Wrapf(ErrSnapshotNotFound, "snapshot '%s'", opts.id)
+	}
+	return result, nil
+}
+
+func newSnapshotInspection(meta *raft.SnapshotMeta) *SnapshotInspection {
+	info := &SnapshotInspection{
+		ID:                 meta.ID,
+		Index:              meta.Index,
+		Term:               meta.Term,
+		Size:               meta.Size,
+		PayloadSize:        -1,
+		ConfigurationIndex: meta.ConfigurationIndex,
+		Voters:             []string{},
+		NonVoters:          []string{},
+		Digest:             "none",
+		Encryption:         "none",
+		Compression:        "unknown",
+		Status:             SnapshotStatusOK,
+	}
+	for _, server := range meta.Configuration.Servers {
+		entry := fmt.Sprintf("%s=%s", server.ID, server.Address)
+		if server.Suffrage == raft.Voter {
+			info.Voters = append(info.Voters, entry)
+		} else {
+			info.NonVoters = append(info.NonVoters, entry)
+		}
+	}
+	return info
+}
+
+/**
+Unwraps the stream in the same order as the factory stack: digest, encryption, compression.
+ */
+func (t *SnapshotInspection) read(base raft.SnapshotStore, enc *implEncryptedSnapshotStore, meta *raft.SnapshotMeta, dump io.Writer) error {
+
+	_, source, err := base.Open(meta.ID)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	payload, _, err := openDigestStream(meta.Size, source)
+	if err != nil {
+		return err
+	}
+	if _, ok := payload.(*implDigestReader); ok {
+		t.Digest = "sha256"
+	}
+
+	buffered := bufio.NewReader(payload)
+	stream := io.NopCloser(buffered)
+
+	magic, _ := buffered.Peek(len(snapshotMagic))
+	if bytes.Equal(magic, snapshotMagic) {
+		header, ad, body, err := readEncryptionHeader(stream)
+		if err != nil {
+			return err
+		}
+		t.Encryption = header.cipher.String()
+		t.EncryptionVersion = int(header.version)
+		if header.version >= snapshotVersionHKDF {
+			t.KDF = header.kdf.String()
+		}
+		t.KeyID = header.keyId
+		if enc == nil {
+			// digest is still checked at the end of the stream
+			_, err = io.Copy(io.Discard, body)
+			return err
+		}
+		stream, err = enc.decryptStream(header, ad, body, meta, meta.ID)
+		if err != nil {
+			return err
+		}
+	} else if enc != nil {
+		t.Encryption = "ctr"
+		stream, err = enc.decryptStream(nil, nil, stream, meta, meta.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	buffered = bufio.NewReader(stream)
+	t.Compression = CompressionNone.String()
+	if magic, _ := buffered.Peek(len(compressionMagic) + 2); len(magic) == len(compressionMagic)+2 && bytes.Equal(magic[:len(compressionMagic)], compressionMagic) {
+		t.Compression = SnapshotCompression(magic[len(compressionMagic)+1]).String()
+	}
+
+	decompressed, err := openCompressedStream(&prefixedReadCloser{Reader: buffered, Closer: stream})
+	if err != nil {
+		return err
+	}
+	defer decompressed.Close()
+
+	t.PayloadSize, err = io.Copy(dump, decompressed)
+	if err != nil {
+		t.PayloadSize = -1
+	}
+	return err
+}
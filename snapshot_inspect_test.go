@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+package raftmod
+
+import (
+	"bytes"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInspectSnapshots(t *testing.T) {
+
+	dir, err := os.MkdirTemp(os.TempDir(), "raftmodtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	base, err := NewFileSnapshotStore(dir, 5, nil)
+	require.NoError(t, err)
+
+	store, err := NewEncryptedSnapshotStore(NewVerifyingSnapshotStore(base, zap.NewNop()), "123", WithKDF("sha256", ""), WithKeyID("k1"))
+	require.NoError(t, err)
+	store = NewCompressedSnapshotStore(store, CompressionZstd)
+
+	configuration := raft.Configuration{Servers: []raft.Server{
+		{Suffrage: raft.Voter, ID: "node1", Address: "10.0.0.1:7000"},
+		{Suffrage: raft.Nonvoter, ID: "node2", Address: "10.0.0.2:7000"},
+	}}
+
+	content := bytes.Repeat([]byte("snapshot"), 1000)
+	var ids []string
+	for i := 1; i <= 2; i++ {
+		sink, err := store.Create(raft.SnapshotVersionMax, uint64(i), 1, configuration, 1, &raft.InmemTransport{})
+		require.NoError(t, err)
+		_, err = sink.Write(content)
+		require.NoError(t, err)
+		require.NoError(t, sink.Close())
+		ids = append(ids, sink.ID())
+	}
+
+	list, err := InspectSnapshots(store)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(list))
+	info := list[0]
+	require.Equal(t, ids[1], info.ID)
+	require.Equal(t, SnapshotStatusOK, info.Status, info.Error)
+	require.Equal(t, int64(len(content)), info.PayloadSize)
+	require.Equal(t, []string{"node1=10.0.0.1:7000"}, info.Voters)
+	require.Equal(t, []string{"node2=10.0.0.2:7000"}, info.NonVoters)
+	require.Equal(t, "sha256", info.Digest)
+	require.Equal(t, "aes-gcm", info.Encryption)
+	require.Equal(t, "sha256", info.KDF)
+	require.Equal(t, "k1", info.KeyID)
+	require.Equal(t, "zstd", info.Compression)
+
+	// without the key
+	list, err = InspectSnapshots(base)
+	require.NoError(t, err)
+	require.Equal(t, SnapshotStatusOK, list[0].Status, list[0].Error)
+	require.Equal(t, "aes-gcm", list[0].Encryption)
+	require.Equal(t, "unknown", list[0].Compression)
+	require.Equal(t, int64(-1), list[0].PayloadSize)
+
+	var dump bytes.Buffer
+	_, err = InspectSnapshots(store, WithInspectID(ids[0]), WithInspectDump(&dump))
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(content, dump.Bytes()))
+
+	state := filepath.Join(dir, fileSnapshotsDir, ids[0], fileSnapshotState)
+	data, err := os.ReadFile(state)
+	require.NoError(t, err)
+	data[len(data)/2] ^= 0xff
+	require.NoError(t, os.WriteFile(state, data, 0644))
+
+	list, err = InspectSnapshots(store, WithInspectID(ids[0]))
+	require.NoError(t, err)
+	require.Equal(t, SnapshotStatusCorrupt, list[0].Status)
+
+	_, err = InspectSnapshots(store, WithInspectID("unknown"))
+	require.Error(t, err)
+
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+	"io"
+)
+
+/**
+KEY DERIVATION
+
+Operator token is turned in to the master key by password-based KDF,
+the session key of each snapshot is derived from the master key by HKDF-SHA256
+with random salt from the header and info bound to index, term and snapshot ID.
+*/
+
+type SnapshotKDF uint8
+
+const (
+	KDFSHA256 SnapshotKDF = iota
+	KDFScrypt
+	KDFArgon2id
+)
+
+const (
+	sessionKeySize = 32
+	snapshotSaltSize = 32
+
+	DefaultKDFSalt = "raftmod-snapshot"
+)
+
+var sessionKeyInfo = []byte("raftmod snapshot session key")
+
+func (t SnapshotKDF) String() string {
+	switch t {
+	case KDFSHA256:
+		return "sha256"
+	case KDFScrypt:
+		return "scrypt"
+	case KDFArgon2id:
+		return "argon2id"
+	default:
+		return "unknown"
+	}
+}
+
+func ParseSnapshotKDF(s string) (SnapshotKDF, error) {
+	switch s {
+	case "sha256":
+		return KDFSHA256, nil
+	case "scrypt", "":
+		return KDFScrypt, nil
+	case "argon2id", "argon2":
+		return KDFArgon2id, nil
+	default:
+		return 0, errors.Errorf("unknown snapshot kdf '%s'", s)
+	}
+}
+
+/**
+Parameters are fixed for each KDF, because only KDF identifier is stored in the snapshot header.
+ */
+func deriveMasterKey(kdf SnapshotKDF, token, salt []byte) ([]byte, error) {
+	switch kdf {
+	case KDFSHA256:
+		h := sha256.New()
+		h.Write(token)
+		return h.Sum(nil), nil
+	case KDFScrypt:
+		return scrypt.Key(token, salt, 1<<15, 8, 1, sessionKeySize)
+	case KDFArgon2id:
+		return argon2.IDKey(token, salt, 1, 64*1024, 4, sessionKeySize), nil
+	default:
+		return nil, errors.Errorf("unsupported snapshot kdf %d", kdf)
+	}
+}
+
+func deriveSessionKey(masterKey, salt []byte, index, term uint64, id string) ([]byte, error) {
+	n := len(sessionKeyInfo)
+	info := make([]byte, n+16, n+16+len(id))
+	copy(info, sessionKeyInfo)
+	binary.BigEndian.PutUint64(info[n:], index)
+	binary.BigEndian.PutUint64(info[n+8:], term)
+	info = append(info, id...)
+	key := make([]byte, sessionKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, masterKey, salt, info), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
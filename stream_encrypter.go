@@ -21,20 +21,42 @@ import (
 	"github.com/hashicorp/raft"
 	"github.com/pkg/errors"
 	"io"
+	"sync"
 )
 
 /**
 STREAM ENCRYPTER
 
-Warning: fast but modifies stream data
+Encrypts through the pooled buffer, so the caller's data is never modified.
 */
 
+var streamBufferSize = 32 * 1024
+
+var streamBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, streamBufferSize)
+		return &buf
+	},
+}
+
 type implStreamEncrypter struct {
-	sink   raft.SnapshotSink
-	stream cipher.Stream
+	sink    raft.SnapshotSink
+	stream  cipher.Stream
+	inPlace bool
 }
 
 func StreamEncrypter(sessionKey []byte, sink raft.SnapshotSink) (raft.SnapshotSink, error) {
+	return newStreamEncrypter(sessionKey, sink, false)
+}
+
+/**
+Warning: fast but modifies stream data, use only if the caller never reuses buffers passed to Write.
+ */
+func InPlaceStreamEncrypter(sessionKey []byte, sink raft.SnapshotSink) (raft.SnapshotSink, error) {
+	return newStreamEncrypter(sessionKey, sink, true)
+}
+
+func newStreamEncrypter(sessionKey []byte, sink raft.SnapshotSink, inPlace bool) (raft.SnapshotSink, error) {
 	block, err := aes.NewCipher(sessionKey)
 	if err != nil {
 		return nil, err
@@ -59,12 +81,38 @@ func StreamEncrypter(sessionKey []byte, sink raft.SnapshotSink) (raft.SnapshotSi
 	return &implStreamEncrypter{
 		sink: sink,
 		stream: stream,
+		inPlace: inPlace,
 	}, nil
 }
 
 func (t *implStreamEncrypter) Write(p []byte) (int, error) {
-	t.stream.XORKeyStream(p, p)
-	return t.sink.Write(p)
+	if t.inPlace {
+		t.stream.XORKeyStream(p, p)
+		return t.sink.Write(p)
+	}
+
+	bufPtr := streamBufferPool.Get().(*[]byte)
+	defer streamBufferPool.Put(bufPtr)
+	buf := *bufPtr
+
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > len(buf) {
+			n = len(buf)
+		}
+		t.stream.XORKeyStream(buf[:n], p[:n])
+		m, err := t.sink.Write(buf[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		if m != n {
+			return written, io.ErrShortWrite
+		}
+		p = p[n:]
+	}
+	return written, nil
 }
 
 func (t *implStreamEncrypter) Close() error {
@@ -0,0 +1,110 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+)
+
+func TestStreamEncrypter(t *testing.T) {
+
+	sessionKey := sha256.Sum256([]byte("123"))
+
+	content := make([]byte, streamBufferSize * 2 + 100)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	buf := append([]byte{}, content...)
+
+	sink := &bufferSink{}
+	encrypter, err := StreamEncrypter(sessionKey[:], sink)
+	require.NoError(t, err)
+
+	n, err := encrypter.Write(buf)
+	require.NoError(t, err)
+	require.Equal(t, len(buf), n)
+	require.NoError(t, encrypter.Close())
+
+	// does not modify buf during encryption
+	require.True(t, bytes.Equal(content, buf))
+
+	reader, err := StreamDecrypter(sessionKey[:], io.NopCloser(bytes.NewReader(sink.Bytes())))
+	require.NoError(t, err)
+	actual, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(content, actual))
+
+	// in-place mode encrypts the caller's buffer
+	encrypter, err = InPlaceStreamEncrypter(sessionKey[:], &bufferSink{})
+	require.NoError(t, err)
+	_, err = encrypter.Write(buf)
+	require.NoError(t, err)
+	require.False(t, bytes.Equal(content, buf))
+
+}
+
+type discardSink struct {
+}
+
+func (t discardSink) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (t discardSink) ID() string {
+	return "discard"
+}
+
+func (t discardSink) Cancel() error {
+	return nil
+}
+
+func (t discardSink) Close() error {
+	return nil
+}
+
+func benchmarkStreamEncrypter(b *testing.B, newEncrypter func([]byte, raft.SnapshotSink) (raft.SnapshotSink, error), size int) {
+	sessionKey := sha256.Sum256([]byte("123"))
+	encrypter, err := newEncrypter(sessionKey[:], discardSink{})
+	require.NoError(b, err)
+	buf := make([]byte, size)
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := encrypter.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStreamEncrypter4K(b *testing.B) {
+	benchmarkStreamEncrypter(b, StreamEncrypter, 4 * 1024)
+}
+
+func BenchmarkStreamEncrypterInPlace4K(b *testing.B) {
+	benchmarkStreamEncrypter(b, InPlaceStreamEncrypter, 4 * 1024)
+}
+
+func BenchmarkStreamEncrypter1M(b *testing.B) {
+	benchmarkStreamEncrypter(b, StreamEncrypter, 1024 * 1024)
+}
+
+func BenchmarkStreamEncrypterInPlace1M(b *testing.B) {
+	benchmarkStreamEncrypter(b, InPlaceStreamEncrypter, 1024 * 1024)
+}
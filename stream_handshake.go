@@ -0,0 +1,183 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+/**
+CLUSTER SECRET HANDSHAKE
+
+Runs on every raft connection before NetworkTransport uses it, both sides prove knowledge of 'raft-server.cluster-secret':
+	dialer    -> magic "RMSH", version uint8, dialer nonce [32]byte
+	acceptor  -> acceptor nonce [32]byte, HMAC-SHA256(secret, "acceptor" | dialer nonce | acceptor nonce)
+	dialer    -> HMAC-SHA256(secret, "dialer" | dialer nonce | acceptor nonce)
+	acceptor  -> status uint8, 1 if accepted
+*/
+
+var handshakeMagic = []byte("RMSH")
+
+const (
+	handshakeVersion   = 1
+	handshakeNonceSize = 32
+	handshakeAccepted  = 1
+)
+
+var handshakeTimeout = 10 * time.Second
+
+var ErrHandshakeFailed = errors.New("raft transport handshake failed")
+
+type streamHandshake struct {
+	secret []byte
+	log    *zap.Logger
+}
+
+func handshakeMAC(secret []byte, role string, dialerNonce, acceptorNonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(role))
+	mac.Write(dialerNonce)
+	mac.Write(acceptorNonce)
+	return mac.Sum(nil)
+}
+
+/**
+Runs the dialer side of the handshake within the deadline.
+ */
+func (t *streamHandshake) dial(conn net.Conn, deadline time.Time) error {
+
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	dialerNonce := make([]byte, handshakeNonceSize)
+	if _, err := rand.Read(dialerNonce); err != nil {
+		return err
+	}
+
+	hello := append(append(append([]byte{}, handshakeMagic...), handshakeVersion), dialerNonce...)
+	if err := writeFull(conn, hello); err != nil {
+		return err
+	}
+
+	challenge := make([]byte, handshakeNonceSize+sha256.Size)
+	if _, err := io.ReadFull(conn, challenge); err != nil {
+		return errors.Wrapf(ErrHandshakeFailed, "'%s' challenge read error, %v", conn.RemoteAddr(), err)
+	}
+	acceptorNonce := challenge[:handshakeNonceSize]
+	if !hmac.Equal(challenge[handshakeNonceSize:], handshakeMAC(t.secret, "acceptor", dialerNonce, acceptorNonce)) {
+		return errors.Wrapf(ErrHandshakeFailed, "'%s' has different cluster secret", conn.RemoteAddr())
+	}
+
+	if err := writeFull(conn, handshakeMAC(t.secret, "dialer", dialerNonce, acceptorNonce)); err != nil {
+		return err
+	}
+
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(conn, status); err != nil || status[0] != handshakeAccepted {
+		return errors.Wrapf(ErrHandshakeFailed, "rejected by '%s'", conn.RemoteAddr())
+	}
+
+	return conn.SetDeadline(time.Time{})
+}
+
+/**
+Runs the acceptor side of the handshake, rejected connection is closed by the caller.
+ */
+func (t *streamHandshake) accept(conn net.Conn) error {
+
+	if err := conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return err
+	}
+
+	hello := make([]byte, len(handshakeMagic)+1+handshakeNonceSize)
+	if _, err := io.ReadFull(conn, hello); err != nil {
+		return errors.Wrapf(ErrHandshakeFailed, "hello read error, %v", err)
+	}
+	if !bytes.Equal(hello[:len(handshakeMagic)], handshakeMagic) {
+		return errors.Wrap(ErrHandshakeFailed, "not a raft peer")
+	}
+	if hello[len(handshakeMagic)] != handshakeVersion {
+		return errors.Wrapf(ErrHandshakeFailed, "unsupported version %d", hello[len(handshakeMagic)])
+	}
+	dialerNonce := hello[len(handshakeMagic)+1:]
+
+	acceptorNonce := make([]byte, handshakeNonceSize)
+	if _, err := rand.Read(acceptorNonce); err != nil {
+		return err
+	}
+
+	if err := writeFull(conn, append(acceptorNonce, handshakeMAC(t.secret, "acceptor", dialerNonce, acceptorNonce)...)); err != nil {
+		return err
+	}
+
+	response := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return errors.Wrapf(ErrHandshakeFailed, "response read error, %v", err)
+	}
+	if !hmac.Equal(response, handshakeMAC(t.secret, "dialer", dialerNonce, acceptorNonce)) {
+		return errors.Wrap(ErrHandshakeFailed, "different cluster secret")
+	}
+
+	if err := writeFull(conn, []byte{handshakeAccepted}); err != nil {
+		return err
+	}
+
+	return conn.SetDeadline(time.Time{})
+}
+
+/**
+Accepted connection that runs the handshake on the first read in the connection goroutine, so slow peers do not block Accept.
+ */
+type handshakeConn struct {
+	net.Conn
+	handshake *streamHandshake
+	once      sync.Once
+	err       error
+}
+
+func (t *handshakeConn) check() error {
+	t.once.Do(func() {
+		t.err = t.handshake.accept(t.Conn)
+		if t.err != nil {
+			t.handshake.log.Warn("RaftPeerRejected", zap.Stringer("remote", t.Conn.RemoteAddr()), zap.Error(t.err))
+			t.Conn.Close()
+		}
+	})
+	return t.err
+}
+
+func (t *handshakeConn) Read(p []byte) (int, error) {
+	if err := t.check(); err != nil {
+		return 0, err
+	}
+	return t.Conn.Read(p)
+}
+
+func (t *handshakeConn) Write(p []byte) (int, error) {
+	if err := t.check(); err != nil {
+		return 0, err
+	}
+	return t.Conn.Write(p)
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+package raftmod
+
+import (
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestHandshakeLayer(t *testing.T, secret string) *TCPStreamLayer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	layer := &TCPStreamLayer{listener: listener}
+	if secret != "" {
+		layer.handshakeOpt = &streamHandshake{secret: []byte(secret), log: zap.NewNop()}
+	}
+	return layer
+}
+
+func TestStreamHandshake(t *testing.T) {
+
+	server := newTestHandshakeLayer(t, "cluster-secret")
+	defer server.Close()
+
+	clientErr, serverErr := dialTestStreamLayer(newTestHandshakeLayer(t, "cluster-secret"), server)
+	require.NoError(t, clientErr)
+	require.NoError(t, serverErr)
+
+	// node of another cluster
+	clientErr, serverErr = dialTestStreamLayer(newTestHandshakeLayer(t, "other-secret"), server)
+	require.True(t, errors.Is(clientErr, ErrHandshakeFailed), "%v", clientErr)
+	require.True(t, errors.Is(serverErr, ErrHandshakeFailed), "%v", serverErr)
+
+	// node without secret sends raft RPC right away and waits for response
+	saved := handshakeTimeout
+	handshakeTimeout = 200 * time.Millisecond
+	defer func() {
+		handshakeTimeout = saved
+	}()
+	_, serverErr = dialTestStreamLayer(newTestHandshakeLayer(t, ""), server)
+	require.True(t, errors.Is(serverErr, ErrHandshakeFailed), "%v", serverErr)
+
+	// secret over TLS
+	ca := newTestCA(t)
+	tlsServer := newTestStreamLayer(t, ca.issue(t, "node1", false), ca, TLSModeMutual, nil)
+	defer tlsServer.Close()
+	tlsServer.handshakeOpt = &streamHandshake{secret: []byte("cluster-secret"), log: zap.NewNop()}
+
+	peers := map[raft.ServerAddress]raft.ServerID{raft.ServerAddress(tlsServer.Addr().String()): "node1"}
+	tlsClient := newTestStreamLayer(t, ca.issue(t, "node2", false), ca, TLSModeMutual, peers)
+	tlsClient.handshakeOpt = &streamHandshake{secret: []byte("cluster-secret"), log: zap.NewNop()}
+
+	clientErr, serverErr = dialTestStreamLayer(tlsClient, tlsServer)
+	require.NoError(t, clientErr)
+	require.NoError(t, serverErr)
+
+}
+
+func TestStreamHandshakeTimeout(t *testing.T) {
+
+	saved := handshakeTimeout
+	handshakeTimeout = 100 * time.Millisecond
+	defer func() {
+		handshakeTimeout = saved
+	}()
+
+	server := newTestHandshakeLayer(t, "cluster-secret")
+	defer server.Close()
+
+	// stray client that never sends anything
+	conn, err := net.Dial("tcp", server.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	accepted, err := server.Accept()
+	require.NoError(t, err)
+	_, err = accepted.Read(make([]byte, 1))
+	require.True(t, errors.Is(err, ErrHandshakeFailed), "%v", err)
+
+}
@@ -15,7 +15,6 @@
 package raftmod
 
 import (
-	"crypto/rand"
 	"crypto/tls"
 	"errors"
 	"github.com/hashicorp/raft"
@@ -32,29 +31,37 @@ var (
 type TCPStreamLayer struct {
 	advertise     net.Addr
 	listener      net.Listener
-	tlsConfigOpt  *tls.Config // can be nil
+	tlsOpt        *streamTLS // can be nil
+	handshakeOpt  *streamHandshake // can be nil
 }
 
 func newTCPTransport(listener net.Listener,
 	advertise net.Addr,
-	tlsConfigOpt *tls.Config, // can be nil
+	tlsOpt *streamTLS, // can be nil
+	handshakeOpt *streamHandshake, // can be nil
 	transportCreator func(stream raft.StreamLayer) *raft.NetworkTransport) (*raft.NetworkTransport, error) {
 
 	// Create stream
 	stream := &TCPStreamLayer{
 		advertise:    advertise,
 		listener:     listener,
-		tlsConfigOpt: tlsConfigOpt,
+		tlsOpt:       tlsOpt,
+		handshakeOpt: handshakeOpt,
 	}
 
 	// Verify that we have a usable advertise address
-	addr, ok := stream.Addr().(*net.TCPAddr)
-	if !ok {
+	switch addr := stream.Addr().(type) {
+	case *net.TCPAddr:
+		if addr.IP == nil || addr.IP.IsUnspecified() {
+			return nil, errNotAdvertisable
+		}
+	case HostAddr:
+		if host, _, err := net.SplitHostPort(addr.Address); err != nil || host == "" {
+			return nil, errNotAdvertisable
+		}
+	default:
 		return nil, errNotTCP
 	}
-	if addr.IP == nil || addr.IP.IsUnspecified() {
-		return nil, errNotAdvertisable
-	}
 
 	// Create the network transport
 	trans := transportCreator(stream)
@@ -64,26 +71,46 @@ func newTCPTransport(listener net.Listener,
 // Dial implements the StreamLayer interface.
 func (t *TCPStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
 
-	if t.tlsConfigOpt != nil {
-
-		tlsConf := &tls.Config{
-			Rand:                        rand.Reader,
-			Certificates:                t.tlsConfigOpt.Certificates,
-			ClientCAs:                   t.tlsConfigOpt.ClientCAs,
-			InsecureSkipVerify:          true,
-		}
+	deadline := time.Now().Add(timeout)
+	if timeout <= 0 {
+		deadline = time.Now().Add(handshakeTimeout)
+	}
 
+	var conn net.Conn
+	var err error
+	if t.tlsOpt != nil {
 		d := net.Dialer{Timeout: timeout}
-		return tls.DialWithDialer(&d, "tcp", string(address), tlsConf)
+		conn, err = tls.DialWithDialer(&d, "tcp", string(address), t.tlsOpt.clientConfig(address))
 	} else {
-		return net.DialTimeout("tcp", string(address), timeout)
+		conn, err = net.DialTimeout("tcp", string(address), timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t.handshakeOpt == nil {
+		return conn, nil
 	}
 
+	if err := t.handshakeOpt.dial(conn, deadline); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
 }
 
-// Accept implements the net.Listener interface.
+// Accept implements the net.Listener interface, TLS and cluster secret handshakes run on the first read in the connection goroutine.
 func (t *TCPStreamLayer) Accept() (c net.Conn, err error) {
-	return t.listener.Accept()
+	c, err = t.listener.Accept()
+	if err != nil {
+		return c, err
+	}
+	if t.tlsOpt != nil {
+		c = t.tlsOpt.accept(c)
+	}
+	if t.handshakeOpt != nil {
+		c = &handshakeConn{Conn: c, handshake: t.handshakeOpt}
+	}
+	return c, nil
 }
 
 // Close implements the net.Listener interface.
@@ -32,6 +32,21 @@ func (t EmptyAddr) String() string {
 	return ""
 }
 
+/**
+Advertised address with the host name, it is resolved by the dialer on every connection.
+ */
+type HostAddr struct {
+	Address string
+}
+
+func (t HostAddr) Network() string {
+	return "tcp"
+}
+
+func (t HostAddr) String() string {
+	return t.Address
+}
+
 func createDirIfNeeded(dir string, perm os.FileMode) error {
 	if _, err := os.Stat(dir); err != nil {
 		if err = os.Mkdir(dir, perm); err != nil {
@@ -45,12 +60,74 @@ func createDirIfNeeded(dir string, perm os.FileMode) error {
 }
 
 
+/**
+Default preferences of LocalIP, RFC1918 IPv4 networks are preferred over IPv6 unique local addresses.
+ */
+var defaultLocalIPPreferences = [][]string{
+	{
+		// don't check loopback ips
+		//"127.0.0.0/8",    // IPv4 loopback
+		//"::1/128",        // IPv6 loopback
+		//"fe80::/10",      // IPv6 link-local
+		"10.0.0.0/8",     // RFC1918
+		"172.16.0.0/12",  // RFC1918
+		"192.168.0.0/16", // RFC1918
+	},
+	{
+		"fc00::/7",       // RFC4193 unique local
+	},
+}
+
 // LocalIP get the host machine local IP address
 func LocalIP() (net.IP, error) {
+	return preferredLocalIP(defaultLocalIPPreferences)
+}
+
+/**
+Returns the interface address from the first matching CIDR of the list, the list order is the preference.
+Empty list means the default private networks.
+ */
+func PreferredLocalIP(cidrs []string) (net.IP, error) {
+	if len(cidrs) == 0 {
+		return LocalIP()
+	}
+	preferences := make([][]string, len(cidrs))
+	for i, cidr := range cidrs {
+		preferences[i] = []string{cidr}
+	}
+	return preferredLocalIP(preferences)
+}
+
+func preferredLocalIP(preferences [][]string) (net.IP, error) {
+
+	blocks := make([][]*net.IPNet, len(preferences))
+	for i, group := range preferences {
+		for _, cidr := range group {
+			_, block, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, errors.Errorf("invalid CIDR '%s', %v", cidr, err)
+			}
+			blocks[i] = append(blocks[i], block)
+		}
+	}
+
+	ips, err := interfaceIPs()
+	if err != nil {
+		return nil, err
+	}
+
+	if ip, ok := selectIP(ips, blocks); ok {
+		return ip, nil
+	}
+	return nil, errors.New("no IP")
+}
+
+func interfaceIPs() ([]net.IP, error) {
 	ifaces, err := net.Interfaces()
 	if err != nil {
 		return nil, err
 	}
+	var ips []net.IP
 	for _, i := range ifaces {
 		addrs, err := i.Addrs()
 		if err != nil {
@@ -58,43 +135,29 @@ func LocalIP() (net.IP, error) {
 		}
 
 		for _, addr := range addrs {
-			var ip net.IP
 			switch v := addr.(type) {
 			case *net.IPNet:
-				ip = v.IP
+				ips = append(ips, v.IP)
 			case *net.IPAddr:
-				ip = v.IP
-			}
-
-			if isPrivateIP(ip) {
-				return ip, nil
+				ips = append(ips, v.IP)
 			}
 		}
 	}
-
-	return nil, errors.New("no IP")
+	return ips, nil
 }
 
-func isPrivateIP(ip net.IP) bool {
-	var privateIPBlocks []*net.IPNet
-	for _, cidr := range []string{
-		// don't check loopback ips
-		//"127.0.0.0/8",    // IPv4 loopback
-		//"::1/128",        // IPv6 loopback
-		//"fe80::/10",      // IPv6 link-local
-		"10.0.0.0/8",     // RFC1918
-		"172.16.0.0/12",  // RFC1918
-		"192.168.0.0/16", // RFC1918
-	} {
-		_, block, _ := net.ParseCIDR(cidr)
-		privateIPBlocks = append(privateIPBlocks, block)
-	}
-
-	for _, block := range privateIPBlocks {
-		if block.Contains(ip) {
-			return true
+/**
+Returns the first IP in the order of interfaces that matches the most preferred group of networks.
+ */
+func selectIP(ips []net.IP, preferences [][]*net.IPNet) (net.IP, bool) {
+	for _, group := range preferences {
+		for _, ip := range ips {
+			for _, block := range group {
+				if block.Contains(ip) {
+					return ip, true
+				}
+			}
 		}
 	}
-
-	return false
-}
\ No newline at end of file
+	return nil, false
+}
@@ -0,0 +1,377 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"hash"
+	"io"
+	"sync"
+)
+
+/**
+SNAPSHOT DIGEST
+
+Place below encryption and compression, so the digest covers bytes on disk, snapshots without header are not verified.
+	magic        [4]byte  "RMSV"
+	version      uint8
+	payload      ...
+	digest       [32]byte  SHA-256 of payload
+*/
+
+var digestMagic = []byte("RMSV")
+
+const (
+	digestVersion    = 1
+	digestHeaderSize = 5
+)
+
+var ErrSnapshotDigestMismatch = errors.New("snapshot digest mismatch")
+
+type implVerifyingSnapshotStore struct {
+	delegate raft.SnapshotStore
+	log      *zap.Logger
+	// corrupt snapshots are only hidden, used by read-only tools on the live data directory
+	noQuarantine bool
+
+	// corrupt snapshots that could not be quarantined
+	corrupt   map[string]bool
+	corruptMu sync.RWMutex
+}
+
+type VerifyingOption func(*implVerifyingSnapshotStore)
+
+/**
+Corrupt snapshots are not moved in to quarantine, Open and Verify return the error and the snapshot is hidden from List.
+ */
+func WithoutQuarantine() VerifyingOption {
+	return func(t *implVerifyingSnapshotStore) {
+		t.noQuarantine = true
+	}
+}
+
+/**
+Stores SHA-256 digest of each snapshot and checks it on Open before returning the stream.
+Corrupt snapshots are moved in to quarantine if delegate implements SnapshotQuarantine, otherwise hidden from List,
+so raft falls back to the next-newest valid snapshot.
+ */
+func NewVerifyingSnapshotStore(store raft.SnapshotStore, log *zap.Logger, options ...VerifyingOption) VerifyingSnapshotStore {
+	t := &implVerifyingSnapshotStore{
+		delegate: store,
+		log:      log,
+		corrupt:  make(map[string]bool),
+	}
+	for _, opt := range options {
+		opt(t)
+	}
+	return t
+}
+
+func (t *implVerifyingSnapshotStore) Create(version raft.SnapshotVersion, index, term uint64, configuration raft.Configuration,
+	configurationIndex uint64, trans raft.Transport) (raft.SnapshotSink, error) {
+
+	sink, err := t.delegate.Create(version, index, term, configuration, configurationIndex, trans)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeFull(sink, digestHeader()); err != nil {
+		sink.Cancel()
+		return nil, err
+	}
+
+	return &implDigestSink{
+		SnapshotSink: sink,
+		hash:         sha256.New(),
+	}, nil
+}
+
+func digestHeader() []byte {
+	return append(append([]byte{}, digestMagic...), digestVersion)
+}
+
+func (t *implVerifyingSnapshotStore) Unwrap() raft.SnapshotStore {
+	return t.delegate
+}
+
+func (t *implVerifyingSnapshotStore) List() ([]*raft.SnapshotMeta, error) {
+	list, err := t.delegate.List()
+	if err != nil {
+		return nil, err
+	}
+	t.corruptMu.RLock()
+	defer t.corruptMu.RUnlock()
+	if len(t.corrupt) == 0 {
+		return list, nil
+	}
+	var result []*raft.SnapshotMeta
+	for _, meta := range list {
+		if !t.corrupt[meta.ID] {
+			result = append(result, meta)
+		}
+	}
+	return result, nil
+}
+
+/**
+Reads the snapshot twice, first time to verify the digest.
+ */
+func (t *implVerifyingSnapshotStore) Open(id string) (*raft.SnapshotMeta, io.ReadCloser, error) {
+
+	if err := t.Verify(id); err != nil {
+		return nil, nil, err
+	}
+
+	meta, source, err := t.delegate.Open(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	payload, size, err := openDigestStream(meta.Size, source)
+	if err != nil {
+		source.Close()
+		return nil, nil, err
+	}
+
+	verified := *meta
+	verified.Size = size
+	return &verified, &prefixedReadCloser{Reader: payload, Closer: source}, nil
+}
+
+/**
+Checks digest of the snapshot, quarantines it on mismatch.
+Returns nil for snapshots written without digest.
+ */
+func (t *implVerifyingSnapshotStore) Verify(id string) error {
+
+	t.corruptMu.RLock()
+	corrupt := t.corrupt[id]
+	t.corruptMu.RUnlock()
+	if corrupt {
+		return errors.Wrapf(ErrSnapshotDigestMismatch, "snapshot '%s'", id)
+	}
+
+	meta, source, err := t.delegate.Open(id)
+	if err == nil {
+		err = verifyDigestStream(meta.Size, source)
+		source.Close()
+	}
+
+	if errors.Is(err, ErrSnapshotDigestMismatch) || errors.Is(err, ErrSnapshotTruncated) {
+		t.quarantine(id, err)
+		return errors.Wrapf(err, "snapshot '%s'", id)
+	}
+	return err
+}
+
+func (t *implVerifyingSnapshotStore) quarantine(id string, cause error) {
+	if q, ok := t.delegate.(SnapshotQuarantine); ok && !t.noQuarantine {
+		err := q.Quarantine(id)
+		if err == nil {
+			t.log.Error("RaftSnapshotQuarantined", zap.String("id", id), zap.NamedError("cause", cause))
+			return
+		}
+		t.log.Error("RaftSnapshotQuarantine", zap.String("id", id), zap.Error(err))
+	}
+	t.corruptMu.Lock()
+	t.corrupt[id] = true
+	t.corruptMu.Unlock()
+	t.log.Error("RaftSnapshotCorrupted", zap.String("id", id), zap.NamedError("cause", cause))
+}
+
+/**
+Verifies all snapshots and reports results, called on startup before raft restores the snapshot.
+Returns the number of valid snapshots.
+ */
+func (t *implVerifyingSnapshotStore) Scan() (int, error) {
+
+	list, err := t.delegate.List()
+	if err != nil {
+		return 0, err
+	}
+
+	valid := 0
+	for _, meta := range list {
+		if err := t.Verify(meta.ID); err != nil {
+			if !errors.Is(err, ErrSnapshotDigestMismatch) && !errors.Is(err, ErrSnapshotTruncated) {
+				t.log.Error("RaftSnapshotVerify", zap.String("id", meta.ID), zap.Error(err))
+			}
+			continue
+		}
+		valid++
+	}
+
+	t.log.Info("RaftSnapshotScan", zap.Int("snapshots", len(list)), zap.Int("valid", valid))
+	return valid, nil
+}
+
+/**
+Rewrites payload keeping the digest valid, used by the key rotation.
+ */
+func (t *implVerifyingSnapshotStore) Rewrite(id string, fn func(meta *raft.SnapshotMeta, source io.Reader, sink io.Writer) error) error {
+
+	rewriter, ok := t.delegate.(SnapshotRewriter)
+	if !ok {
+		return errors.New("snapshot store does not support rewrite")
+	}
+
+	return rewriter.Rewrite(id, func(meta *raft.SnapshotMeta, source io.Reader, sink io.Writer) error {
+
+		payload, size, err := openDigestStream(meta.Size, source)
+		if err != nil {
+			return err
+		}
+
+		verified := *meta
+		verified.Size = size
+
+		if err := writeFull(sink, digestHeader()); err != nil {
+			return err
+		}
+		digest := &implDigestSink{SnapshotSink: &writerSink{Writer: sink, id: id}, hash: sha256.New()}
+		if err := fn(&verified, payload, digest); err != nil {
+			return err
+		}
+		return digest.Close()
+	})
+}
+
+func (t *implVerifyingSnapshotStore) SetAttribute(id, name string, value []byte) error {
+	attributes, ok := t.delegate.(SnapshotAttributes)
+	if !ok {
+		return errors.New("snapshot store does not support attributes")
+	}
+	return attributes.SetAttribute(id, name, value)
+}
+
+func (t *implVerifyingSnapshotStore) Attribute(id, name string) ([]byte, error) {
+	attributes, ok := t.delegate.(SnapshotAttributes)
+	if !ok {
+		return nil, errors.New("snapshot store does not support attributes")
+	}
+	return attributes.Attribute(id, name)
+}
+
+/**
+Returns the payload reader that checks the digest at the end and the payload size.
+Snapshots without header are returned as is.
+ */
+func openDigestStream(size int64, source io.Reader) (io.Reader, int64, error) {
+
+	header := make([]byte, digestHeaderSize)
+	n, err := io.ReadFull(source, header)
+	if err == nil && bytes.Equal(header[:len(digestMagic)], digestMagic) {
+		if header[len(digestMagic)] != digestVersion {
+			return nil, 0, errors.Errorf("unsupported snapshot digest version %d", header[len(digestMagic)])
+		}
+		payloadSize := size - digestHeaderSize - sha256.Size
+		if payloadSize < 0 {
+			return nil, 0, ErrSnapshotTruncated
+		}
+		return &implDigestReader{source: source, remaining: payloadSize, hash: sha256.New()}, payloadSize, nil
+	}
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, 0, err
+	}
+
+	return io.MultiReader(bytes.NewReader(header[:n]), source), size, nil
+}
+
+func verifyDigestStream(size int64, source io.Reader) error {
+	payload, _, err := openDigestStream(size, source)
+	if err != nil {
+		return err
+	}
+	if _, ok := payload.(*implDigestReader); !ok {
+		// written without digest
+		return nil
+	}
+	_, err = io.Copy(io.Discard, payload)
+	return err
+}
+
+type implDigestSink struct {
+	raft.SnapshotSink
+	hash   hash.Hash
+	closed bool
+}
+
+func (t *implDigestSink) Write(p []byte) (int, error) {
+	n, err := t.SnapshotSink.Write(p)
+	t.hash.Write(p[:n])
+	return n, err
+}
+
+func (t *implDigestSink) Close() error {
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	if err := writeFull(t.SnapshotSink, t.hash.Sum(nil)); err != nil {
+		t.SnapshotSink.Cancel()
+		return err
+	}
+	return t.SnapshotSink.Close()
+}
+
+type implDigestReader struct {
+	source    io.Reader
+	remaining int64
+	hash      hash.Hash
+	err       error
+}
+
+func (t *implDigestReader) Read(p []byte) (int, error) {
+	if t.err != nil {
+		return 0, t.err
+	}
+	if t.remaining == 0 {
+		t.err = t.check()
+		return 0, t.err
+	}
+	if int64(len(p)) > t.remaining {
+		p = p[:t.remaining]
+	}
+	n, err := t.source.Read(p)
+	t.hash.Write(p[:n])
+	t.remaining -= int64(n)
+	if err == io.EOF && t.remaining > 0 {
+		t.err = ErrSnapshotTruncated
+		return n, t.err
+	}
+	if err != nil && err != io.EOF {
+		t.err = err
+		return n, err
+	}
+	return n, nil
+}
+
+func (t *implDigestReader) check() error {
+	digest := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(t.source, digest); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrSnapshotTruncated
+		}
+		return err
+	}
+	if !bytes.Equal(digest, t.hash.Sum(nil)) {
+		return ErrSnapshotDigestMismatch
+	}
+	return io.EOF
+}
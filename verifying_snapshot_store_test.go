@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyingSnapshotStore(t *testing.T) {
+
+	dir, err := os.MkdirTemp(os.TempDir(), "raftmodtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	snapshots, err := NewFileSnapshotStore(dir, 5, nil)
+	require.NoError(t, err)
+
+	store := NewVerifyingSnapshotStore(snapshots, zap.NewNop())
+
+	welcome := "Hello World!"
+	for i := uint64(1); i <= 2; i++ {
+		sink, err := store.Create(raft.SnapshotVersionMax, 100 * i, 1, raft.Configuration{}, 0, nil)
+		require.NoError(t, err)
+		_, err = sink.Write([]byte(welcome))
+		require.NoError(t, err)
+		require.NoError(t, sink.Close())
+	}
+
+	valid, err := store.Scan()
+	require.NoError(t, err)
+	require.Equal(t, 2, valid)
+
+	list, err := store.List()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(list))
+
+	meta, reader, err := store.Open(list[0].ID)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(welcome)), meta.Size)
+	content, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, welcome, string(content))
+	require.NoError(t, reader.Close())
+
+	// corrupt the newest snapshot
+	statePath := filepath.Join(dir, fileSnapshotsDir, list[0].ID, fileSnapshotState)
+	state, err := os.ReadFile(statePath)
+	require.NoError(t, err)
+	state[digestHeaderSize] ^= 1
+	require.NoError(t, os.WriteFile(statePath, state, 0644))
+
+	// read-only store fails without moving the snapshot
+	readOnly := NewVerifyingSnapshotStore(snapshots, zap.NewNop(), WithoutQuarantine())
+	_, _, err = readOnly.Open(list[0].ID)
+	require.True(t, errors.Is(err, ErrSnapshotDigestMismatch), "%v", err)
+	_, err = os.Stat(statePath)
+	require.NoError(t, err)
+
+	valid, err = store.Scan()
+	require.NoError(t, err)
+	require.Equal(t, 1, valid)
+
+	_, err = os.Stat(filepath.Join(dir, fileSnapshotQuarantineDir, list[0].ID))
+	require.NoError(t, err)
+
+	// falls back to the next-newest snapshot
+	list, err = store.List()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(list))
+	require.Equal(t, uint64(100), list[0].Index)
+
+}
+
+func TestDigestStream(t *testing.T) {
+
+	sink := &bufferSink{}
+	require.NoError(t, writeFull(sink, digestHeader()))
+	digest := &implDigestSink{SnapshotSink: sink, hash: sha256.New()}
+	_, err := digest.Write([]byte("Hello World!"))
+	require.NoError(t, err)
+	require.NoError(t, digest.Close())
+
+	stored := sink.Bytes()
+	require.NoError(t, verifyDigestStream(int64(len(stored)), bytes.NewReader(stored)))
+
+	tampered := append([]byte{}, stored...)
+	tampered[digestHeaderSize] ^= 1
+	require.Equal(t, ErrSnapshotDigestMismatch, verifyDigestStream(int64(len(tampered)), bytes.NewReader(tampered)))
+
+	truncated := stored[:len(stored)-1]
+	require.Equal(t, ErrSnapshotTruncated, verifyDigestStream(int64(len(stored)), bytes.NewReader(truncated)))
+
+	// written without digest
+	require.NoError(t, verifyDigestStream(5, bytes.NewReader([]byte("plain"))))
+
+}
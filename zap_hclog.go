@@ -0,0 +1,242 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+	"io"
+	"log"
+	"strings"
+)
+
+/**
+HCLOG ADAPTER
+
+Routes hashicorp raft logging in to zap logger, TRACE level is emitted as zap DEBUG.
+*/
+
+type implZapLogger struct {
+	root   *zap.Logger
+	log    *zap.Logger
+	name   string
+	fields []zap.Field
+	level  *atomic.Int32  // shared with sub-loggers
+}
+
+/**
+Creates logger with the given level, unknown level falls back to hclog.DefaultLevel, use ParseLogLevel to validate it.
+ */
+func NewZapLogger(log *zap.Logger, name string, level string) hclog.Logger {
+	lvl, err := ParseLogLevel(level)
+	if err != nil {
+		lvl = hclog.DefaultLevel
+	}
+	return newZapLogger(log, name, nil, atomic.NewInt32(int32(lvl)))
+}
+
+/**
+Parses hclog level name, the name is case insensitive.
+ */
+func ParseLogLevel(level string) (hclog.Level, error) {
+	lvl := hclog.LevelFromString(level)
+	if lvl == hclog.NoLevel {
+		return lvl, errors.Errorf("unknown log level '%s', expected 'TRACE', 'DEBUG', 'INFO', 'WARN' or 'ERROR'", level)
+	}
+	return lvl, nil
+}
+
+func newZapLogger(root *zap.Logger, name string, fields []zap.Field, level *atomic.Int32) *implZapLogger {
+	l := root
+	if name != "" {
+		l = l.Named(name)
+	}
+	if len(fields) > 0 {
+		l = l.With(fields...)
+	}
+	return &implZapLogger{
+		root:   root,
+		log:    l,
+		name:   name,
+		fields: fields,
+		level:  level,
+	}
+}
+
+func (t *implZapLogger) Trace(msg string, args ...interface{}) {
+	if t.IsTrace() {
+		t.log.Debug(msg, toZapFields(args)...)
+	}
+}
+
+func (t *implZapLogger) Debug(msg string, args ...interface{}) {
+	if t.IsDebug() {
+		t.log.Debug(msg, toZapFields(args)...)
+	}
+}
+
+func (t *implZapLogger) Info(msg string, args ...interface{}) {
+	if t.IsInfo() {
+		t.log.Info(msg, toZapFields(args)...)
+	}
+}
+
+func (t *implZapLogger) Warn(msg string, args ...interface{}) {
+	if t.IsWarn() {
+		t.log.Warn(msg, toZapFields(args)...)
+	}
+}
+
+func (t *implZapLogger) Error(msg string, args ...interface{}) {
+	if t.IsError() {
+		t.log.Error(msg, toZapFields(args)...)
+	}
+}
+
+func (t *implZapLogger) enabled(level hclog.Level) bool {
+	return hclog.Level(t.level.Load()) <= level
+}
+
+func (t *implZapLogger) IsTrace() bool {
+	return t.enabled(hclog.Trace) && t.log.Core().Enabled(zap.DebugLevel)
+}
+
+func (t *implZapLogger) IsDebug() bool {
+	return t.enabled(hclog.Debug) && t.log.Core().Enabled(zap.DebugLevel)
+}
+
+func (t *implZapLogger) IsInfo() bool {
+	return t.enabled(hclog.Info) && t.log.Core().Enabled(zap.InfoLevel)
+}
+
+func (t *implZapLogger) IsWarn() bool {
+	return t.enabled(hclog.Warn) && t.log.Core().Enabled(zap.WarnLevel)
+}
+
+func (t *implZapLogger) IsError() bool {
+	return t.enabled(hclog.Error) && t.log.Core().Enabled(zap.ErrorLevel)
+}
+
+func (t *implZapLogger) With(args ...interface{}) hclog.Logger {
+	fields := make([]zap.Field, 0, len(t.fields)+len(args)/2+1)
+	fields = append(fields, t.fields...)
+	fields = append(fields, toZapFields(args)...)
+	return newZapLogger(t.root, t.name, fields, t.level)
+}
+
+func (t *implZapLogger) Named(name string) hclog.Logger {
+	if t.name != "" {
+		name = t.name + "." + name
+	}
+	return newZapLogger(t.root, name, t.fields, t.level)
+}
+
+func (t *implZapLogger) ResetNamed(name string) hclog.Logger {
+	return newZapLogger(t.root, name, t.fields, t.level)
+}
+
+func (t *implZapLogger) SetLevel(level hclog.Level) {
+	t.level.Store(int32(level))
+}
+
+func (t *implZapLogger) StandardLogger(opts *hclog.StandardLoggerOptions) *log.Logger {
+	return log.New(t.StandardWriter(opts), "", 0)
+}
+
+func (t *implZapLogger) StandardWriter(opts *hclog.StandardLoggerOptions) io.Writer {
+	if opts == nil {
+		opts = &hclog.StandardLoggerOptions{}
+	}
+	return &implZapWriter{
+		log:         t,
+		inferLevels: opts.InferLevels,
+		forceLevel:  opts.ForceLevel,
+	}
+}
+
+func toZapFields(args []interface{}) []zap.Field {
+	fields := make([]zap.Field, 0, len(args)/2+1)
+	n := len(args)
+	for i := 0; i+1 < n; i += 2 {
+		key, ok := args[i].(string)
+		if !ok {
+			key = fmt.Sprint(args[i])
+		}
+		fields = append(fields, zap.Any(key, args[i+1]))
+	}
+	if n%2 == 1 {
+		fields = append(fields, zap.Any("EXTRA_VALUE_AT_END", args[n-1]))
+	}
+	return fields
+}
+
+/**
+Standard logger writer that parses '[LEVEL]' prefixes emitted by legacy code.
+ */
+
+type implZapWriter struct {
+	log         hclog.Logger
+	inferLevels bool
+	forceLevel  hclog.Level
+}
+
+func (t *implZapWriter) Write(data []byte) (int, error) {
+	str := string(bytes.TrimRight(data, " \t\n"))
+
+	level, msg := pickLevel(str)
+	if t.forceLevel != hclog.NoLevel {
+		level = t.forceLevel
+	} else if !t.inferLevels {
+		level, msg = hclog.Info, str
+	}
+
+	switch level {
+	case hclog.Trace:
+		t.log.Trace(msg)
+	case hclog.Debug:
+		t.log.Debug(msg)
+	case hclog.Warn:
+		t.log.Warn(msg)
+	case hclog.Error:
+		t.log.Error(msg)
+	default:
+		t.log.Info(msg)
+	}
+
+	return len(data), nil
+}
+
+func pickLevel(str string) (hclog.Level, string) {
+	for _, p := range []struct {
+		prefix string
+		level  hclog.Level
+	}{
+		{"[TRACE]", hclog.Trace},
+		{"[DEBUG]", hclog.Debug},
+		{"[INFO]", hclog.Info},
+		{"[WARN]", hclog.Warn},
+		{"[ERROR]", hclog.Error},
+		{"[ERR]", hclog.Error},
+	} {
+		if strings.HasPrefix(str, p.prefix) {
+			return p.level, strings.TrimSpace(str[len(p.prefix):])
+		}
+	}
+	return hclog.Info, str
+}
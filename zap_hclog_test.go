@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2022-2023 Zander Schwid & Co. LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package raftmod
+
+import (
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"testing"
+)
+
+func newTestZapLogger(level string) (hclog.Logger, *observer.ObservedLogs) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	return NewZapLogger(zap.New(core), "raft", level), logs
+}
+
+func TestZapLoggerLevels(t *testing.T) {
+
+	for _, c := range []struct {
+		level   string
+		emitted []zapcore.Level
+	}{
+		// TRACE is emitted as DEBUG
+		{"TRACE", []zapcore.Level{zapcore.DebugLevel, zapcore.DebugLevel, zapcore.InfoLevel, zapcore.WarnLevel, zapcore.ErrorLevel}},
+		{"DEBUG", []zapcore.Level{zapcore.DebugLevel, zapcore.InfoLevel, zapcore.WarnLevel, zapcore.ErrorLevel}},
+		{"INFO", []zapcore.Level{zapcore.InfoLevel, zapcore.WarnLevel, zapcore.ErrorLevel}},
+		{"WARN", []zapcore.Level{zapcore.WarnLevel, zapcore.ErrorLevel}},
+		{"ERROR", []zapcore.Level{zapcore.ErrorLevel}},
+		// unknown level falls back to the default
+		{"verbose", []zapcore.Level{zapcore.InfoLevel, zapcore.WarnLevel, zapcore.ErrorLevel}},
+	} {
+		logger, logs := newTestZapLogger(c.level)
+		logger.Trace("trace")
+		logger.Debug("debug")
+		logger.Info("info")
+		logger.Warn("warn")
+		logger.Error("error")
+
+		var emitted []zapcore.Level
+		for _, entry := range logs.All() {
+			emitted = append(emitted, entry.Level)
+		}
+		require.Equal(t, c.emitted, emitted, c.level)
+	}
+
+	// level is shared with sub-loggers
+	logger, logs := newTestZapLogger("INFO")
+	named := logger.Named("snapshot")
+	require.False(t, named.IsDebug())
+	logger.SetLevel(hclog.Debug)
+	require.True(t, named.IsDebug())
+	named.Debug("debug")
+	require.Equal(t, 1, logs.Len())
+
+}
+
+func TestZapLoggerWithNamed(t *testing.T) {
+
+	logger, logs := newTestZapLogger("INFO")
+
+	logger.With("peer", "node1").Named("replication").Info("message", "index", 5, "odd")
+	logger.Named("snapshot").Named("store").Info("message")
+	logger.Named("snapshot").ResetNamed("fsm").Info("message")
+	logger.With("a", 1).With("b", 2).Info("message")
+
+	entries := logs.All()
+	require.Equal(t, 4, len(entries))
+
+	require.Equal(t, "raft.replication", entries[0].LoggerName)
+	require.Equal(t, map[string]interface{}{"peer": "node1", "index": int64(5), "EXTRA_VALUE_AT_END": "odd"}, entries[0].ContextMap())
+
+	require.Equal(t, "raft.snapshot.store", entries[1].LoggerName)
+	require.Equal(t, "fsm", entries[2].LoggerName)
+
+	require.Equal(t, "raft", entries[3].LoggerName)
+	require.Equal(t, map[string]interface{}{"a": int64(1), "b": int64(2)}, entries[3].ContextMap())
+
+	// standard logger infers levels from prefixes
+	std := logger.StandardLogger(&hclog.StandardLoggerOptions{InferLevels: true})
+	std.Print("[WARN] raft: slow disk")
+	std.Print("[ERR] raft: failed")
+	entry := logs.All()[4]
+	require.Equal(t, zapcore.WarnLevel, entry.Level)
+	require.Equal(t, "raft: slow disk", entry.Message)
+	require.Equal(t, zapcore.ErrorLevel, logs.All()[5].Level)
+
+	logger.StandardLogger(nil).Print("[WARN] as is")
+	entry = logs.All()[6]
+	require.Equal(t, zapcore.InfoLevel, entry.Level)
+	require.Equal(t, "[WARN] as is", entry.Message)
+
+}
+
+func TestParseLogLevel(t *testing.T) {
+
+	for _, c := range []struct {
+		value string
+		level hclog.Level
+		valid bool
+	}{
+		{"TRACE", hclog.Trace, true},
+		{"debug", hclog.Debug, true},
+		{"INFO", hclog.Info, true},
+		{" warn ", hclog.Warn, true},
+		{"ERROR", hclog.Error, true},
+		{"OFF", hclog.NoLevel, false},
+		{"", hclog.NoLevel, false},
+		{"verbose", hclog.NoLevel, false},
+	} {
+		level, err := ParseLogLevel(c.value)
+		if c.valid {
+			require.NoError(t, err, c.value)
+			require.Equal(t, c.level, level, c.value)
+		} else {
+			require.Error(t, err, c.value)
+		}
+	}
+
+}